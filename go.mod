@@ -6,13 +6,17 @@ require (
 	github.com/cactus/go-statsd-client/statsd v0.0.0-20200728222731-a2baea3bbfc6
 	github.com/gophercloud/gophercloud v0.12.0
 	github.com/gophercloud/utils v0.0.0-20200508015959-b0167b94122c
+	github.com/jlaffaye/ftp v0.0.0-20200812143550-39e3779af0db
 	github.com/jpillora/longestcommon v0.0.0-20161227235612-adb9d91ee629 // indirect
 	github.com/kr/pretty v0.2.1 // indirect
 	github.com/majewsky/schwift v0.0.0-20200416120220-80c09ef2a88d
+	github.com/pkg/sftp v1.11.0
 	github.com/sapcc/go-bits v0.0.0-20200719195243-6f202ca5296a
 	github.com/ulikunitz/xz v0.5.7
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/mod v0.3.0
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
 	gopkg.in/yaml.v2 v2.3.0
 	pault.ag/go/debian v0.0.0-20190530135403-b831f604d664
 )
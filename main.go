@@ -93,22 +93,33 @@ func runPipeline(config *objects.Configuration, report chan<- actors.ReportEvent
 	//start the pipeline actors
 	var wg sync.WaitGroup
 	var wgTransfer sync.WaitGroup
-	queue1 := make(chan objects.File, 10)              //will be closed by scraper when it's done
+	queue0 := make(chan objects.File, 10)              //will be closed by scraper when it's done
+	queue1 := make(chan objects.File, 10)              //will be closed by symlink resolver when it's done
 	queue2 := make(chan actors.FileInfoForCleaner, 10) //will be closed by us when all transferors are done
 
 	actors.Start(&actors.Scraper{
 		Context: ctx,
 		Jobs:    config.Jobs,
-		Output:  queue1,
+		Output:  queue0,
 		Report:  report,
 	}, &wg)
 
+	actors.Start(&actors.SymlinkResolver{
+		Context: ctx,
+		Jobs:    config.Jobs,
+		Input:   queue0,
+		Output:  queue1,
+	}, &wg)
+
+	var tracker actors.TransferTracker
+
 	for i := uint(0); i < config.WorkerCounts.Transfer; i++ {
 		actors.Start(&actors.Transferor{
 			Context: ctx,
 			Input:   queue1,
 			Output:  queue2,
 			Report:  report,
+			Tracker: &tracker,
 		}, &wg, &wgTransfer)
 	}
 
@@ -31,6 +31,7 @@ import (
 //FileInfoForCleaner contains information about a transferred file for the Cleaner actor.
 type FileInfoForCleaner struct {
 	objects.File
+	Target *objects.SwiftLocation
 	Failed bool
 }
 
@@ -44,60 +45,100 @@ type Cleaner struct {
 
 //Run implements the Actor interface.
 func (c *Cleaner) Run() {
-	isJobFailed := make(map[*objects.Job]bool)
-	isFileTransferred := make(map[*objects.Job]map[string]bool) //string = object name incl. prefix (if any)
+	//since a failure on one target does not affect the other targets of the
+	//same job, cleanup is decided per target
+	jobForTarget := make(map[*objects.SwiftLocation]*objects.Job)
+	isTargetFailed := make(map[*objects.SwiftLocation]bool)
+	isFileTransferred := make(map[*objects.SwiftLocation]map[string]bool) //string = object name incl. prefix (if any)
 
 	//collect information about transferred files from the transferors
 	//(we don't need to check Context.Done in the loop; when the process is
 	//interrupted, main() will close our Input and we will move on)
 	for info := range c.Input {
-		//ignore all files in jobs where no cleanup is configured
+		//ignore all files in jobs where no cleanup is configured (unless a
+		//snapshot needs to be published at the end)
 		job := info.File.Job
-		if job.Cleanup.Strategy == objects.KeepUnknownFiles {
+		if job.Cleanup.Strategy == objects.KeepUnknownFiles && job.Snapshots == nil {
 			continue
 		}
 
+		jobForTarget[info.Target] = job
 		if info.Failed {
-			isJobFailed[job] = true
+			isTargetFailed[info.Target] = true
 		}
 
-		m, exists := isFileTransferred[job]
+		m, exists := isFileTransferred[info.Target]
 		if !exists {
 			m = make(map[string]bool)
-			isFileTransferred[job] = m
+			isFileTransferred[info.Target] = m
 		}
-		m[info.File.TargetObject().Name()] = true
+		m[info.File.TargetObject(info.Target).Name()] = true
 	}
 	if c.Context.Err() != nil {
 		logg.Info("skipping cleanup phase: interrupt was received")
+		c.discardSnapshots(jobForTarget)
 		return
 	}
-	if len(isJobFailed) > 0 {
+
+	//publish snapshots that were written completely, discard the others (if
+	//publishing fails, PublishSnapshot() discards the snapshot by itself)
+	for target, job := range jobForTarget {
+		if job.Snapshots == nil {
+			continue
+		}
+		var err error
+		if isTargetFailed[target] || job.ScrapingFailed {
+			err = target.DiscardSnapshot()
+		} else {
+			err = target.PublishSnapshot(*job.Snapshots)
+		}
+		if err != nil {
+			logg.Error(err.Error())
+		}
+	}
+	if len(isTargetFailed) > 0 {
 		logg.Info(
-			"skipping cleanup phase for %d job(s) because of failed file transfers",
-			len(isJobFailed))
+			"skipping cleanup phase for %d target(s) because of failed file transfers",
+			len(isTargetFailed))
 	}
 
 	//perform cleanup if it is safe to do so
-	for job, transferred := range isFileTransferred {
+	for target, transferred := range isFileTransferred {
 		if c.Context.Err() != nil {
 			//interrupt received
 			return
 		}
-		if !isJobFailed[job] {
-			c.performCleanup(job, transferred)
+		job := jobForTarget[target]
+		if job.ScrapingFailed && job.Snapshots == nil && job.Cleanup.Strategy != objects.KeepUnknownFiles {
+			logg.Info("skipping cleanup phase for %s because the source was not listed completely", target.ContainerName)
+			continue
+		}
+		if !isTargetFailed[target] && job.Snapshots == nil {
+			c.performCleanup(job, target, transferred)
+		}
+	}
+}
+
+func (c *Cleaner) discardSnapshots(jobForTarget map[*objects.SwiftLocation]*objects.Job) {
+	for target, job := range jobForTarget {
+		if job.Snapshots == nil {
+			continue
+		}
+		err := target.DiscardSnapshot()
+		if err != nil {
+			logg.Error(err.Error())
 		}
 	}
 }
 
-func (c *Cleaner) performCleanup(job *objects.Job, isFileTransferred map[string]bool) {
+func (c *Cleaner) performCleanup(job *objects.Job, target *objects.SwiftLocation, isFileTransferred map[string]bool) {
 	//collect objects to cleanup
 	var objs []*schwift.Object
-	for objectName := range job.Target.FileExists {
+	for objectName := range target.FileExists {
 		if isFileTransferred[objectName] {
 			continue
 		}
-		objs = append(objs, job.Target.Container.Object(objectName))
+		objs = append(objs, target.Container.Object(objectName))
 	}
 	sort.Slice(objs, func(i, j int) bool {
 		return objs[i].Name() < objs[j].Name()
@@ -115,7 +156,7 @@ func (c *Cleaner) performCleanup(job *objects.Job, isFileTransferred map[string]
 		}
 
 	case objects.DeleteUnknownFiles:
-		numDeleted, _, err := job.Target.Container.Account().BulkDelete(objs, nil, nil)
+		numDeleted, _, err := target.Container.Account().BulkDelete(objs, nil, nil)
 		c.Report <- ReportEvent{IsCleanup: true, CleanedUpObjectCount: int64(numDeleted)}
 		if err != nil {
 			logg.Error("cleanup of %d objects on target side failed: %s", (len(objs) - numDeleted), err.Error())
@@ -0,0 +1,102 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package actors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sapcc/swift-http-import/pkg/objects"
+)
+
+func TestCleanupIsSkippedOnlyForFailedTarget(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+	swift.addObject("AUTH_source/source/file", "hello", nil)
+	swift.addObject("AUTH_target/mirror1/stale", "old", nil)
+	swift.addObject("AUTH_target/mirror2/stale", "old", nil)
+	swift.failPUT["/v1/AUTH_target/mirror2/file"] = true
+
+	job := compileTestJob(t, fmt.Sprintf(`
+from:
+  storage_url: %[1]s/v1/AUTH_source
+  auth_token: unused
+  container: source
+to:
+  - storage_url: %[1]s/v1/AUTH_target
+    auth_token: unused
+    container: mirror1
+  - storage_url: %[1]s/v1/AUTH_target
+    auth_token: unused
+    container: mirror2
+cleanup:
+  strategy: delete
+`, swift.URL))
+	specs, lerr := job.Source.ListAllFiles()
+	if lerr != nil {
+		t.Fatal(lerr.FullMessage())
+	}
+
+	input := make(chan objects.File, len(specs))
+	for _, spec := range specs {
+		input <- objects.File{Job: job, Spec: spec}
+	}
+	close(input)
+	cleanerInput := make(chan FileInfoForCleaner, 10)
+	report := make(chan ReportEvent, 10)
+	(&Transferor{
+		Context: context.Background(),
+		Input:   input,
+		Output:  cleanerInput,
+		Report:  report,
+		Tracker: &TransferTracker{},
+	}).Run()
+	close(cleanerInput)
+	(&Cleaner{Context: context.Background(), Input: cleanerInput, Report: report}).Run()
+	close(report)
+
+	if swift.object("AUTH_target/mirror1/file") == nil {
+		t.Error("expected file to be transferred into the first target")
+	}
+	if swift.object("AUTH_target/mirror1/stale") != nil {
+		t.Error("expected cleanup of the first target to delete the unknown object")
+	}
+	if swift.object("AUTH_target/mirror2/stale") == nil {
+		t.Error("expected cleanup of the failed second target to be skipped")
+	}
+
+	var transferResults []objects.TransferResult
+	var cleanedUp int64
+	for event := range report {
+		if event.IsFile {
+			transferResults = append(transferResults, event.FileTransferResult)
+		}
+		if event.IsCleanup {
+			cleanedUp += event.CleanedUpObjectCount
+		}
+	}
+	if len(transferResults) != 1 || transferResults[0] != objects.TransferFailed {
+		t.Errorf("expected the file to be reported as failed once, got %v", transferResults)
+	}
+	if cleanedUp != 1 {
+		t.Errorf("expected 1 object to be cleaned up, got %d", cleanedUp)
+	}
+}
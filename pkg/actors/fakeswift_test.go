@@ -0,0 +1,324 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package actors
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/swift-http-import/pkg/objects"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//fakeSwift is a minimal in-memory Swift cluster for the actor tests. It is a
+//stripped-down version of the one in package objects: it supports containers,
+//plain objects, symlinks and bulk uploads, but no large objects, server-side
+//copies or authentication.
+type fakeSwift struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	containers map[string]bool             //key = "/v1/ACCOUNT/CONTAINER"
+	objects    map[string]*fakeSwiftObject //key = "/v1/ACCOUNT/CONTAINER/OBJECT"
+	failPUT    map[string]bool             //key = "/v1/ACCOUNT/CONTAINER/OBJECT"
+	requests   []string                    //e.g. "PUT /v1/ACCOUNT/CONTAINER/OBJECT?QUERY"
+}
+
+const fakeSwiftCapabilities = `{"swift":{"version":"2.25.0"},"bulk_upload":{},"symlink":{}}`
+
+type fakeSwiftObject struct {
+	Contents     []byte
+	Headers      http.Header
+	LastModified time.Time
+}
+
+func newFakeSwift() *fakeSwift {
+	s := &fakeSwift{
+		containers: make(map[string]bool),
+		objects:    make(map[string]*fakeSwiftObject),
+		failPUT:    make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+//Adds an object at the given path ("ACCOUNT/CONTAINER/OBJECT"), and creates
+//the container if necessary.
+func (s *fakeSwift) addObject(objectPath, contents string, hdr http.Header) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fields := strings.SplitN(objectPath, "/", 3)
+	s.containers["/v1/"+fields[0]+"/"+fields[1]] = true
+	if hdr == nil {
+		hdr = make(http.Header)
+	}
+	hash := md5.Sum([]byte(contents))
+	hdr.Set("Etag", hex.EncodeToString(hash[:]))
+	s.objects["/v1/"+objectPath] = &fakeSwiftObject{Contents: []byte(contents), Headers: hdr, LastModified: time.Now()}
+}
+
+//Returns the object at the given path ("ACCOUNT/CONTAINER/OBJECT"), or nil.
+func (s *fakeSwift) object(objectPath string) *fakeSwiftObject {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects["/v1/"+objectPath]
+}
+
+//Returns the index of the first request with the given method and path
+//("ACCOUNT/CONTAINER/OBJECT?QUERY"), or -1.
+func (s *fakeSwift) requestIndex(request string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for idx, r := range s.requests {
+		if r == request {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (s *fakeSwift) handle(w http.ResponseWriter, r *http.Request) {
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+
+	if r.URL.Path == "/info" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fakeSwiftCapabilities))
+		return
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 3)
+	switch {
+	case len(fields) == 1 || (len(fields) == 2 && fields[1] == ""):
+		w.WriteHeader(http.StatusNoContent)
+	case len(fields) == 2 || (len(fields) == 3 && fields[2] == ""):
+		s.handleContainer(w, r, contents, "/v1/"+fields[0]+"/"+fields[1])
+	default:
+		s.handleObject(w, r, contents, "/v1/"+fields[0], "/v1/"+fields[0]+"/"+fields[1], r.URL.Path)
+	}
+}
+
+func (s *fakeSwift) handleContainer(w http.ResponseWriter, r *http.Request, contents []byte, containerPath string) {
+	switch r.Method {
+	case "PUT":
+		if r.URL.Query().Get("extract-archive") == "tar" {
+			s.extractArchive(w, contents, containerPath)
+			return
+		}
+		if s.containers[containerPath] {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			s.containers[containerPath] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "HEAD":
+		if s.containers[containerPath] {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.NotFound(w, r)
+		}
+	case "GET":
+		if !s.containers[containerPath] {
+			http.NotFound(w, r)
+			return
+		}
+		//only recursive listings are supported
+		query := r.URL.Query()
+		var names []string
+		for objectPath := range s.objects {
+			name := strings.TrimPrefix(objectPath, containerPath+"/")
+			if name != objectPath && strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if query.Get("format") != "json" {
+			w.Header().Set("Content-Type", "text/plain")
+			for _, name := range names {
+				w.Write([]byte(name + "\n"))
+			}
+			return
+		}
+		type listingEntry struct {
+			Name         string `json:"name"`
+			Bytes        int    `json:"bytes"`
+			Hash         string `json:"hash"`
+			LastModified string `json:"last_modified"`
+			SymlinkPath  string `json:"symlink_path,omitempty"`
+		}
+		listing := []listingEntry{}
+		for _, name := range names {
+			obj := s.objects[containerPath+"/"+name]
+			entry := listingEntry{
+				Name:         name,
+				Bytes:        len(obj.Contents),
+				Hash:         obj.Headers.Get("Etag"),
+				LastModified: obj.LastModified.UTC().Format("2006-01-02T15:04:05.000000"),
+			}
+			if target := obj.Headers.Get("X-Symlink-Target"); target != "" {
+				entry.SymlinkPath = path.Dir(containerPath) + "/" + target
+			}
+			listing = append(listing, entry)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listing)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeSwift) handleObject(w http.ResponseWriter, r *http.Request, contents []byte, accountPath, containerPath, objectPath string) {
+	if !s.containers[containerPath] {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if s.failPUT[objectPath] {
+			http.Error(w, "PUT disabled for testing", http.StatusServiceUnavailable)
+			return
+		}
+		hdr := make(http.Header)
+		for key, values := range r.Header {
+			if strings.HasPrefix(key, "X-Object-Meta-") || key == "Content-Type" || key == "X-Symlink-Target" {
+				hdr[key] = values
+			}
+		}
+		hash := md5.Sum(contents)
+		hdr.Set("Etag", hex.EncodeToString(hash[:]))
+		s.objects[objectPath] = &fakeSwiftObject{Contents: contents, Headers: hdr, LastModified: time.Now()}
+		w.Header().Set("Etag", hdr.Get("Etag"))
+		w.WriteHeader(http.StatusCreated)
+	case "HEAD", "GET":
+		obj := s.objects[objectPath]
+		if obj == nil {
+			http.NotFound(w, r)
+			return
+		}
+		body := obj.Contents
+		//without ?symlink=get, symlinks are followed
+		if target := obj.Headers.Get("X-Symlink-Target"); target != "" && r.URL.Query().Get("symlink") != "get" {
+			targetObj := s.objects[accountPath+"/"+target]
+			if targetObj == nil {
+				http.NotFound(w, r)
+				return
+			}
+			body = targetObj.Contents
+		}
+		for key, values := range obj.Headers {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	case "DELETE":
+		if s.objects[objectPath] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.objects, objectPath)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//Implements bulk uploads into the given container. Only plain tar archives are
+//supported.
+func (s *fakeSwift) extractArchive(w http.ResponseWriter, contents []byte, containerPath string) {
+	if !s.containers[containerPath] {
+		http.NotFound(w, nil)
+		return
+	}
+	created := 0
+	tr := tar.NewReader(bytes.NewReader(contents))
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hdr := make(http.Header)
+		hash := md5.Sum(data)
+		hdr.Set("Etag", hex.EncodeToString(hash[:]))
+		for key, value := range th.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.user.meta.") {
+				hdr.Set("X-Object-Meta-"+strings.TrimPrefix(key, "SCHILY.xattr.user.meta."), value)
+			}
+		}
+		s.objects[containerPath+"/"+th.Name] = &fakeSwiftObject{Contents: data, Headers: hdr, LastModified: time.Now()}
+		created++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Number Files Created": created,
+		"Response Status":      "201 Created",
+		"Response Body":        "",
+		"Errors":               [][]string{},
+	})
+}
+
+//Compiles a job from the given YAML configuration.
+func compileTestJob(t *testing.T, configYAML string) *objects.Job {
+	t.Helper()
+	var cfg objects.JobConfiguration
+	err := yaml.Unmarshal([]byte(configYAML), &cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	job, errs := cfg.Compile("jobs[0]", objects.SwiftLocation{})
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	return job
+}
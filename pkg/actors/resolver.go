@@ -0,0 +1,160 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package actors
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/objects"
+)
+
+//SymlinkResolver is an actor that sits between the Scraper and the
+//Transferors. Files from the `Input` channel are forwarded into the `Output`
+//channel, except for symlinks, which are held back until scraping has
+//finished.
+//
+//The target of each symlink is then resolved against all jobs in the `Jobs`
+//list that transfer into the same target container(s). If the target is
+//transferred by one of these jobs, the symlink is forwarded with
+//File.SymlinkTarget filled. Otherwise, it is forwarded as-is and will be
+//transferred as a regular file.
+type SymlinkResolver struct {
+	Context context.Context
+	Jobs    []*objects.Job
+	Input   <-chan objects.File
+	Output  chan<- objects.File
+}
+
+//fileKey identifies a file across all jobs.
+type fileKey struct {
+	Job  *objects.Job
+	Path string
+}
+
+func keyOf(job *objects.Job, filePath string) fileKey {
+	//different sources use different conventions regarding leading slashes
+	return fileKey{job, path.Join("/", filePath)}
+}
+
+//Run implements the Actor interface.
+func (r *SymlinkResolver) Run() {
+	//values = whether the file is a symlink
+	isScraped := make(map[fileKey]bool)
+	var symlinks []objects.File
+	for file := range r.Input {
+		isSymlink := file.Spec.SymlinkTargetPath != ""
+		isScraped[keyOf(file.Job, file.Spec.Path)] = isSymlink
+		if isSymlink {
+			symlinks = append(symlinks, file)
+		} else {
+			r.Output <- file
+		}
+	}
+
+	for _, file := range symlinks {
+		if r.Context.Err() == nil {
+			file.SymlinkTarget = r.resolve(file, isScraped)
+		}
+		r.Output <- file
+	}
+
+	//signal to consumers that we're done
+	close(r.Output)
+}
+
+func (r *SymlinkResolver) resolve(file objects.File, isScraped map[fileKey]bool) *objects.SymlinkTarget {
+	namespace, targetPath, ok := file.SymlinkTargetLocation()
+	if !ok {
+		return nil
+	}
+
+	//prefer the symlink's own job over other jobs (the target must have been
+	//scraped by the respective job, so it matched that job's filters with its
+	//actual modification time)
+	for _, job := range append([]*objects.Job{file.Job}, r.Jobs...) {
+		if !file.Job.CanSymlinkTo(job) {
+			continue
+		}
+		filePath, ok := job.PathInSource(namespace, targetPath)
+		if !ok {
+			continue
+		}
+		key := keyOf(job, filePath)
+		isSymlink, exists := isScraped[key]
+		if exists && key != keyOf(file.Job, file.Spec.Path) {
+			return &objects.SymlinkTarget{Job: job, Path: filePath, IsSymlink: isSymlink}
+		}
+	}
+
+	logg.Debug("transferring %s as a regular file: symlink target %s is not transferred into the same container", file.Spec.Path, targetPath)
+	return nil
+}
+
+//TransferTracker records which files have been transferred by the
+//Transferors, so that symlinks can be transferred after the files that they
+//refer to. The zero value is ready to use.
+type TransferTracker struct {
+	mutex sync.Mutex
+	//channels are closed once the transfer of the respective file has been attempted
+	done map[fileKey]chan struct{}
+}
+
+func (t *TransferTracker) channel(key fileKey) chan struct{} {
+	if t.done == nil {
+		t.done = make(map[fileKey]chan struct{})
+	}
+	ch, exists := t.done[key]
+	if !exists {
+		ch = make(chan struct{})
+		t.done[key] = ch
+	}
+	return ch
+}
+
+//MarkDone records that the transfer of the given file has been attempted.
+func (t *TransferTracker) MarkDone(file objects.File) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ch := t.channel(keyOf(file.Job, file.Spec.Path))
+	select {
+	case <-ch:
+		//already closed
+	default:
+		close(ch)
+	}
+}
+
+//WaitFor blocks until the transfer of the given symlink target has been
+//attempted. Returns false if the context was cancelled in the meantime.
+func (t *TransferTracker) WaitFor(ctx context.Context, target objects.SymlinkTarget) bool {
+	t.mutex.Lock()
+	ch := t.channel(keyOf(target.Job, target.Path))
+	t.mutex.Unlock()
+
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
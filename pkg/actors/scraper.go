@@ -50,6 +50,9 @@ func (s *Scraper) Run() {
 		})
 	}
 
+	//jobs for which we already complained about listings without mtimes
+	warnedAboutMissingMtimes := make(map[*objects.Job]bool)
+
 	for !stack.IsEmpty() {
 		//check if state.Context.Done() is closed
 		if s.Context.Err() != nil {
@@ -75,16 +78,28 @@ func (s *Scraper) Run() {
 			entries, err = job.Source.ListEntries(directory.Path)
 		}
 
+		//if the listing is incomplete, transfer what was found, but do not let
+		//the job delete or publish anything based on this listing
+		isIncomplete := err != nil && len(entries) > 0
+		if isIncomplete {
+			logg.Error("incomplete listing of %s: %s", err.Location, err.FullMessage())
+			job.ScrapingFailed = true
+			s.Report <- ReportEvent{IsDirectory: true, DirectoryFailed: true}
+			err = nil
+		}
+
 		//if listing failed, maybe retry later
 		if err != nil {
 			if err.Message == objects.ErrMessageGPGVerificationFailed {
 				logg.Error("skipping job for source %s: %s", err.Location, err.FullMessage())
+				job.ScrapingFailed = true
 				//report that a job was skipped
 				s.Report <- ReportEvent{IsJob: true, JobSkipped: true}
 				continue
 			}
 			if directory.RetryCounter >= 2 {
 				logg.Error("giving up on %s: %s", err.Location, err.FullMessage())
+				job.ScrapingFailed = true
 				s.Report <- ReportEvent{IsDirectory: true, DirectoryFailed: true}
 				continue
 			}
@@ -96,6 +111,14 @@ func (s *Scraper) Run() {
 
 		//handle each file/subdirectory that was found
 		for _, entry := range entries {
+			//not_older_than cannot exclude files without mtime (e.g. from HTML
+			//listings that do not show an mtime column)
+			if !entry.IsDirectory && entry.LastModified == nil && job.Matcher.NotOlderThan != nil && !warnedAboutMissingMtimes[job] {
+				logg.Error("the listing of %s does not report modification times, so match.not_older_than has no effect for files like %s",
+					directory.Path, entry.Path)
+				warnedAboutMissingMtimes[job] = true
+			}
+
 			excludeReason := job.Matcher.CheckFile(entry)
 			if excludeReason != nil {
 				logg.Debug("skipping %s: %s", entry.Path, excludeReason.Error())
@@ -116,7 +139,9 @@ func (s *Scraper) Run() {
 		}
 
 		//report that a directory was successfully scraped
-		s.Report <- ReportEvent{IsDirectory: true}
+		if !isIncomplete {
+			s.Report <- ReportEvent{IsDirectory: true}
+		}
 	}
 
 	//signal to consumers that we're done
@@ -30,11 +30,15 @@ import (
 //
 //Files to transfer are read from the `Input` channel until it is closed.
 //For each input file, a report is sent into the `Report` channel.
+//
+//Symlinks are transferred after all other files, and only once the transfer
+//of their target has been attempted (as recorded in the shared `Tracker`).
 type Transferor struct {
 	Context context.Context
 	Input   <-chan objects.File
 	Output  chan<- FileInfoForCleaner
 	Report  chan<- ReportEvent
+	Tracker *TransferTracker
 }
 
 //Run implements the Actor interface.
@@ -42,9 +46,34 @@ func (t *Transferor) Run() {
 	done := t.Context.Done()
 
 	//main transfer loop - report successful and skipped transfers immediately,
-	//but push back failed transfers for later retry
+	//but push back failed transfers for later retry (small files may be
+	//collected for bulk uploads, in which case they are reported once their
+	//batch has been uploaded)
 	aborted := false
-	var filesToRetry []objects.File
+	var (
+		filesToRetry []fileToRetry
+		symlinks     []objects.File
+		bulk         objects.BulkUploader
+	)
+	handleResults := func(file objects.File, results []objects.TransferResult, size int64) {
+		retry := fileToRetry{File: file, Result: objects.TransferSkipped}
+		for idx, result := range results {
+			target := file.Job.Targets[idx]
+			if result == objects.TransferFailed {
+				retry.Targets = append(retry.Targets, target)
+			} else {
+				t.Output <- FileInfoForCleaner{File: file, Target: target, Failed: false}
+				retry.addResult(result, size)
+			}
+		}
+		if len(retry.Targets) > 0 {
+			filesToRetry = append(filesToRetry, retry)
+		} else {
+			t.Report <- retry.ReportEvent()
+		}
+		t.Tracker.MarkDone(file)
+	}
+
 LOOP:
 	for {
 		select {
@@ -55,31 +84,57 @@ LOOP:
 			if !ok {
 				break LOOP
 			}
-			result, size := file.PerformTransfer()
-			if result == objects.TransferFailed {
-				filesToRetry = append(filesToRetry, file)
-			} else {
-				t.Output <- FileInfoForCleaner{File: file, Failed: false}
-				t.Report <- ReportEvent{IsFile: true, FileTransferResult: result, FileTransferBytes: size}
+			if file.SymlinkTarget != nil {
+				symlinks = append(symlinks, file)
+				continue
 			}
+			bulk.Transfer(file, file.Job.Targets, func(results []objects.TransferResult, size int64) {
+				handleResults(file, results, size)
+			})
 		}
 	}
+	if aborted {
+		bulk.Abort()
+	} else {
+		bulk.Flush()
+	}
+
+	//transfer symlinks once their targets have been transferred (if the
+	//target is a symlink itself, we do not wait since the order does not
+	//matter for symlinks pointing to symlinks, and waiting could deadlock on
+	//cyclic symlinks)
+	for _, file := range symlinks {
+		target := *file.SymlinkTarget
+		if aborted || t.Context.Err() != nil || (!target.IsSymlink && !t.Tracker.WaitFor(t.Context, target)) {
+			aborted = true
+			filesToRetry = append(filesToRetry, fileToRetry{File: file, Targets: file.Job.Targets, Result: objects.TransferSkipped})
+			continue
+		}
+		results, size := file.PerformTransfer(file.Job.Targets)
+		handleResults(file, results, size)
+	}
 
 	//retry transfer of failed files one more time
 	if !aborted && len(filesToRetry) > 0 {
 		logg.Info("retrying %d failed file transfers...", len(filesToRetry))
 	}
-	for _, file := range filesToRetry {
-		result := objects.TransferFailed
+	for _, retry := range filesToRetry {
+		results := make([]objects.TransferResult, len(retry.Targets))
+		for idx := range results {
+			results[idx] = objects.TransferFailed
+		}
 		var size int64
 		//...but only if we were not aborted (this is checked in every loop
 		//iteration because the abort signal (i.e. Ctrl-C) could also happen
 		//during this loop)
 		if !aborted && t.Context.Err() == nil {
-			result, size = file.PerformTransfer()
+			results, size = retry.File.PerformTransfer(retry.Targets)
 		}
-		t.Output <- FileInfoForCleaner{File: file, Failed: result == objects.TransferFailed}
-		t.Report <- ReportEvent{IsFile: true, FileTransferResult: result, FileTransferBytes: size}
+		for idx, result := range results {
+			t.Output <- FileInfoForCleaner{File: retry.File, Target: retry.Targets[idx], Failed: result == objects.TransferFailed}
+			retry.addResult(result, size)
+		}
+		t.Report <- retry.ReportEvent()
 	}
 
 	//if interrupt was received, consume all remaining input to get the Scraper
@@ -88,3 +143,31 @@ LOOP:
 	for range t.Input {
 	}
 }
+
+//fileToRetry describes a file whose transfer into some of its targets failed.
+//Since a file is only reported once, it also accumulates the results for all
+//targets.
+type fileToRetry struct {
+	File    objects.File
+	Targets []*objects.SwiftLocation
+	Result  objects.TransferResult
+	Bytes   int64
+}
+
+func (r *fileToRetry) addResult(result objects.TransferResult, size int64) {
+	switch result {
+	case objects.TransferSuccess:
+		r.Bytes += size
+		if r.Result == objects.TransferSkipped {
+			r.Result = objects.TransferSuccess
+		}
+	case objects.TransferFailed:
+		r.Result = objects.TransferFailed
+	}
+}
+
+//ReportEvent returns the ReportEvent for this file. The file counts as failed
+//if the transfer into any target failed.
+func (r fileToRetry) ReportEvent() ReportEvent {
+	return ReportEvent{IsFile: true, FileTransferResult: r.Result, FileTransferBytes: r.Bytes}
+}
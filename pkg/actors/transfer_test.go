@@ -0,0 +1,123 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package actors
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/swift-http-import/pkg/objects"
+)
+
+func TestSymlinkWaitsForTargetInOtherWorkersBulkBatch(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+	//source and target are in different accounts, so files are not copied on the server side
+	swift.addObject("AUTH_source/source/a/file", "hello", nil)
+	swift.addObject("AUTH_source/source/b/link", "", http.Header{"X-Symlink-Target": {"source/a/file"}})
+
+	job := compileTestJob(t, fmt.Sprintf(`
+from:
+  storage_url: %[1]s/v1/AUTH_source
+  auth_token: unused
+  container: source
+to:
+  storage_url: %[1]s/v1/AUTH_target
+  auth_token: unused
+  container: mirror
+bulk_upload:
+  max_file_bytes: 1024
+  batch_size: 10
+`, swift.URL))
+
+	//resolve the symlink like the pipeline would
+	specs, lerr := job.Source.ListAllFiles()
+	if lerr != nil {
+		t.Fatal(lerr.FullMessage())
+	}
+	resolverInput := make(chan objects.File, len(specs))
+	resolverOutput := make(chan objects.File, len(specs))
+	for _, spec := range specs {
+		resolverInput <- objects.File{Job: job, Spec: spec}
+	}
+	close(resolverInput)
+	(&SymlinkResolver{Context: context.Background(), Jobs: []*objects.Job{job}, Input: resolverInput, Output: resolverOutput}).Run()
+	var file, link objects.File
+	for f := range resolverOutput {
+		if f.SymlinkTarget == nil {
+			file = f
+		} else {
+			link = f
+		}
+	}
+	if file.Job == nil || link.Job == nil {
+		t.Fatal("expected SymlinkResolver to output one file and one resolved symlink")
+	}
+
+	//the file and the symlink go to different workers; the file's bulk batch
+	//is only uploaded once its worker runs out of input
+	var (
+		tracker   TransferTracker
+		wg        sync.WaitGroup
+		fileInput = make(chan objects.File, 1)
+		linkInput = make(chan objects.File, 1)
+		output    = make(chan FileInfoForCleaner, 10)
+		report    = make(chan ReportEvent, 10)
+	)
+	for _, input := range []chan objects.File{fileInput, linkInput} {
+		Start(&Transferor{
+			Context: context.Background(),
+			Input:   input,
+			Output:  output,
+			Report:  report,
+			Tracker: &tracker,
+		}, &wg)
+	}
+	fileInput <- file
+	linkInput <- link
+	close(linkInput)
+
+	time.Sleep(100 * time.Millisecond)
+	if swift.object("AUTH_target/mirror/b/link") != nil {
+		t.Error("expected symlink to not be uploaded before the bulk batch containing its target")
+	}
+
+	close(fileInput)
+	wg.Wait()
+	close(report)
+
+	bulkIdx := swift.requestIndex("PUT /v1/AUTH_target/mirror/?extract-archive=tar")
+	linkIdx := swift.requestIndex("PUT /v1/AUTH_target/mirror/b/link")
+	if bulkIdx < 0 || linkIdx < 0 || linkIdx < bulkIdx {
+		t.Errorf("expected bulk upload before symlink upload, got request indexes %d and %d", bulkIdx, linkIdx)
+	}
+	if obj := swift.object("AUTH_target/mirror/b/link"); obj == nil || obj.Headers.Get("X-Symlink-Target") != "mirror/a/file" {
+		t.Errorf("expected symlink to mirror/a/file, got %#v", obj)
+	}
+	for event := range report {
+		if event.FileTransferResult != objects.TransferSuccess {
+			t.Errorf("expected all transfers to succeed, got result %d", event.FileTransferResult)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//BulkUploadConfiguration contains the "bulk_upload" section of a JobConfiguration.
+type BulkUploadConfiguration struct {
+	//new files up to this size are uploaded in bulk
+	MaxFileSize uint64 `yaml:"max_file_bytes"`
+	//maximum number of files per archive
+	BatchSize uint `yaml:"batch_size"`
+}
+
+//BulkUploader collects small files and uploads them into their targets in
+//batches, using the bulk middleware of Swift (extract-archive). Each batch is
+//sent as a tar archive that is streamed into a single PUT request. The zero
+//value is ready to use, but a BulkUploader must not be used by multiple
+//goroutines at once.
+type BulkUploader struct {
+	batches map[*SwiftLocation][]*bulkEntry
+	//targets whose bulk middleware was found to store object metadata from PAX headers
+	verified map[*SwiftLocation]bool
+	//targets whose bulk middleware does not store object metadata, so files are
+	//uploaded individually instead
+	disabled map[*SwiftLocation]bool
+}
+
+//bulkFile tracks a file whose transfer into some targets is waiting for a
+//batch to be uploaded.
+type bulkFile struct {
+	File    File
+	Targets []*transferTarget
+	Size    int64
+	Pending int //number of entries that are still waiting in batches
+	Done    func([]TransferResult, int64)
+}
+
+//bulkEntry is a file in a batch for a bulk upload.
+type bulkEntry struct {
+	File     *bulkFile
+	Target   *transferTarget
+	Contents []byte
+	Headers  schwift.ObjectHeaders
+	//only set if the job uses deduplication (see File.indexUploadedObject())
+	Checksums []Checksum
+}
+
+//Transfer transfers the given file into the given targets, like
+//File.PerformTransfer() does. If the file qualifies for a bulk upload into
+//some of the targets (see BulkUploadConfiguration), it is added to the batches
+//for these targets instead, and its transfer completes when the batch is
+//uploaded.
+//
+//In any case, the done callback is called exactly once with the results of
+//the transfer, either during this call or during a later call to Transfer(),
+//Flush() or Abort().
+func (b *BulkUploader) Transfer(f File, targets []*SwiftLocation, done func([]TransferResult, int64)) {
+	all, size := f.performTransfer(targets, b)
+	file := &bulkFile{File: f, Targets: all, Size: size, Done: done}
+
+	var fullBatches []*SwiftLocation
+	for _, t := range all {
+		if t.BulkEntry == nil {
+			continue
+		}
+		if b.batches == nil {
+			b.batches = make(map[*SwiftLocation][]*bulkEntry)
+		}
+		t.BulkEntry.File = file
+		file.Pending++
+		b.batches[t.Location] = append(b.batches[t.Location], t.BulkEntry)
+		if uint(len(b.batches[t.Location])) >= f.Job.BulkUpload.BatchSize {
+			fullBatches = append(fullBatches, t.Location)
+		}
+	}
+
+	if file.Pending == 0 {
+		file.finish()
+		return
+	}
+	for _, target := range fullBatches {
+		b.upload(target)
+	}
+}
+
+//Flush uploads all batches that are not full yet. It must be called after the
+//last call to Transfer().
+func (b *BulkUploader) Flush() {
+	for target := range b.batches {
+		b.upload(target)
+	}
+}
+
+//Abort marks the files in all batches that have not been uploaded yet as
+//failed. It can be called instead of Flush() when the transfer is aborted.
+func (b *BulkUploader) Abort() {
+	for target, batch := range b.batches {
+		delete(b.batches, target)
+		for _, e := range batch {
+			e.Target.Result = TransferFailed
+			e.complete()
+		}
+	}
+}
+
+func (bf *bulkFile) finish() {
+	results := make([]TransferResult, len(bf.Targets))
+	for idx, t := range bf.Targets {
+		results[idx] = t.Result
+	}
+	bf.Done(results, bf.Size)
+}
+
+func (e *bulkEntry) complete() {
+	e.File.Pending--
+	if e.File.Pending == 0 {
+		e.File.finish()
+	}
+}
+
+//Checks whether the given target supports bulk uploads. If not, files are
+//uploaded individually as usual.
+func (s *SwiftLocation) checkBulkUpload(name string) error {
+	capabilities, err := s.Account.Capabilities()
+	if err != nil {
+		return fmt.Errorf("cannot query capabilities of %s: %s", name, err.Error())
+	}
+	if capabilities.BulkUpload == nil {
+		logg.Info("%s does not support bulk uploads, files will be uploaded individually", name)
+	}
+	return nil
+}
+
+//Returns whether the file can be uploaded into the given target as part of a
+//bulk upload. This is only done for new files, since the bulk middleware
+//cannot clean up the segments of an existing large object when overwriting
+//it, and cannot set an expiration date.
+func (b *BulkUploader) accepts(f File, t *transferTarget, hdr schwift.ObjectHeaders, sourceState FileState) bool {
+	cfg := f.Job.BulkUpload
+	if b == nil || cfg == nil || b.disabled[t.Location] {
+		return false
+	}
+	size := sourceState.SizeBytes
+	if size < 0 || uint64(size) > cfg.MaxFileSize {
+		return false
+	}
+	if f.Job.Segmenting != nil && uint64(size) >= f.Job.Segmenting.MinObjectSize {
+		return false
+	}
+	if t.Headers.SizeBytes().Exists() || hdr.ExpiresAt().Exists() {
+		return false
+	}
+	capabilities, err := t.Location.Account.Capabilities()
+	return err == nil && capabilities.BulkUpload != nil
+}
+
+//Uploads the batch for the given target, and completes the transfers of all
+//files in it.
+func (b *BulkUploader) upload(target *SwiftLocation) {
+	batch := b.batches[target]
+	delete(b.batches, target)
+	if len(batch) == 0 {
+		return
+	}
+
+	isFailed := uploadBulkArchive(target, batch)
+
+	//older versions of the bulk middleware ignore PAX headers, so the first
+	//successful bulk upload into each target is checked for metadata
+	if !b.verified[target] {
+		for idx, e := range batch {
+			if isFailed[idx] || !hasMetadata(e.Headers) {
+				continue
+			}
+			ok, err := hasBulkMetadata(e)
+			switch {
+			case err != nil:
+				logg.Error("HEAD %s failed: %s", e.Target.Object.FullName(), err.Error())
+			case ok:
+				if b.verified == nil {
+					b.verified = make(map[*SwiftLocation]bool)
+				}
+				b.verified[target] = true
+			default:
+				logg.Info("bulk uploads into %s do not retain object metadata, uploading files individually instead",
+					target.Container.Name())
+				if b.disabled == nil {
+					b.disabled = make(map[*SwiftLocation]bool)
+				}
+				b.disabled[target] = true
+			}
+			if !ok {
+				//the metadata is required to recognize unchanged files later on
+				for idx := range isFailed {
+					isFailed[idx] = true
+				}
+			}
+			break
+		}
+	}
+
+	//files that could not be extracted are uploaded individually
+	for idx, e := range batch {
+		e.Target.Result = TransferSuccess
+		if isFailed[idx] && !e.File.File.uploadNormalObject(e.Target, bytes.NewReader(e.Contents), e.Headers) {
+			e.Target.Result = TransferFailed
+		}
+		e.File.File.indexUploadedObject(e.Target, e.Checksums, int64(len(e.Contents)))
+		e.complete()
+	}
+}
+
+//Sends the given batch to the bulk middleware as a tar archive. Returns which
+//files of the batch could not be uploaded.
+func uploadBulkArchive(target *SwiftLocation, batch []*bulkEntry) []bool {
+	isFailed := make([]bool, len(batch))
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBulkArchive(writer, batch))
+	}()
+	created, err := target.Account.BulkUpload(target.ContainerName, schwift.BulkUploadTar, reader, nil)
+	//unblock the archive writer if the request was aborted early
+	reader.Close()
+	if err == nil {
+		logg.Debug("bulk upload into %s has created %d objects", target.Container.Name(), created)
+		return isFailed
+	}
+
+	logg.Error("bulk upload into %s failed: %s", target.Container.Name(), err.Error())
+	bulkErr, ok := err.(schwift.BulkError)
+	if ok && created+len(bulkErr.ObjectErrors) == len(batch) {
+		//only the files that are reported as failed need to be uploaded again
+		for idx, e := range batch {
+			isFailed[idx] = hasBulkObjectError(bulkErr, e.Target.Object)
+		}
+		return isFailed
+	}
+	for idx := range isFailed {
+		isFailed[idx] = true
+	}
+	return isFailed
+}
+
+func writeBulkArchive(w io.Writer, batch []*bulkEntry) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, e := range batch {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       e.Target.Object.Name(),
+			Size:       int64(len(e.Contents)),
+			Mode:       0644,
+			ModTime:    now,
+			Format:     tar.FormatPAX,
+			PAXRecords: bulkPAXRecords(e.Headers),
+		})
+		if err == nil {
+			_, err = tw.Write(e.Contents)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+//Returns the PAX records that instruct the bulk middleware to set the given
+//headers on the extracted object. (The bulk middleware only understands the
+//Content-Type and object metadata.)
+func bulkPAXRecords(hdr schwift.ObjectHeaders) map[string]string {
+	records := make(map[string]string)
+	if contentType := hdr.ContentType().Get(); contentType != "" {
+		records["SCHILY.xattr.user.mime_type"] = contentType
+	}
+	for key, value := range hdr.Headers {
+		if strings.HasPrefix(key, "X-Object-Meta-") {
+			records["SCHILY.xattr.user.meta."+strings.TrimPrefix(key, "X-Object-Meta-")] = value
+		}
+	}
+	return records
+}
+
+func hasMetadata(hdr schwift.ObjectHeaders) bool {
+	for key := range hdr.Headers {
+		if strings.HasPrefix(key, "X-Object-Meta-") {
+			return true
+		}
+	}
+	return false
+}
+
+//Checks whether the object that was created by a bulk upload has the expected
+//metadata.
+func hasBulkMetadata(e *bulkEntry) (bool, error) {
+	e.Target.Object.Invalidate()
+	hdr, err := e.Target.Object.Headers()
+	if err != nil {
+		return false, err
+	}
+	for key, value := range e.Headers.Headers {
+		if strings.HasPrefix(key, "X-Object-Meta-") && hdr.Get(key) != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func hasBulkObjectError(err schwift.BulkError, object *schwift.Object) bool {
+	for _, objErr := range err.ObjectErrors {
+		name := objErr.ContainerName + "/" + objErr.ObjectName
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		//depending on the Swift version, the name may include the account
+		if name == object.FullName() || strings.HasSuffix(name, "/"+object.FullName()) {
+			return true
+		}
+	}
+	return false
+}
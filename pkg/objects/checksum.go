@@ -0,0 +1,193 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+//Checksum is the expected digest of a file. In configuration files and
+//manifests, it appears in the format "<algorithm>:<hex digest>", e.g.
+//"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855".
+type Checksum struct {
+	Algorithm string
+	Digest    []byte
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+//ParseChecksum parses a checksum in the format "<algorithm>:<hex digest>".
+func ParseChecksum(input string) (Checksum, error) {
+	fields := strings.SplitN(input, ":", 2)
+	if len(fields) != 2 {
+		return Checksum{}, fmt.Errorf(`expected checksum in the format "<algorithm>:<hex digest>", got %q instead`, input)
+	}
+	return NewChecksum(fields[0], fields[1])
+}
+
+//NewChecksum builds a Checksum from an algorithm name and a hex digest.
+func NewChecksum(algorithm, hexDigest string) (Checksum, error) {
+	algorithm = strings.ToLower(algorithm)
+	newHash, exists := checksumAlgorithms[algorithm]
+	if !exists {
+		return Checksum{}, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("malformed %s digest %q: %s", algorithm, hexDigest, err.Error())
+	}
+	if len(digest) != newHash().Size() {
+		return Checksum{}, fmt.Errorf("malformed %s digest %q: expected %d bytes, got %d bytes", algorithm, hexDigest, newHash().Size(), len(digest))
+	}
+	return Checksum{Algorithm: algorithm, Digest: digest}, nil
+}
+
+//String returns the checksum in the format "<algorithm>:<hex digest>".
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + hex.EncodeToString(c.Digest)
+}
+
+//VerifyingReader wraps the given reader such that a checksum mismatch will
+//be reported as a read error when the end of the file is reached.
+func (c Checksum) VerifyingReader(body io.ReadCloser, path string) io.ReadCloser {
+	return &verifyingReader{
+		Base:     body,
+		Path:     path,
+		Checksum: c,
+		Hash:     checksumAlgorithms[c.Algorithm](),
+	}
+}
+
+//verifyingReader is an io.ReadCloser that computes a hash of everything that
+//is read from the Base reader. Since an upload to Swift is aborted when the
+//request body yields an error, returning an error instead of io.EOF is enough
+//to ensure that corrupted files are not uploaded.
+//
+//The last byte read from Base is always held back until we know whether Base
+//is at EOF. This ensures that the checksum mismatch (if any) is reported
+//together with the final bytes of the file instead of on a separate Read()
+//that yields no data. (Some readers, e.g. the segmenting logic in
+//schwift.LargeObject.Append(), do not expect a read that yields no data and no
+//io.EOF.)
+type verifyingReader struct {
+	Base     io.ReadCloser
+	Path     string
+	Checksum Checksum
+	Hash     hash.Hash
+	//this object's internal state
+	lookahead    byte
+	hasLookahead bool
+	baseErr      error //error returned by Base, but not yet reported to the caller
+	err          error //error reported to the caller (either io.EOF or a checksum mismatch)
+}
+
+//Read implements the io.Reader interface.
+func (r *verifyingReader) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if !r.hasLookahead && r.baseErr == nil {
+		r.fillLookahead()
+	}
+	if !r.hasLookahead {
+		return 0, r.finish()
+	}
+
+	//return the lookahead byte, followed by as much new data as fits into buf
+	buf[0] = r.lookahead
+	r.hasLookahead = false
+	n := 1
+	if r.baseErr == nil && len(buf) > 1 {
+		m, err := r.Base.Read(buf[1:])
+		r.Hash.Write(buf[1 : 1+m])
+		n += m
+		r.baseErr = err
+		if m > 0 && err == nil {
+			//hold back the last byte as the next lookahead
+			n--
+			r.lookahead = buf[n]
+			r.hasLookahead = true
+			return n, nil
+		}
+	}
+
+	//we could not fill a new lookahead byte from the read above, so check
+	//explicitly if there is more data after what we are about to return
+	if r.baseErr == nil {
+		r.fillLookahead()
+		if r.hasLookahead {
+			return n, nil
+		}
+	}
+	return n, r.finish()
+}
+
+func (r *verifyingReader) fillLookahead() {
+	var b [1]byte
+	for {
+		n, err := r.Base.Read(b[:])
+		if n > 0 {
+			r.Hash.Write(b[:])
+			r.lookahead = b[0]
+			r.hasLookahead = true
+		}
+		if n > 0 || err != nil {
+			r.baseErr = err
+			return
+		}
+	}
+}
+
+func (r *verifyingReader) finish() error {
+	if r.baseErr != io.EOF {
+		r.err = r.baseErr
+		return r.err
+	}
+	actual := r.Hash.Sum(nil)
+	if bytes.Equal(actual, r.Checksum.Digest) {
+		r.err = io.EOF
+	} else {
+		r.err = fmt.Errorf("checksum mismatch for %s: expected %s, got %s:%s",
+			r.Path, r.Checksum.String(), r.Checksum.Algorithm, hex.EncodeToString(actual))
+	}
+	return r.err
+}
+
+//Close implements the io.Closer interface.
+func (r *verifyingReader) Close() error {
+	return r.Base.Close()
+}
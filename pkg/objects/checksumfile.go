@@ -0,0 +1,285 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+//ChecksumFileSource is a URLSource containing a release directory with a
+//checksum file (e.g. SHA256SUMS). This type reuses the Validate() and
+//Connect() logic of URLSource, but uses the checksum file as the file listing
+//instead of relying on directory listings.
+type ChecksumFileSource struct {
+	//options from config file
+	URLString                string   `yaml:"url"`
+	ClientCertificatePath    string   `yaml:"cert"`
+	ClientCertificateKeyPath string   `yaml:"key"`
+	ServerCAPath             string   `yaml:"ca"`
+	HTTPAuth                 HTTPAuth `yaml:",inline"`
+	ChecksumFile             string   `yaml:"checksum_file"`
+	SignatureFile            string   `yaml:"signature_file"`
+	VerifySignature          *bool    `yaml:"verify_signature"`
+	//compiled configuration
+	urlSource       *URLSource       `yaml:"-"`
+	gpgVerification bool             `yaml:"-"`
+	gpgKeyRing      *util.GPGKeyRing `yaml:"-"`
+	//checksums is filled by ListAllFiles() and used by GetFile()
+	checksums map[string]Checksum `yaml:"-"`
+}
+
+//Validate implements the Source interface.
+func (s *ChecksumFileSource) Validate(name string) []error {
+	s.urlSource = &URLSource{
+		URLString:                s.URLString,
+		ClientCertificatePath:    s.ClientCertificatePath,
+		ClientCertificateKeyPath: s.ClientCertificateKeyPath,
+		ServerCAPath:             s.ServerCAPath,
+		HTTPAuth:                 s.HTTPAuth,
+	}
+	if s.ChecksumFile == "" {
+		s.ChecksumFile = "SHA256SUMS"
+	}
+	s.ChecksumFile = strings.TrimPrefix(s.ChecksumFile, "/")
+	s.SignatureFile = strings.TrimPrefix(s.SignatureFile, "/")
+	s.gpgVerification = true
+	if s.VerifySignature != nil {
+		s.gpgVerification = *s.VerifySignature
+	}
+	return s.urlSource.Validate(name)
+}
+
+//Connect implements the Source interface.
+func (s *ChecksumFileSource) Connect(name string) error {
+	return s.urlSource.Connect(name)
+}
+
+//ListEntries implements the Source interface.
+func (s *ChecksumFileSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	return nil, &ListEntriesError{
+		Location: s.urlSource.getURLForPath(directoryPath).String(),
+		Message:  "ListEntries is not implemented for ChecksumFileSource",
+	}
+}
+
+//GetFile implements the Source interface.
+func (s *ChecksumFileSource) GetFile(path string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	body, sourceState, err := s.urlSource.GetFile(path, requestHeaders)
+	if err != nil || sourceState.SkipTransfer {
+		return body, sourceState, err
+	}
+	checksum, exists := s.checksums[path]
+	if !exists {
+		//should not happen since ListAllFiles() only lists files with checksums
+		//(and the checksum file itself, which is passed with its contents)
+		body.Close()
+		return nil, FileState{}, fmt.Errorf("skipping %s: no checksum known", path)
+	}
+	return checksum.VerifyingReader(body, s.urlSource.getURLForPath(path).String()), sourceState, nil
+}
+
+//ListAllFiles implements the Source interface.
+func (s *ChecksumFileSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	cache := make(map[string]FileSpec)
+	var allFiles []string
+
+	checksumFileBytes, checksumFileURI, lerr := s.urlSource.getFileContents(s.ChecksumFile, cache)
+	if lerr != nil {
+		return nil, lerr
+	}
+
+	//verify the checksum file's GPG signature (either a clear signature inside
+	//the file itself, or a detached signature next to it)
+	block, _ := clearsign.Decode(checksumFileBytes)
+	if block != nil {
+		//only consider the signed part of the file
+		checksumFileBytes = block.Plaintext
+	}
+	if s.gpgVerification {
+		var (
+			signatureURI string
+			err          error
+		)
+		if block != nil {
+			signatureURI = checksumFileURI
+			err = util.VerifyClearSignedGPGSignature(s.gpgKeyRing, cache[s.ChecksumFile].Contents)
+		} else {
+			var (
+				signaturePath  string
+				signatureBytes []byte
+			)
+			signaturePath, signatureBytes, signatureURI, lerr = s.findDetachedSignature(cache)
+			if lerr != nil {
+				return nil, lerr
+			}
+			switch {
+			case signaturePath != "":
+				err = util.VerifyDetachedGPGSignature(s.gpgKeyRing, checksumFileBytes, signatureBytes)
+				allFiles = append(allFiles, signaturePath)
+			case s.VerifySignature != nil || s.SignatureFile != "":
+				//verification was requested explicitly, so a missing signature is fatal
+				err = fmt.Errorf("no GPG signature found for %s", checksumFileURI)
+			default:
+				logg.Error("no GPG signature found for %s, skipping signature verification", checksumFileURI)
+			}
+		}
+		if err != nil {
+			logg.Debug("could not verify GPG signature at %s for file %s", signatureURI, "-"+path.Base(s.ChecksumFile))
+			return nil, &ListEntriesError{
+				Location: s.urlSource.getURLForPath("/").String(),
+				Message:  ErrMessageGPGVerificationFailed,
+				Inner:    err,
+			}
+		}
+		if signatureURI != "" {
+			logg.Debug("successfully verified GPG signature at %s for file %s", signatureURI, "-"+path.Base(s.ChecksumFile))
+		}
+	}
+
+	entries, err := parseChecksumFile(checksumFileBytes)
+	if err != nil {
+		return nil, &ListEntriesError{checksumFileURI, "cannot parse checksum file", err}
+	}
+	s.checksums = make(map[string]Checksum, len(entries))
+	var listedFiles []string
+	for _, entry := range entries {
+		filePath := path.Join(path.Dir(s.ChecksumFile), entry.Path)
+		if _, exists := s.checksums[filePath]; !exists {
+			listedFiles = append(listedFiles, filePath)
+		}
+		s.checksums[filePath] = entry.Checksum
+	}
+
+	//transfer the checksum file and its signature at the very end, when
+	//everything else has already been uploaded (to avoid situations where a
+	//client might see a checksum file without being able to download the
+	//referenced files)
+	allFiles = append(append(listedFiles, allFiles...), s.ChecksumFile)
+
+	//for files that were already downloaded, pass the contents and HTTP headers
+	//into the transfer phase to avoid double download
+	result := make([]FileSpec, len(allFiles))
+	for idx, filePath := range allFiles {
+		var exists bool
+		result[idx], exists = cache[filePath]
+		if !exists {
+			result[idx] = FileSpec{Path: filePath}
+		}
+		if checksum, exists := s.checksums[filePath]; exists {
+			checksum := checksum
+			result[idx].Checksum = &checksum
+		}
+	}
+	return result, nil
+}
+
+//Helper function for ChecksumFileSource.ListAllFiles(). If no signature file
+//has been configured explicitly, a few common names are tried. An empty
+//signaturePath is returned if none of them exists.
+func (s *ChecksumFileSource) findDetachedSignature(cache map[string]FileSpec) (signaturePath string, signatureBytes []byte, signatureURI string, e *ListEntriesError) {
+	candidates := []string{s.SignatureFile}
+	if s.SignatureFile == "" {
+		candidates = []string{s.ChecksumFile + ".gpg", s.ChecksumFile + ".asc", s.ChecksumFile + ".sig"}
+	}
+
+	for _, signaturePath = range candidates {
+		signatureBytes, signatureURI, e = s.urlSource.getFileContents(signaturePath, cache)
+		if e == nil {
+			return signaturePath, signatureBytes, signatureURI, nil
+		}
+		if !strings.Contains(e.Message, "GET returned status 404") {
+			return "", nil, "", e
+		}
+	}
+	return "", nil, "", nil
+}
+
+//checksumFileEntry is a single entry in a checksum file.
+type checksumFileEntry struct {
+	Path     string
+	Checksum Checksum
+}
+
+var (
+	//matches a line in the format written by GNU coreutils, e.g. "$DIGEST  $PATH"
+	//or "$DIGEST *$PATH" (the latter for files that were read in binary mode)
+	gnuChecksumLineRx = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+	//matches a line in the BSD format, e.g. "SHA256 ($PATH) = $DIGEST"
+	bsdChecksumLineRx = regexp.MustCompile(`^([A-Za-z0-9]+) \((.+)\) = ([0-9a-fA-F]+)$`)
+)
+
+//In the GNU format, the algorithm can only be inferred from the digest size.
+var checksumAlgorithmsByHexLength = map[int]string{
+	32:  "md5",
+	40:  "sha1",
+	64:  "sha256",
+	128: "sha512",
+}
+
+//parseChecksumFile parses a checksum file in the format written by e.g.
+//sha256sum(1). Both the default format of GNU coreutils and the BSD format
+//(as written by `sha256sum --tag`) are understood.
+func parseChecksumFile(buf []byte) ([]checksumFileEntry, error) {
+	var result []checksumFileEntry
+	for idx, line := range bytes.Split(buf, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var (
+			entry checksumFileEntry
+			err   error
+		)
+		if match := bsdChecksumLineRx.FindSubmatch(line); match != nil {
+			entry.Path = string(match[2])
+			entry.Checksum, err = NewChecksum(string(match[1]), string(match[3]))
+		} else if match := gnuChecksumLineRx.FindSubmatch(line); match != nil {
+			entry.Path = string(match[2])
+			algorithm, exists := checksumAlgorithmsByHexLength[len(match[1])]
+			if !exists {
+				return nil, fmt.Errorf("line %d: cannot infer checksum algorithm for digest %q", idx+1, string(match[1]))
+			}
+			entry.Checksum, err = NewChecksum(algorithm, string(match[1]))
+		} else {
+			return nil, fmt.Errorf("line %d: malformed line %q", idx+1, string(line))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+
+		entry.Path = strings.TrimPrefix(entry.Path, "./")
+		if path.IsAbs(entry.Path) || dotdotRx.MatchString(entry.Path) {
+			return nil, fmt.Errorf("line %d: path %q points outside of the directory containing the checksum file", idx+1, entry.Path)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	input := "d41d8cd98f00b204e9800998ecf8427e  empty.txt\r\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 *./bin/empty.iso\n" +
+		"\n" +
+		"SHA1 (with spaces.txt) = da39a3ee5e6b4b0d3255bfef95601890afd80709\n"
+
+	entries, err := parseChecksumFile([]byte(input))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []struct{ Path, Algorithm string }{
+		{"empty.txt", "md5"},
+		{"bin/empty.iso", "sha256"},
+		{"with spaces.txt", "sha1"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for idx, e := range expected {
+		if entries[idx].Path != e.Path || entries[idx].Checksum.Algorithm != e.Algorithm {
+			t.Errorf("entry %d: expected %s checksum for %q, got %s checksum for %q",
+				idx, e.Algorithm, e.Path, entries[idx].Checksum.Algorithm, entries[idx].Path)
+		}
+	}
+
+	invalidInputs := []string{
+		"d41d8cd98f00b204e9800998ecf8427e  ../empty.txt",  //path outside of directory
+		"d41d8cd98f00b204e9800998ecf8427e  /etc/passwd",   //absolute path
+		"d41d8cd98f00b204e9800998ec  empty.txt",           //unknown digest size
+		"MD5 (empty.txt) = e3b0c44298fc1c149afbf4c8996fb", //digest does not match algorithm
+	}
+	for _, input := range invalidInputs {
+		_, err := parseChecksumFile([]byte(input))
+		if err == nil {
+			t.Errorf("expected checksum file %q to be rejected, but it was accepted", input)
+		}
+	}
+}
+
+func TestChecksumFileWithoutSignature(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/release/SHA256SUMS" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  empty.txt\n"))
+	}))
+	defer server.Close()
+
+	yes, no := true, false
+	testCases := []struct {
+		VerifySignature *bool
+		SignatureFile   string
+		ExpectError     bool
+	}{
+		//without explicit configuration, the checksum file is used without verification
+		{nil, "", false},
+		{&no, "", false},
+		{&yes, "", true},
+		{nil, "SHA256SUMS.gpg", true},
+	}
+
+	for idx, tc := range testCases {
+		source := ChecksumFileSource{
+			URLString:       server.URL + "/release/",
+			SignatureFile:   tc.SignatureFile,
+			VerifySignature: tc.VerifySignature,
+		}
+		if errs := source.Validate("source"); len(errs) > 0 {
+			t.Fatal(errs[0].Error())
+		}
+		err := source.Connect("source")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		specs, lerr := source.ListAllFiles()
+		switch {
+		case tc.ExpectError && lerr == nil:
+			t.Errorf("testcase %d: expected GPG verification to fail, but got %d files", idx, len(specs))
+		case tc.ExpectError && lerr.Message != ErrMessageGPGVerificationFailed:
+			t.Errorf("testcase %d: expected GPG verification to fail, got: %s", idx, lerr.FullMessage())
+		case !tc.ExpectError && lerr != nil:
+			t.Errorf("testcase %d: unexpected error: %s", idx, lerr.FullMessage())
+		case !tc.ExpectError && len(specs) != 2:
+			t.Errorf("testcase %d: expected empty.txt and SHA256SUMS to be listed, got %d files", idx, len(specs))
+		}
+	}
+}
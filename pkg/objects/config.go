@@ -23,9 +23,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
+	"strings"
 	"time"
 
-	"github.com/majewsky/schwift"
 	"github.com/sapcc/swift-http-import/pkg/util"
 	"golang.org/x/crypto/openpgp"
 	yaml "gopkg.in/yaml.v2"
@@ -96,16 +96,19 @@ type StatsdConfiguration struct {
 //JobConfiguration describes a transfer job in the configuration file.
 type JobConfiguration struct {
 	//basic options
-	Source SourceUnmarshaler `yaml:"from"`
-	Target *SwiftLocation    `yaml:"to"`
+	Source  SourceUnmarshaler  `yaml:"from"`
+	Targets TargetsUnmarshaler `yaml:"to"`
 	//behavior options
-	ExcludePattern       string                   `yaml:"except"`
-	IncludePattern       string                   `yaml:"only"`
-	ImmutableFilePattern string                   `yaml:"immutable"`
-	Match                MatchConfiguration       `yaml:"match"`
-	Segmenting           *SegmentingConfiguration `yaml:"segmenting"`
-	Expiration           ExpirationConfiguration  `yaml:"expiration"`
-	Cleanup              CleanupConfiguration     `yaml:"cleanup"`
+	ExcludePattern       string                      `yaml:"except"`
+	IncludePattern       string                      `yaml:"only"`
+	ImmutableFilePattern string                      `yaml:"immutable"`
+	Match                MatchConfiguration          `yaml:"match"`
+	Segmenting           *SegmentingConfiguration    `yaml:"segmenting"`
+	Expiration           ExpirationConfiguration     `yaml:"expiration"`
+	Cleanup              CleanupConfiguration        `yaml:"cleanup"`
+	Snapshots            *SnapshotConfiguration      `yaml:"snapshots"`
+	BulkUpload           *BulkUploadConfiguration    `yaml:"bulk_upload"`
+	Deduplication        *DeduplicationConfiguration `yaml:"deduplication"`
 	//gpgKeyRing is the common key ring cache that is passed on to the
 	//custom source type Job(s).
 	gpgKeyRing *util.GPGKeyRing
@@ -122,8 +125,19 @@ type SegmentingConfiguration struct {
 	MinObjectSize uint64 `yaml:"min_bytes"`
 	SegmentSize   uint64 `yaml:"segment_bytes"`
 	ContainerName string `yaml:"container"`
-	//Container is initialized by JobConfiguration.Compile().
-	Container *schwift.Container `yaml:"-"`
+	//"slo" or "dlo" (if empty, SLO is used if the target cluster supports it)
+	Strategy string `yaml:"strategy"`
+	//template for the names of segments, see defaultSegmentPrefix
+	SegmentPrefix string `yaml:"segment_prefix"`
+	//storage policy for the segment container (if empty, the cluster's default
+	//storage policy is used)
+	StoragePolicy string `yaml:"storage_policy"`
+	//segments expire this many seconds after the large object itself
+	ExpiryDelaySeconds uint32 `yaml:"expiry_delay_seconds"`
+	//number of segments of the same file that are uploaded concurrently
+	Parallelism uint `yaml:"parallelism"`
+	//if true, only changed segments of existing large objects are uploaded
+	DeltaUpdates bool `yaml:"delta_updates"`
 }
 
 //ExpirationConfiguration contains the "expiration" section of a JobConfiguration.
@@ -168,31 +182,93 @@ func (u *SourceUnmarshaler) UnmarshalYAML(unmarshal func(interface{}) error) err
 	}
 
 	//look at keys to determine whether this is a URLSource or a SwiftSource
-	if probe.URL == "" {
-		u.Source = &SwiftLocation{}
-	} else {
-		switch probe.Type {
-		case "":
-			u.Source = &URLSource{}
-		case "yum":
-			u.Source = &YumSource{}
-		case "debian":
-			u.Source = &DebianSource{}
+	switch probe.Type {
+	case "":
+		switch {
+		case probe.URL == "":
+			u.Source = &SwiftLocation{}
+		case strings.HasPrefix(probe.URL, "sftp://"):
+			u.Source = &SFTPSource{}
+		case strings.HasPrefix(probe.URL, "ftp://"):
+			u.Source = &FTPSource{}
 		default:
-			return fmt.Errorf("unexpected value: type = %q", probe.Type)
+			u.Source = &URLSource{}
 		}
+	case "yum":
+		u.Source = &YumSource{}
+	case "debian":
+		u.Source = &DebianSource{}
+	case "goproxy":
+		u.Source = &GoProxySource{}
+	case "checksums":
+		u.Source = &ChecksumFileSource{}
+	case "manifest":
+		u.Source = &ManifestSource{}
+	case "swift":
+		if probe.URL == "" {
+			u.Source = &SwiftLocation{}
+		} else {
+			u.Source = &SwiftURLSource{}
+		}
+	default:
+		return fmt.Errorf("unexpected value: type = %q", probe.Type)
 	}
 	return unmarshal(u.Source)
 }
 
+//TargetsUnmarshaler provides a yaml.Unmarshaler implementation for the
+//jobs[].to field, which can be either a single target or a list of targets.
+type TargetsUnmarshaler []*SwiftLocation
+
+//UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (u *TargetsUnmarshaler) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var probe interface{}
+	err := unmarshal(&probe)
+	if err != nil {
+		return err
+	}
+
+	if _, isList := probe.([]interface{}); isList {
+		var targets []*SwiftLocation
+		err := unmarshal(&targets)
+		if err != nil {
+			return err
+		}
+		*u = targets
+		return nil
+	}
+
+	var target SwiftLocation
+	err = unmarshal(&target)
+	if err != nil {
+		return err
+	}
+	*u = TargetsUnmarshaler{&target}
+	return nil
+}
+
+//Returns the name of the given target in error messages.
+func (cfg JobConfiguration) targetName(name string, idx int) string {
+	if len(cfg.Targets) == 1 {
+		return name + ".to"
+	}
+	return fmt.Sprintf("%s.to[%d]", name, idx)
+}
+
 //Job describes a transfer job at runtime.
 type Job struct {
-	Source     Source
-	Target     *SwiftLocation
-	Matcher    Matcher
-	Segmenting *SegmentingConfiguration
-	Expiration ExpirationConfiguration
-	Cleanup    CleanupConfiguration
+	Source        Source
+	Targets       []*SwiftLocation
+	Matcher       Matcher
+	Segmenting    *SegmentingConfiguration
+	Expiration    ExpirationConfiguration
+	Cleanup       CleanupConfiguration
+	Snapshots     *SnapshotConfiguration
+	BulkUpload    *BulkUploadConfiguration
+	Deduplication *DeduplicationConfiguration
+	//ScrapingFailed is set by the Scraper actor when some directories of this
+	//job could not be listed. (Snapshots are not published in this case.)
+	ScrapingFailed bool
 }
 
 //Compile validates the given JobConfiguration, then creates and prepares a Job from it.
@@ -202,34 +278,56 @@ func (cfg JobConfiguration) Compile(name string, swift SwiftLocation) (job *Job,
 	} else {
 		errors = append(errors, cfg.Source.Source.Validate(name+".from")...)
 	}
-	if cfg.Target == nil {
+	if len(cfg.Targets) == 0 {
 		errors = append(errors, fmt.Errorf("missing value for %s.to", name))
-	} else {
-		//target inherits connection parameters from global Swift credentials
-		cfg.Target.AuthURL = swift.AuthURL
-		cfg.Target.UserName = swift.UserName
-		cfg.Target.UserDomainName = swift.UserDomainName
-		cfg.Target.ProjectName = swift.ProjectName
-		cfg.Target.ProjectDomainName = swift.ProjectDomainName
-		cfg.Target.Password = swift.Password
-		cfg.Target.ApplicationCredentialID = swift.ApplicationCredentialID
-		cfg.Target.ApplicationCredentialName = swift.ApplicationCredentialName
-		cfg.Target.ApplicationCredentialSecret = swift.ApplicationCredentialSecret
-		cfg.Target.RegionName = swift.RegionName
-		errors = append(errors, cfg.Target.Validate(name+".to")...)
+	}
+	for idx, target := range cfg.Targets {
+		//unless the target has its own credentials, it inherits connection
+		//parameters from global Swift credentials
+		if !target.hasCredentials() {
+			target.AuthURL = swift.AuthURL
+			target.UserName = swift.UserName
+			target.UserDomainName = swift.UserDomainName
+			target.ProjectName = swift.ProjectName
+			target.ProjectDomainName = swift.ProjectDomainName
+			target.Password = swift.Password
+			target.ApplicationCredentialID = swift.ApplicationCredentialID
+			target.ApplicationCredentialName = swift.ApplicationCredentialName
+			target.ApplicationCredentialSecret = swift.ApplicationCredentialSecret
+			target.Cloud = swift.Cloud
+			target.FromEnvironment = swift.FromEnvironment
+			target.StorageURL = swift.StorageURL
+			target.AuthToken = swift.AuthToken
+			target.AuthTokenFile = swift.AuthTokenFile
+			target.TempAuthUser = swift.TempAuthUser
+			target.TempAuthKey = swift.TempAuthKey
+			if target.RegionName == "" {
+				target.RegionName = swift.RegionName
+			}
+		}
+		errors = append(errors, target.Validate(cfg.targetName(name, idx))...)
 	}
 
 	if cfg.Match.NotOlderThan != nil {
 		_, isSwiftSource := cfg.Source.Source.(*SwiftLocation)
-		if !isSwiftSource {
+		_, isURLSource := cfg.Source.Source.(*URLSource)
+		_, isSFTPSource := cfg.Source.Source.(*SFTPSource)
+		_, isFTPSource := cfg.Source.Source.(*FTPSource)
+		_, isSwiftURLSource := cfg.Source.Source.(*SwiftURLSource)
+		if !isSwiftSource && !isURLSource && !isSFTPSource && !isFTPSource && !isSwiftURLSource {
 			errors = append(errors, fmt.Errorf("invalid value for %s.match.not_older_than: this option is not supported for source type %T", name, cfg.Source.Source))
 		}
+		if u, ok := cfg.Source.Source.(*URLSource); ok && u.JSONListingMapping != nil && u.JSONListingMapping.MtimeField == "" {
+			errors = append(errors, fmt.Errorf("invalid value for %s.match.not_older_than: requires %s.from.listing_json.mtime to be set", name, name))
+		}
 	}
 
 	if cfg.Match.SimplisticComparison != nil {
 		_, isURLSource := cfg.Source.Source.(*URLSource)
 		_, isSwiftSource := cfg.Source.Source.(*SwiftLocation)
-		if !isURLSource && !isSwiftSource {
+		_, isManifestSource := cfg.Source.Source.(*ManifestSource)
+		_, isSwiftURLSource := cfg.Source.Source.(*SwiftURLSource)
+		if !isURLSource && !isSwiftSource && !isManifestSource && !isSwiftURLSource {
 			errors = append(errors, fmt.Errorf("invalid value for %s.match.simplistic_comparsion: this option is not supported for source type %T", name, cfg.Source.Source))
 		}
 	}
@@ -242,6 +340,10 @@ func (cfg JobConfiguration) Compile(name string, swift SwiftLocation) (job *Job,
 	if isDebianSource {
 		cfg.Source.Source.(*DebianSource).gpgKeyRing = cfg.gpgKeyRing
 	}
+	_, isChecksumFileSource := cfg.Source.Source.(*ChecksumFileSource)
+	if isChecksumFileSource {
+		cfg.Source.Source.(*ChecksumFileSource).gpgKeyRing = cfg.gpgKeyRing
+	}
 
 	if cfg.Segmenting != nil {
 		if cfg.Segmenting.MinObjectSize == 0 {
@@ -250,8 +352,20 @@ func (cfg JobConfiguration) Compile(name string, swift SwiftLocation) (job *Job,
 		if cfg.Segmenting.SegmentSize == 0 {
 			errors = append(errors, fmt.Errorf("missing value for %s.segmenting.segment_bytes", name))
 		}
-		if cfg.Segmenting.ContainerName == "" {
-			cfg.Segmenting.ContainerName = cfg.Target.ContainerName + "_segments"
+		if cfg.Segmenting.Parallelism == 0 {
+			cfg.Segmenting.Parallelism = 1
+		}
+		switch cfg.Segmenting.Strategy {
+		case "", "slo", "dlo":
+		default:
+			errors = append(errors, fmt.Errorf("invalid value for %s.segmenting.strategy: %q", name, cfg.Segmenting.Strategy))
+		}
+		if cfg.Segmenting.SegmentPrefix == "" {
+			cfg.Segmenting.SegmentPrefix = defaultSegmentPrefix
+		}
+		err := validateSegmentPrefix(cfg.Segmenting.SegmentPrefix)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid value for %s.segmenting.segment_prefix: %s", name, err.Error()))
 		}
 	}
 
@@ -266,12 +380,53 @@ func (cfg JobConfiguration) Compile(name string, swift SwiftLocation) (job *Job,
 		errors = append(errors, fmt.Errorf("invalid value for %s.cleanup.strategy: %q", name, ufs))
 	}
 
+	if cfg.Snapshots != nil {
+		if cfg.Snapshots.Retention == 0 {
+			cfg.Snapshots.Retention = 3
+		}
+		if cfg.Snapshots.SymlinksIn == nil {
+			cfg.Snapshots.Symlinks = true
+		} else {
+			cfg.Snapshots.Symlinks = *cfg.Snapshots.SymlinksIn
+		}
+		if ufs != KeepUnknownFiles {
+			errors = append(errors, fmt.Errorf("invalid value for %s.cleanup.strategy: cannot be combined with %s.snapshots (old snapshots are pruned instead)", name, name))
+		}
+	}
+
+	if cfg.BulkUpload != nil {
+		if cfg.BulkUpload.MaxFileSize == 0 {
+			errors = append(errors, fmt.Errorf("missing value for %s.bulk_upload.max_file_bytes", name))
+		}
+		if cfg.BulkUpload.BatchSize == 0 {
+			cfg.BulkUpload.BatchSize = 100
+		}
+	}
+
+	if cfg.Deduplication != nil {
+		switch cfg.Deduplication.Method {
+		case "":
+			cfg.Deduplication.Method = DeduplicateByCopy
+		case DeduplicateByCopy:
+			//nothing to check
+		case DeduplicateBySymlink:
+			if cfg.Snapshots != nil {
+				errors = append(errors, fmt.Errorf("invalid value for %s.deduplication.method: %q cannot be combined with %s.snapshots (symlinks could refer into pruned snapshots)", name, DeduplicateBySymlink, name))
+			}
+		default:
+			errors = append(errors, fmt.Errorf("invalid value for %s.deduplication.method: %q", name, cfg.Deduplication.Method))
+		}
+	}
+
 	job = &Job{
-		Source:     cfg.Source.Source,
-		Target:     cfg.Target,
-		Segmenting: cfg.Segmenting,
-		Expiration: cfg.Expiration,
-		Cleanup:    cfg.Cleanup,
+		Source:        cfg.Source.Source,
+		Targets:       cfg.Targets,
+		Segmenting:    cfg.Segmenting,
+		Expiration:    cfg.Expiration,
+		Cleanup:       cfg.Cleanup,
+		Snapshots:     cfg.Snapshots,
+		BulkUpload:    cfg.BulkUpload,
+		Deduplication: cfg.Deduplication,
 	}
 
 	//compile patterns into regexes
@@ -305,20 +460,49 @@ func (cfg JobConfiguration) Compile(name string, swift SwiftLocation) (job *Job,
 	if err != nil {
 		errors = append(errors, err)
 	}
-	err = job.Target.Connect(name + ".to")
-	if err != nil {
-		errors = append(errors, err)
-	}
-	if job.Target.Account != nil && job.Segmenting != nil {
-		job.Segmenting.Container, err = job.Target.Account.Container(job.Segmenting.ContainerName).EnsureExists()
+	now := time.Now()
+	for idx, target := range job.Targets {
+		targetName := cfg.targetName(name, idx)
+		err = target.Connect(targetName)
 		if err != nil {
 			errors = append(errors, err)
+			continue
+		}
+		if job.Snapshots != nil {
+			//all targets of this job use the same snapshot name
+			err = target.prepareSnapshot(now)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			err = target.checkSnapshotSymlinks(*job.Snapshots, name, targetName)
+			if err != nil {
+				errors = append(errors, err)
+			}
+		}
+		if job.Segmenting != nil {
+			err = target.prepareSegmenting(*job.Segmenting, name, targetName)
+			if err != nil {
+				errors = append(errors, err)
+			}
+		}
+		if job.BulkUpload != nil {
+			err = target.checkBulkUpload(targetName)
+			if err != nil {
+				errors = append(errors, err)
+			}
+		}
+		if job.Deduplication != nil {
+			err = target.checkDeduplication(*job.Deduplication, name, targetName)
+			if err != nil {
+				errors = append(errors, err)
+			}
 		}
-	}
 
-	err = job.Target.DiscoverExistingFiles(job.Matcher)
-	if err != nil {
-		errors = append(errors, err)
+		err = target.DiscoverExistingFiles(job.Matcher)
+		if err != nil {
+			errors = append(errors, err)
+		}
 	}
 
 	return
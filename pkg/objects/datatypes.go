@@ -28,12 +28,14 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ulikunitz/xz"
 )
 
-//AuthPassword contains the password for some OpenStack Authentication credentials.
+//AuthPassword contains the password for some OpenStack Authentication credentials,
+//or some other secret value.
 type AuthPassword string
 
 //UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -46,18 +48,37 @@ func (p *AuthPassword) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return nil
 	}
 
-	//retrieve password from the given environment variable key
-	var envVariableInput struct {
-		Key string `yaml:"fromEnv"`
+	//retrieve password from the given environment variable key, or from the
+	//given file
+	var referenceInput struct {
+		Key      string `yaml:"fromEnv"`
+		FilePath string `yaml:"fromFile"`
 	}
-	err = unmarshal(&envVariableInput)
+	err = unmarshal(&referenceInput)
 	if err != nil {
 		return err
 	}
 
-	passFromEnv := os.Getenv(envVariableInput.Key)
+	switch {
+	case referenceInput.Key != "" && referenceInput.FilePath != "":
+		return errors.New(`only one of "fromEnv" and "fromFile" may be given`)
+	case referenceInput.FilePath != "":
+		buf, err := ioutil.ReadFile(referenceInput.FilePath)
+		if err != nil {
+			return err
+		}
+		//ignore the trailing newline that most editors insert
+		passFromFile := strings.TrimRight(string(buf), "\r\n")
+		if passFromFile == "" {
+			return fmt.Errorf(`file %q is empty`, referenceInput.FilePath)
+		}
+		*p = AuthPassword(passFromFile)
+		return nil
+	}
+
+	passFromEnv := os.Getenv(referenceInput.Key)
 	if passFromEnv == "" {
-		return fmt.Errorf(`environment variable %q is not set`, envVariableInput.Key)
+		return fmt.Errorf(`environment variable %q is not set`, referenceInput.Key)
 	}
 
 	*p = AuthPassword(passFromEnv)
@@ -51,6 +51,7 @@ type DebianSource struct {
 	ClientCertificatePath    string   `yaml:"cert"`
 	ClientCertificateKeyPath string   `yaml:"key"`
 	ServerCAPath             string   `yaml:"ca"`
+	HTTPAuth                 HTTPAuth `yaml:",inline"`
 	Distributions            []string `yaml:"dist"`
 	Architectures            []string `yaml:"arch"`
 	VerifySignature          *bool    `yaml:"verify_signature"`
@@ -67,6 +68,7 @@ func (s *DebianSource) Validate(name string) []error {
 		ClientCertificatePath:    s.ClientCertificatePath,
 		ClientCertificateKeyPath: s.ClientCertificateKeyPath,
 		ServerCAPath:             s.ServerCAPath,
+		HTTPAuth:                 s.HTTPAuth,
 	}
 	s.gpgVerification = true
 	if s.VerifySignature != nil {
@@ -109,11 +111,12 @@ func (s *DebianSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
 	//unique files in order to avoid duplicates in the allFiles slice
 	var allFiles []string
 	isDuplicate := make(map[string]bool)
+	checksums := make(map[string]Checksum)
 
 	//index files for different distributions as specified in the config file
 	for _, distName := range s.Distributions {
 		distRootPath := filepath.Join("dists", distName)
-		distFiles, lerr := s.listDistFiles(distRootPath, cache)
+		distFiles, lerr := s.listDistFiles(distRootPath, cache, checksums)
 		if lerr != nil {
 			return nil, lerr
 		}
@@ -135,13 +138,18 @@ func (s *DebianSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
 		if !exists {
 			result[idx] = FileSpec{Path: path}
 		}
+		if checksum, exists := checksums[path]; exists {
+			checksum := checksum
+			result[idx].Checksum = &checksum
+		}
 	}
 
 	return result, nil
 }
 
-//Helper function for DebianSource.ListAllFiles().
-func (s *DebianSource) listDistFiles(distRootPath string, cache map[string]FileSpec) ([]string, *ListEntriesError) {
+//Helper function for DebianSource.ListAllFiles(). The checksums of package and
+//source files are written into the given map.
+func (s *DebianSource) listDistFiles(distRootPath string, cache map[string]FileSpec, checksums map[string]Checksum) ([]string, *ListEntriesError) {
 	var distFiles []string
 
 	//parse 'inRelease' file to find paths of other control files
@@ -228,6 +236,7 @@ func (s *DebianSource) listDistFiles(distRootPath string, cache map[string]FileS
 	for pkgIndexPath := range packageIndices {
 		var packageIndex []struct {
 			Filename string `control:"Filename"`
+			SHA256   string `control:"SHA256"`
 		}
 		//get package index from 'Packages.xz'
 		_, _, lerr := s.downloadAndParseDCF(pkgIndexPath+".xz", &packageIndex, cache)
@@ -241,6 +250,10 @@ func (s *DebianSource) listDistFiles(distRootPath string, cache map[string]FileS
 
 		for _, pkg := range packageIndex {
 			distFiles = append(distFiles, pkg.Filename)
+			checksum, err := NewChecksum("sha256", pkg.SHA256)
+			if err == nil {
+				checksums[pkg.Filename] = checksum
+			}
 		}
 	}
 
@@ -263,7 +276,12 @@ func (s *DebianSource) listDistFiles(distRootPath string, cache map[string]FileS
 
 		for _, src := range sourceIndex {
 			for _, file := range src.Files {
-				distFiles = append(distFiles, filepath.Join(src.Directory, file.Filename))
+				filePath := filepath.Join(src.Directory, file.Filename)
+				distFiles = append(distFiles, filePath)
+				checksum, err := NewChecksum(file.Algorithm, file.Hash)
+				if err == nil {
+					checksums[filePath] = checksum
+				}
 			}
 		}
 	}
@@ -0,0 +1,300 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+)
+
+//DeduplicationMethod is an enum of legal values for the jobs[].deduplication.method configuration option.
+type DeduplicationMethod string
+
+const (
+	//DeduplicateByCopy is the default deduplication method. Duplicate files are
+	//copied from the existing object with a server-side COPY.
+	DeduplicateByCopy DeduplicationMethod = "copy"
+	//DeduplicateBySymlink is another method. Duplicate files are uploaded as
+	//symlinks to the existing object.
+	DeduplicateBySymlink DeduplicationMethod = "symlink"
+)
+
+//DeduplicationConfiguration contains the "deduplication" section of a JobConfiguration.
+type DeduplicationConfiguration struct {
+	Method DeduplicationMethod `yaml:"method"`
+}
+
+//contentIndex maps checksums of file contents to objects with these contents.
+//It is shared by all jobs, so that duplicate files are also found when they
+//are transferred by different jobs into the same container.
+type contentIndex struct {
+	mutex   sync.Mutex
+	entries map[string]contentIndexEntry
+}
+
+//contentIndexEntry refers to an object in a contentIndex. The Etag is used to
+//recognize when the object has been overwritten in the meantime. The Job is
+//the one that uploaded or found the object.
+type contentIndexEntry struct {
+	ObjectName string
+	Etag       string
+	Job        *Job
+}
+
+var dedupIndex = contentIndex{entries: make(map[string]contentIndexEntry)}
+
+func contentIndexKey(container *schwift.Container, checksum Checksum) (string, error) {
+	containerURL, err := container.URL()
+	return containerURL + "\000" + checksum.String(), err
+}
+
+func (i *contentIndex) Add(container *schwift.Container, checksums []Checksum, entry contentIndexEntry) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for _, checksum := range checksums {
+		key, err := contentIndexKey(container, checksum)
+		if err == nil {
+			i.entries[key] = entry
+		}
+	}
+}
+
+func (i *contentIndex) Find(container *schwift.Container, checksum Checksum) (contentIndexEntry, bool) {
+	key, err := contentIndexKey(container, checksum)
+	if err != nil {
+		return contentIndexEntry{}, false
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, exists := i.entries[key]
+	return entry, exists
+}
+
+func (i *contentIndex) Remove(container *schwift.Container, checksum Checksum, entry contentIndexEntry) {
+	key, err := contentIndexKey(container, checksum)
+	if err != nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	//another worker may have replaced the entry in the meantime
+	if i.entries[key] == entry {
+		delete(i.entries, key)
+	}
+}
+
+//Checks whether the given target supports the given deduplication method.
+func (s *SwiftLocation) checkDeduplication(dc DeduplicationConfiguration, jobName, name string) error {
+	if dc.Method != DeduplicateBySymlink {
+		return nil
+	}
+	capabilities, err := s.Account.Capabilities()
+	if err != nil {
+		return fmt.Errorf("cannot query capabilities of %s: %s", name, err.Error())
+	}
+	if capabilities.Symlink == nil {
+		return fmt.Errorf("invalid value for %s.deduplication.method: %s does not support symlinks", jobName, name)
+	}
+	return nil
+}
+
+//Records the contents of the existing object in the given target, as found
+//by prepareTransfer(), in the content index.
+func (f File) indexExistingObject(t *transferTarget) {
+	hdr := t.Headers
+	if f.Job.Deduplication == nil || t.SymlinkTarget != nil || !hdr.SizeBytes().Exists() {
+		return
+	}
+	var checksums []Checksum
+	if checksum, err := ParseChecksum(hdr.Metadata().Get("Source-Checksum")); err == nil {
+		checksums = append(checksums, checksum)
+	}
+	//the Etag of a large object is not the MD5 checksum of its contents
+	etag := hdr.Etag().Get()
+	if !hdr.IsLargeObject() {
+		if checksum, err := NewChecksum("md5", strings.Trim(etag, `"`)); err == nil {
+			checksums = append(checksums, checksum)
+		}
+	}
+	dedupIndex.Add(t.Location.Container, checksums, contentIndexEntry{ObjectName: t.Object.Name(), Etag: etag, Job: f.Job})
+}
+
+//Records the contents of an object that has just been uploaded into the
+//given target in the content index.
+func (f File) indexUploadedObject(t *transferTarget, checksums []Checksum, size int64) {
+	if f.Job.Deduplication == nil || t.Result != TransferSuccess || len(checksums) == 0 {
+		return
+	}
+	var etag string
+	if f.Job.Segmenting == nil || size <= 0 || uint64(size) < f.Job.Segmenting.MinObjectSize {
+		for _, checksum := range checksums {
+			if checksum.Algorithm == "md5" {
+				etag = hex.EncodeToString(checksum.Digest)
+			}
+		}
+	} else {
+		t.Object.Invalidate()
+		hdr, err := t.Object.Headers()
+		if err != nil {
+			logg.Debug("HEAD %s failed: %s", t.Object.FullName(), err.Error())
+			return
+		}
+		etag = hdr.Etag().Get()
+	}
+	dedupIndex.Add(t.Location.Container, checksums, contentIndexEntry{ObjectName: t.Object.Name(), Etag: etag, Job: f.Job})
+}
+
+//Checks whether the content index knows an object with the same contents as
+//this file in the given target container. If so, the file is transferred by
+//copying or linking that object (see DeduplicationConfiguration), the result
+//is written into t.Result, and true is returned.
+func (f File) deduplicate(t *transferTarget) bool {
+	dc := f.Job.Deduplication
+	if dc == nil || f.Spec.Checksum == nil {
+		return false
+	}
+	entry, exists := dedupIndex.Find(t.Location.Container, *f.Spec.Checksum)
+	if !exists || entry.ObjectName == t.Object.Name() {
+		return false
+	}
+	original := t.Location.Container.Object(entry.ObjectName)
+	hdr, err := original.Headers()
+	if err != nil || strings.Trim(hdr.Etag().Get(), `"`) != strings.Trim(entry.Etag, `"`) || hdr.ExpiresAt().Exists() {
+		//the object has been changed or deleted in the meantime, or will be
+		//deleted soon
+		dedupIndex.Remove(t.Location.Container, *f.Spec.Checksum, entry)
+		return false
+	}
+
+	//the file is not downloaded, so the headers are built from the source
+	//listing and from the original object
+	sourceState := FileState{
+		Etag:        f.Spec.Etag,
+		SizeBytes:   int64(hdr.SizeBytes().Get()),
+		ContentType: hdr.ContentType().Get(),
+	}
+	if f.Spec.LastModified != nil {
+		sourceState.LastModified = f.Spec.LastModified.UTC().Format(http.TimeFormat)
+	}
+	uploadHeaders := f.uploadHeaders(sourceState)
+
+	if util.LogIndividualTransfers {
+		logg.Info("deduplicating %s (same contents as %s)", t.Object.FullName(), original.FullName())
+	}
+
+	if dc.Method == DeduplicateBySymlink && f.canLinkTo(entry) {
+		t.Result = f.uploadSymlink(t, original, uploadHeaders)
+		return true
+	}
+	if hdr.IsLargeObject() && t.Location.SegmentContainer != nil {
+		err = f.copyLargeObjectOnServer(t, original, uploadHeaders, sourceState.SizeBytes)
+	} else {
+		err = f.copyNormalObjectOnServer(t, original, uploadHeaders)
+	}
+	if err == nil {
+		t.Result = TransferSuccess
+		return true
+	}
+
+	logg.Error("COPY %s to %s failed: %s", original.FullName(), t.Object.FullName(), err.Error())
+	if !schwift.Is(err, StatusSwiftRateLimit) {
+		cleanupFailedUpload(t.Object)
+	}
+	t.Result = TransferFailed
+	return true
+}
+
+//Returns whether a duplicate of the given object can be uploaded as a symlink
+//to it. This is only safe when the original object cannot be deleted while the
+//symlink exists, so it must belong to the same job, and that job must not
+//delete objects that disappear from the source. Otherwise, the duplicate is
+//copied instead.
+func (f File) canLinkTo(entry contentIndexEntry) bool {
+	return entry.Job == f.Job && f.Job.Cleanup.Strategy != DeleteUnknownFiles
+}
+
+//Returns the checksum algorithms that are computed during uploads for the
+//content index.
+func (f File) dedupAlgorithms() []string {
+	algorithms := []string{"md5", "sha256"}
+	if f.Spec.Checksum != nil && f.Spec.Checksum.Algorithm != "md5" && f.Spec.Checksum.Algorithm != "sha256" {
+		algorithms = append(algorithms, f.Spec.Checksum.Algorithm)
+	}
+	return algorithms
+}
+
+//contentHasher is an io.ReadCloser that computes checksums of everything that
+//is read from the Base reader.
+type contentHasher struct {
+	Base       io.ReadCloser
+	algorithms []string
+	hashes     []hash.Hash
+	size       int64
+	eof        bool
+}
+
+func newContentHasher(base io.ReadCloser, algorithms []string) *contentHasher {
+	h := &contentHasher{Base: base, algorithms: algorithms}
+	for _, algorithm := range algorithms {
+		h.hashes = append(h.hashes, checksumAlgorithms[algorithm]())
+	}
+	return h
+}
+
+//Read implements the io.Reader interface.
+func (h *contentHasher) Read(buf []byte) (int, error) {
+	n, err := h.Base.Read(buf)
+	for _, hash := range h.hashes {
+		hash.Write(buf[:n])
+	}
+	h.size += int64(n)
+	if err == io.EOF {
+		h.eof = true
+	}
+	return n, err
+}
+
+//Close implements the io.Closer interface.
+func (h *contentHasher) Close() error {
+	return h.Base.Close()
+}
+
+//Checksums returns the checksums of the contents that were read, or nil if
+//the contents were not read completely (e.g. because parts of the file were
+//downloaded with range requests instead).
+func (h *contentHasher) Checksums(expectedSize int64) []Checksum {
+	if h == nil || !h.eof || (expectedSize >= 0 && h.size != expectedSize) {
+		return nil
+	}
+	result := make([]Checksum, len(h.hashes))
+	for idx, hash := range h.hashes {
+		result[idx] = Checksum{Algorithm: h.algorithms[idx], Digest: hash.Sum(nil)}
+	}
+	return result
+}
@@ -0,0 +1,264 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//Returns whether the file can be uploaded into the given target with a delta
+//update (see SegmentingConfiguration.DeltaUpdates).
+func (f File) canUploadDelta(t *transferTarget, sourceState FileState) bool {
+	sc := f.Job.Segmenting
+	if sc == nil || !sc.DeltaUpdates || !t.Headers.IsLargeObject() || f.Spec.Contents != nil || !sourceState.SupportsRanges {
+		return false
+	}
+	//DLO manifests cannot refer to segments with different prefixes
+	if f.largeObjectStrategy(t, sourceState.SizeBytes) != schwift.StaticLargeObject {
+		return false
+	}
+	_, ok := f.Job.Source.(RangeSource)
+	return ok
+}
+
+//deltaSegment describes a segment of a file during a delta update.
+type deltaSegment struct {
+	Offset int64
+	Length int64
+	MD5    string //hex-encoded
+	SHA256 string //hex-encoded
+	//the segment of the existing large object that can be reused, or nil if the
+	//segment has changed
+	Reused *schwift.SegmentInfo
+	//the new segment object (only set for changed segments)
+	Object *schwift.Object
+}
+
+//Updates an existing large object in the given target by only uploading the
+//segments that have changed. The body is read completely to compute the
+//checksum of each segment; changed segments are then downloaded again with
+//range requests. The existing large object stays intact until the new
+//manifest is written.
+func (f File) uploadDelta(t *transferTarget, body io.Reader, hdr schwift.ObjectHeaders, sourceState FileState) (ok bool) {
+	object := t.Object
+	oldLO, err := object.AsLargeObject()
+	var oldSegments []schwift.SegmentInfo
+	if err == nil {
+		oldSegments, err = oldLO.Segments()
+	}
+	if err != nil {
+		logg.Error("could not read manifest of %s: %s", object.FullName(), err.Error())
+		return false
+	}
+
+	//compute checksums for all segments of the source file
+	segmentSize := int64(f.Job.Segmenting.SegmentSize)
+	var segments []*deltaSegment
+	for offset := int64(0); offset < sourceState.SizeBytes; offset += segmentSize {
+		s := &deltaSegment{Offset: offset, Length: segmentSize}
+		if offset+segmentSize > sourceState.SizeBytes {
+			s.Length = sourceState.SizeBytes - offset
+		}
+		md5Hash := md5.New()
+		sha256Hash := sha256.New()
+		_, err := io.CopyN(io.MultiWriter(md5Hash, sha256Hash), body, s.Length)
+		if err != nil {
+			logg.Error("GET %s failed at offset %d: %s", f.Spec.Path, offset, err.Error())
+			return false
+		}
+		s.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+		s.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+
+		idx := len(segments)
+		if idx < len(oldSegments) && isUnchangedSegment(oldSegments[idx], *s) {
+			s.Reused = &oldSegments[idx]
+		}
+		segments = append(segments, s)
+	}
+
+	//upload changed segments (the LargeObject is only used for its
+	//SegmentPrefix; old segments must not be deleted until the new manifest
+	//has been written)
+	lo, err := object.AsNewLargeObject(schwift.SegmentingOptions{
+		SegmentContainer: t.Location.SegmentContainer,
+		SegmentPrefix:    f.newSegmentPrefix(object, schwift.StaticLargeObject, sourceState.SizeBytes),
+		Strategy:         schwift.StaticLargeObject,
+	}, nil)
+	if err == nil {
+		err = f.uploadChangedSegments(lo, segments, hdr, sourceState)
+	}
+	if err == nil {
+		for _, s := range segments {
+			segment := schwift.SegmentInfo{Object: s.Object, SizeBytes: uint64(s.Length), Etag: s.MD5}
+			if s.Reused != nil {
+				segment = *s.Reused
+			}
+			err = lo.AddSegment(segment)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = lo.WriteManifest(hdr.ToOpts())
+	}
+	if err != nil {
+		logg.Error("PUT %s as Static Large Object failed: %s", object.FullName(), err.Error())
+		//the existing large object is still intact, so only the new segments need
+		//to be cleaned up
+		deleteNewSegments(t, segments)
+		return false
+	}
+
+	changedCount := 0
+	for _, s := range segments {
+		if s.Reused == nil {
+			changedCount++
+		}
+	}
+	logg.Info("PUT %s has updated a Static Large Object (%d of %d segments changed, new segments in %s/%s)",
+		object.FullName(), changedCount, len(segments), lo.SegmentContainer().Name(), lo.SegmentPrefix(),
+	)
+
+	//delete the old segments that are not referenced anymore
+	isReused := make(map[string]bool)
+	for _, s := range segments {
+		if s.Reused != nil {
+			isReused[s.Reused.Object.FullName()] = true
+		}
+	}
+	var unused []*schwift.Object
+	for _, segment := range oldSegments {
+		if segment.Object != nil && !isReused[segment.Object.FullName()] {
+			unused = append(unused, segment.Object)
+		}
+	}
+	_, _, err = t.Location.Account.BulkDelete(unused, nil, nil)
+	if err != nil {
+		logg.Error("could not delete old segments of %s: %s", object.FullName(), err.Error())
+	}
+	return true
+}
+
+//Returns whether the given segment of an existing large object has the same
+//contents as the given segment of the source file. If the segment was
+//uploaded by a delta update, its SHA-256 checksum is stored in its metadata.
+//Otherwise, the MD5 checksum from the manifest is used.
+func isUnchangedSegment(old schwift.SegmentInfo, s deltaSegment) bool {
+	if old.Object == nil || old.RangeLength != 0 || old.RangeOffset != 0 {
+		return false
+	}
+	hdr, err := old.Object.Headers()
+	if err != nil {
+		logg.Debug("HEAD %s failed: %s", old.Object.FullName(), err.Error())
+		return false
+	}
+	if hdr.SizeBytes().Get() != uint64(s.Length) {
+		return false
+	}
+	if checksum := hdr.Metadata().Get("Segment-Sha256"); checksum != "" {
+		return checksum == s.SHA256
+	}
+	etag := old.Etag
+	if etag == "" {
+		etag = hdr.Etag().Get()
+	}
+	return strings.Trim(etag, `"`) == s.MD5
+}
+
+//Uploads the segments that have changed. Up to
+//SegmentingConfiguration.Parallelism segments are uploaded concurrently.
+func (f File) uploadChangedSegments(lo *schwift.LargeObject, segments []*deltaSegment, hdr schwift.ObjectHeaders, sourceState FileState) error {
+	queue := make(chan int, len(segments))
+	for idx, s := range segments {
+		if s.Reused == nil {
+			s.Object = segmentObject(lo, idx)
+			queue <- idx
+		}
+	}
+	close(queue)
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	for idx := uint(0); idx < f.Job.Segmenting.Parallelism; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segmentIdx := range queue {
+				err := f.uploadChangedSegment(segments[segmentIdx], hdr, sourceState)
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (f File) uploadChangedSegment(s *deltaSegment, hdr schwift.ObjectHeaders, sourceState FileState) error {
+	body, err := f.Job.Source.(RangeSource).GetFileRange(f.Spec.Path, sourceState, s.Offset, s.Length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	//the Etag ensures that the source file has not changed since the checksums
+	//were computed
+	segmentHeaders := f.segmentHeadersFor(hdr)
+	segmentHeaders.SizeBytes().Set(uint64(s.Length))
+	segmentHeaders.Etag().Set(s.MD5)
+	segmentHeaders.Metadata().Set("Segment-Sha256", s.SHA256)
+	err = s.Object.Upload(body, nil, segmentHeaders.ToOpts())
+	if err != nil {
+		return fmt.Errorf("PUT %s failed: %s", s.Object.FullName(), err.Error())
+	}
+	return nil
+}
+
+//Deletes the segments that were uploaded by a failed delta update.
+func deleteNewSegments(t *transferTarget, segments []*deltaSegment) {
+	var objs []*schwift.Object
+	for _, s := range segments {
+		if s.Object != nil {
+			objs = append(objs, s.Object)
+		}
+	}
+	_, _, err := t.Location.Account.BulkDelete(objs, nil, nil)
+	if err != nil {
+		logg.Error("could not delete new segments of %s: %s", t.Object.FullName(), err.Error())
+	}
+}
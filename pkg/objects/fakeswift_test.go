@@ -0,0 +1,456 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//fakeSwift is a minimal in-memory Swift cluster for tests. It supports
+//containers, plain objects, static and dynamic large objects, symlinks,
+//server-side copies and bulk uploads, but no authentication.
+type fakeSwift struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	capabilities string                      //response body for GET /info
+	containers   map[string]bool             //key = "/v1/ACCOUNT/CONTAINER"
+	policies     map[string]string           //key = "/v1/ACCOUNT/CONTAINER", value = storage policy
+	objects      map[string]*fakeSwiftObject //key = "/v1/ACCOUNT/CONTAINER/OBJECT"
+	failPUT      map[string]bool             //key = "/v1/ACCOUNT" or "/v1/ACCOUNT/CONTAINER/OBJECT"
+	requests     []string                    //e.g. "GET /v1/ACCOUNT/CONTAINER/OBJECT?QUERY"
+	//bulk uploads report errors for these objects (key = "/v1/ACCOUNT/CONTAINER/OBJECT")
+	failBulkUpload map[string]bool
+	//if true, bulk uploads ignore PAX headers like older versions of Swift
+	ignorePAXHeaders bool
+}
+
+const defaultFakeSwiftCapabilities = `{"swift":{"version":"2.25.0","policies":[{"name":"default","default":true},{"name":"archive","aliases":"archive, cold"}]},"slo":{"max_manifest_segments":1000,"max_manifest_size":8388608,"min_segment_size":1},"bulk_upload":{},"symlink":{}}`
+
+type fakeSwiftObject struct {
+	Contents     []byte
+	Headers      http.Header
+	LastModified time.Time
+}
+
+func newFakeSwift() *fakeSwift {
+	s := &fakeSwift{
+		capabilities: defaultFakeSwiftCapabilities,
+		containers:   make(map[string]bool),
+		policies:     make(map[string]string),
+		objects:      make(map[string]*fakeSwiftObject),
+		failPUT:      make(map[string]bool),
+
+		failBulkUpload: make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+//Compiles a job from the given YAML configuration, and fails the test if the
+//configuration is invalid.
+func compileTestJob(t *testing.T, configYAML string) *Job {
+	t.Helper()
+	var cfg JobConfiguration
+	err := yaml.Unmarshal([]byte(configYAML), &cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	job, errs := cfg.Compile("jobs[0]", SwiftLocation{})
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	return job
+}
+
+//Returns the object at the given path ("ACCOUNT/CONTAINER/OBJECT"), or nil.
+func (s *fakeSwift) object(path string) *fakeSwiftObject {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects["/v1/"+path]
+}
+
+func (s *fakeSwift) handle(w http.ResponseWriter, r *http.Request) {
+	//read the request body before locking, otherwise concurrent uploads that
+	//are fed from the same reader could deadlock
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+
+	if r.URL.Path == "/info" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(s.capabilities))
+		return
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 3)
+	switch {
+	case len(fields) == 1 || (len(fields) == 2 && fields[1] == ""):
+		w.WriteHeader(http.StatusNoContent)
+	case len(fields) == 2 || (len(fields) == 3 && fields[2] == ""):
+		s.handleContainer(w, r, contents, "/v1/"+fields[0]+"/"+fields[1])
+	default:
+		s.handleObject(w, r, contents, "/v1/"+fields[0], "/v1/"+fields[0]+"/"+fields[1], r.URL.Path)
+	}
+}
+
+func (s *fakeSwift) handleContainer(w http.ResponseWriter, r *http.Request, contents []byte, containerPath string) {
+	switch r.Method {
+	case "PUT":
+		if r.URL.Query().Get("extract-archive") == "tar" {
+			s.extractArchive(w, contents, containerPath)
+			return
+		}
+		policy := r.Header.Get("X-Storage-Policy")
+		if policy == "" {
+			policy = "default"
+		}
+		switch {
+		case !s.containers[containerPath]:
+			s.containers[containerPath] = true
+			s.policies[containerPath] = policy
+			w.WriteHeader(http.StatusCreated)
+		case r.Header.Get("X-Storage-Policy") != "" && s.policies[containerPath] != policy:
+			http.Error(w, "Storage Policy cannot be changed", http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case "HEAD":
+		if s.containers[containerPath] {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.NotFound(w, r)
+		}
+	case "GET":
+		if !s.containers[containerPath] {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		delimiter := query.Get("delimiter")
+		isListed := make(map[string]bool) //values = object names or subdirectories
+		for path := range s.objects {
+			name := strings.TrimPrefix(path, containerPath+"/")
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				idx := strings.Index(strings.TrimPrefix(name, prefix), delimiter)
+				if idx >= 0 {
+					name = name[:len(prefix)+idx+len(delimiter)]
+				}
+			}
+			if name > query.Get("marker") {
+				isListed[name] = true
+			}
+		}
+		var names []string
+		for name := range isListed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if query.Get("format") != "json" {
+			w.Header().Set("Content-Type", "text/plain")
+			for _, name := range names {
+				w.Write([]byte(name + "\n"))
+			}
+			return
+		}
+		type listingEntry struct {
+			Name         string `json:"name,omitempty"`
+			Bytes        int    `json:"bytes"`
+			Hash         string `json:"hash,omitempty"`
+			ContentType  string `json:"content_type,omitempty"`
+			LastModified string `json:"last_modified,omitempty"`
+			SubDirectory string `json:"subdir,omitempty"`
+			SymlinkPath  string `json:"symlink_path,omitempty"`
+		}
+		listing := []listingEntry{}
+		for _, name := range names {
+			obj := s.objects[containerPath+"/"+name]
+			if obj == nil {
+				listing = append(listing, listingEntry{SubDirectory: name})
+				continue
+			}
+			entry := listingEntry{
+				Name:         name,
+				Bytes:        len(obj.Contents),
+				Hash:         obj.Headers.Get("Etag"),
+				ContentType:  obj.Headers.Get("Content-Type"),
+				LastModified: obj.LastModified.UTC().Format("2006-01-02T15:04:05.000000"),
+			}
+			if target := obj.Headers.Get("X-Symlink-Target"); target != "" {
+				entry.SymlinkPath = path.Dir(containerPath) + "/" + target
+			}
+			listing = append(listing, entry)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listing)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeSwift) handleObject(w http.ResponseWriter, r *http.Request, contents []byte, accountPath, containerPath, objectPath string) {
+	if !s.containers[containerPath] {
+		http.NotFound(w, r)
+		return
+	}
+	isManifestRequest := r.URL.Query().Get("multipart-manifest") != ""
+
+	switch r.Method {
+	case "PUT":
+		if s.failPUT[accountPath] || s.failPUT[objectPath] {
+			http.Error(w, "PUT disabled for testing", http.StatusServiceUnavailable)
+			return
+		}
+		hdr := make(http.Header)
+		for key, values := range r.Header {
+			if isStoredFakeSwiftHeader(key) {
+				hdr[key] = values
+			}
+		}
+		if isManifestRequest {
+			//the manifest is stored as-is; the contents are assembled on GET
+			var segments []fakeSwiftSegment
+			err := json.Unmarshal(contents, &segments)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			etags := ""
+			for _, segment := range segments {
+				etags += segment.Etag
+			}
+			hash := md5.Sum([]byte(etags))
+			hdr.Set("Etag", `"`+hex.EncodeToString(hash[:])+`"`)
+			hdr.Set("X-Static-Large-Object", "True")
+		} else {
+			hash := md5.Sum(contents)
+			hdr.Set("Etag", hex.EncodeToString(hash[:]))
+		}
+		s.objects[objectPath] = &fakeSwiftObject{Contents: contents, Headers: hdr, LastModified: time.Now()}
+		w.Header().Set("Etag", hdr.Get("Etag"))
+		w.WriteHeader(http.StatusCreated)
+	case "HEAD", "GET":
+		obj := s.objects[objectPath]
+		if obj == nil {
+			http.NotFound(w, r)
+			return
+		}
+		for key, values := range obj.Headers {
+			w.Header()[key] = values
+		}
+		body := obj.Contents
+		if !isManifestRequest {
+			body = s.contentsOf(accountPath, obj)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	case "DELETE":
+		if s.objects[objectPath] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.objects, objectPath)
+		w.WriteHeader(http.StatusNoContent)
+	case "COPY":
+		obj := s.objects[objectPath]
+		if obj == nil {
+			http.NotFound(w, r)
+			return
+		}
+		//without ?symlink=get, symlinks are followed
+		if target := obj.Headers.Get("X-Symlink-Target"); target != "" && r.URL.Query().Get("symlink") != "get" {
+			obj = s.objects[accountPath+"/"+target]
+			if obj == nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		targetPath := accountPath + "/" + r.Header.Get("Destination")
+		targetContainerName := strings.SplitN(r.Header.Get("Destination"), "/", 2)[0]
+		if !s.containers[accountPath+"/"+targetContainerName] {
+			http.NotFound(w, r)
+			return
+		}
+		copied := &fakeSwiftObject{Contents: obj.Contents, Headers: make(http.Header), LastModified: time.Now()}
+		isFreshMetadata := r.Header.Get("X-Fresh-Metadata") == "true"
+		for key, values := range obj.Headers {
+			if !isFreshMetadata || !strings.HasPrefix(key, "X-Object-Meta-") {
+				copied.Headers[key] = values
+			}
+		}
+		//without ?multipart-manifest=get, large objects are flattened
+		if !isManifestRequest && isFakeSwiftLargeObject(obj) {
+			copied.Contents = s.contentsOf(accountPath, obj)
+			copied.Headers.Del("X-Static-Large-Object")
+			copied.Headers.Del("X-Object-Manifest")
+			hash := md5.Sum(copied.Contents)
+			copied.Headers.Set("Etag", hex.EncodeToString(hash[:]))
+		}
+		for key, values := range r.Header {
+			if isStoredFakeSwiftHeader(key) {
+				copied.Headers[key] = values
+			}
+		}
+		s.objects[targetPath] = copied
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//Implements bulk uploads into the given container. Only plain tar archives are
+//supported.
+func (s *fakeSwift) extractArchive(w http.ResponseWriter, contents []byte, containerPath string) {
+	if !s.containers[containerPath] {
+		http.NotFound(w, nil)
+		return
+	}
+	created := 0
+	failed := [][]string{}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		objectPath := containerPath + "/" + th.Name
+		if s.failBulkUpload[objectPath] {
+			failed = append(failed, []string{objectPath, "503 Service Unavailable"})
+			continue
+		}
+		hdr := make(http.Header)
+		hash := md5.Sum(data)
+		hdr.Set("Etag", hex.EncodeToString(hash[:]))
+		for key, value := range th.PAXRecords {
+			switch {
+			case s.ignorePAXHeaders:
+			case key == "SCHILY.xattr.user.mime_type":
+				hdr.Set("Content-Type", value)
+			case strings.HasPrefix(key, "SCHILY.xattr.user.meta."):
+				hdr.Set("X-Object-Meta-"+strings.TrimPrefix(key, "SCHILY.xattr.user.meta."), value)
+			}
+		}
+		s.objects[objectPath] = &fakeSwiftObject{Contents: data, Headers: hdr, LastModified: time.Now()}
+		created++
+	}
+
+	status := "201 Created"
+	if len(failed) > 0 {
+		status = "502 Bad Gateway"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Number Files Created": created,
+		"Response Status":      status,
+		"Response Body":        "",
+		"Errors":               failed,
+	})
+}
+
+func isStoredFakeSwiftHeader(key string) bool {
+	return strings.HasPrefix(key, "X-Object-Meta-") || key == "Content-Type" || key == "X-Delete-At" || key == "X-Symlink-Target" || key == "X-Object-Manifest"
+}
+
+func isFakeSwiftLargeObject(obj *fakeSwiftObject) bool {
+	return obj.Headers.Get("X-Static-Large-Object") != "" || obj.Headers.Get("X-Object-Manifest") != ""
+}
+
+type fakeSwiftSegment struct {
+	Path string `json:"path"`
+	Etag string `json:"etag"`
+}
+
+//Returns the contents of the given object. For large objects, the contents of
+//all segments are concatenated.
+func (s *fakeSwift) contentsOf(accountPath string, obj *fakeSwiftObject) []byte {
+	if target := obj.Headers.Get("X-Symlink-Target"); target != "" {
+		if targetObj := s.objects[accountPath+"/"+target]; targetObj != nil {
+			return s.contentsOf(accountPath, targetObj)
+		}
+		return nil
+	}
+	if manifest := obj.Headers.Get("X-Object-Manifest"); manifest != "" {
+		//DLO: all objects below the prefix, in the order of their names
+		prefix := accountPath + "/" + manifest
+		var paths []string
+		for path := range s.objects {
+			if strings.HasPrefix(path, prefix) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		var result []byte
+		for _, path := range paths {
+			result = append(result, s.objects[path].Contents...)
+		}
+		return result
+	}
+	if obj.Headers.Get("X-Static-Large-Object") == "" {
+		return obj.Contents
+	}
+	var segments []fakeSwiftSegment
+	json.Unmarshal(obj.Contents, &segments)
+	var result []byte
+	for _, segment := range segments {
+		if segmentObj := s.objects[accountPath+segment.Path]; segmentObj != nil {
+			result = append(result, segmentObj.Contents...)
+		}
+	}
+	return result
+}
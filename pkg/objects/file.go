@@ -21,9 +21,11 @@ package objects
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/majewsky/schwift"
@@ -35,6 +37,9 @@ import (
 type File struct {
 	Job  *Job
 	Spec FileSpec
+	//only set for symlinks whose target is transferred into the same target
+	//container(s), as determined by the SymlinkResolver actor
+	SymlinkTarget *SymlinkTarget
 }
 
 //FileSpec contains metadata for a File. The only required field is Path.
@@ -44,18 +49,30 @@ type File struct {
 type FileSpec struct {
 	Path        string
 	IsDirectory bool
-	//only set for files in Swift sources (otherwise nil)
+	//only set for files in Swift sources and in sources whose listings report
+	//this information (otherwise nil/empty)
 	LastModified *time.Time
-	//only set for symlinks (refers to a path below the ObjectPrefix in the same container)
+	SizeBytes    *int64
+	Etag         string
+	//only set if LastModified is less precise than the Last-Modified header
+	//(e.g. in HTML directory listings that show timestamps without seconds)
+	LastModifiedPrecision time.Duration
+	//only set for symlinks (refers to a path relative to the job's source root,
+	//which may start with "../" if the symlink refers to a file outside of it;
+	//see SymlinkSource)
 	SymlinkTargetPath string
+	//only set for files whose checksum is known from the source's metadata
+	//(e.g. from a checksum file or from repository metadata)
+	Checksum *Checksum
 	//results of GET on this file
 	Contents []byte
 	Headers  http.Header
 }
 
-//TargetObject returns the object corresponding to this file in the target container.
-func (f File) TargetObject() *schwift.Object {
-	return f.Job.Target.ObjectAtPath(f.Spec.Path)
+//TargetObject returns the object corresponding to this file in the given
+//target container.
+func (f File) TargetObject(target *SwiftLocation) *schwift.Object {
+	return target.ObjectAtPath(f.Spec.Path)
 }
 
 //TransferResult is the return type for PerformTransfer().
@@ -72,39 +89,115 @@ const (
 	TransferFailed
 )
 
-//PerformTransfer transfers this file from the source to the target.
-//It returns the TransferResult (which indicates if the transfer finished successfully)
-//and the number of bytes transferred.
-func (f File) PerformTransfer() (TransferResult, int64) {
-	object := f.TargetObject()
+//transferTarget contains the state of the transfer of a File into one of the
+//targets of its Job.
+type transferTarget struct {
+	Location *SwiftLocation
+	Object   *schwift.Object
+	//results of HEAD on the target object
+	Headers       schwift.ObjectHeaders
+	SymlinkTarget *schwift.Object
+	//headers for a conditional GET on the source
+	RequestHeaders schwift.ObjectHeaders
+	//when writing into a new snapshot, this is the corresponding object in the
+	//previous snapshot which will be copied if the file has not changed
+	PreviousObject  *schwift.Object
+	PreviousHeaders schwift.ObjectHeaders
+	//set if the upload into this target was deferred to a bulk upload (see
+	//BulkUploader), in which case Result is only filled after the batch has
+	//been uploaded
+	BulkEntry *bulkEntry
+	Result    TransferResult
+}
 
-	//check if this file needs transfer
-	if f.Job.Matcher.ImmutableFileRx != nil && f.Job.Matcher.ImmutableFileRx.MatchString(f.Spec.Path) {
-		if f.Job.Target.FileExists[object.Name()] {
-			logg.Debug("skipping %s: already transferred", object.FullName())
-			return TransferSkipped, 0
+//PerformTransfer transfers this file from the source to the given targets
+//(usually f.Job.Targets, or a subset thereof when retrying). The file is
+//downloaded from the source only once, and streamed into all targets that
+//need it concurrently.
+//
+//It returns one TransferResult for each target (which indicates if the
+//transfer into that target finished successfully), and the number of bytes
+//transferred into each successful target.
+func (f File) PerformTransfer(targets []*SwiftLocation) ([]TransferResult, int64) {
+	all, size := f.performTransfer(targets, nil)
+	results := make([]TransferResult, len(targets))
+	for idx, t := range all {
+		results[idx] = t.Result
+	}
+	return results, size
+}
+
+//Implementation of PerformTransfer() and BulkUploader.Transfer(). If bulk is
+//not nil, uploads into some targets may be deferred (see
+//transferTarget.BulkEntry).
+func (f File) performTransfer(targets []*SwiftLocation, bulk *BulkUploader) ([]*transferTarget, int64) {
+	all := make([]*transferTarget, len(targets))
+	var (
+		pending []*transferTarget
+		size    int64
+	)
+	for idx, target := range targets {
+		t := &transferTarget{Location: target, Object: f.TargetObject(target)}
+		all[idx] = t
+		if !f.prepareTransfer(t) {
+			continue
+		}
+		//files with the same contents as an existing object do not need to be
+		//downloaded either
+		if f.deduplicate(t) {
+			continue
 		}
+		//within the same Swift account, the file does not need to be downloaded
+		//at all
+		if sourceObject := f.serverSideCopySource(t); sourceObject != nil {
+			if copiedSize := f.copyOnServer(t, sourceObject); t.Result == TransferSuccess {
+				size = copiedSize
+			}
+			continue
+		}
+		pending = append(pending, t)
 	}
 
-	//can only transfer as a symlink if the target server supports it
-	capabilities, err := f.Job.Target.Container.Account().Capabilities()
-	if err != nil {
-		logg.Fatal("query /info on target failed: %s", err.Error())
+	if len(pending) > 0 {
+		size = f.transferToTargets(pending, bulk)
 	}
-	if capabilities.Symlink == nil {
-		f.Spec.SymlinkTargetPath = ""
+
+	//unchanged files are copied from the previous snapshot
+	for _, t := range all {
+		if t.Result == TransferSkipped && t.PreviousObject != nil && t.BulkEntry == nil {
+			t.Result = f.copyFromPreviousSnapshot(t)
+		}
 	}
+	return all, size
+}
 
-	//symlinks are safe to use only if the target object is also included in this job
-	//(TODO extend validation to allow for target to be transferred by any job,
-	//e.g. by adding a new actor between scraper and transferor that has access
-	//to the full list of jobs)
-	//(FIXME we should give something non-nil for the second argument of
-	//CheckRecursive(), otherwise symlinks might interact with the not_older_than
-	//filter in surprising ways)
-	if f.Spec.SymlinkTargetPath != "" {
-		if f.Job.Matcher.CheckRecursive(f.Spec.SymlinkTargetPath, nil) != nil {
-			f.Spec.SymlinkTargetPath = ""
+//Checks whether the file needs to be transferred into the given target. If
+//not (or if the file has already been transferred as a symlink), t.Result is
+//filled and false is returned. Otherwise, t.Headers and t.RequestHeaders are
+//filled and true is returned.
+func (f File) prepareTransfer(t *transferTarget) bool {
+	object := t.Object
+
+	//check if this file needs transfer
+	if f.Job.Matcher.ImmutableFileRx != nil && f.Job.Matcher.ImmutableFileRx.MatchString(f.Spec.Path) {
+		if t.Location.FileExists[object.Name()] {
+			logg.Debug("skipping %s: already transferred", object.FullName())
+			t.Result = TransferSkipped
+			return false
+		}
+	}
+
+	//can only transfer as a symlink if the target server supports it, and if
+	//the symlink target is transferred into the same container (f.SymlinkTarget
+	//is only set by the SymlinkResolver in that case)
+	var symlinkTarget *schwift.Object
+	if f.SymlinkTarget != nil {
+		capabilities, err := t.Location.Container.Account().Capabilities()
+		if err != nil {
+			logg.Fatal("query /info on target failed: %s", err.Error())
+		}
+		if capabilities.Symlink != nil {
+			symlinkTarget = f.SymlinkTarget.objectIn(t.Location)
 		}
 	}
 
@@ -123,35 +216,97 @@ func (f File) PerformTransfer() (TransferResult, int64) {
 			logg.Error("skipping target %s: HEAD failed: %s",
 				object.FullName(), err.Error(),
 			)
-			return TransferFailed, 0
+			t.Result = TransferFailed
+			return false
 		}
 	}
+	t.Headers = hdr
+	t.SymlinkTarget = currentSymlinkTarget
 
 	//if we want to upload a symlink, we can skip the whole Last-Modified/Etag
 	//shebang and straight-up compare the symlink target
-	if f.Spec.SymlinkTargetPath != "" {
-		return f.uploadSymlink(currentSymlinkTarget, hdr.IsLargeObject()), 0
+	if symlinkTarget != nil {
+		t.Result = f.uploadSymlink(t, symlinkTarget, schwift.NewObjectHeaders())
+		return false
+	}
+	f.indexExistingObject(t)
+
+	//a new snapshot starts out empty, so we compare with the previous snapshot
+	//instead (and copy the file from there if it has not changed)
+	if !hdr.SizeBytes().Exists() {
+		if previousObject := t.Location.previousSnapshotObject(object); previousObject != nil {
+			previousHdr, err := previousObject.Headers()
+			switch {
+			case err == nil:
+				t.PreviousObject = previousObject
+				t.PreviousHeaders = previousHdr
+				hdr = previousHdr
+			case schwift.Is(err, http.StatusNotFound):
+				//file is new in this snapshot
+			default:
+				logg.Error("skipping target %s: HEAD %s failed: %s",
+					object.FullName(), previousObject.FullName(), err.Error(),
+				)
+				t.Result = TransferFailed
+				return false
+			}
+		}
 	}
 
-	//retrieve object from source, taking advantage of Etag and Last-Modified where possible
-	requestHeaders := schwift.NewObjectHeaders()
+	//prepare request headers to retrieve the object from the source, taking
+	//advantage of Etag and Last-Modified where possible
+	t.RequestHeaders = schwift.NewObjectHeaders()
 	if f.Job.Matcher.SimplisticComparison != nil && *f.Job.Matcher.SimplisticComparison {
 		if val := hdr.Get("Last-Modified"); val != "" {
-			requestHeaders.Set("If-Modified-Since", val)
+			t.RequestHeaders.Set("If-Modified-Since", val)
 		}
 	} else {
 		metadata := hdr.Metadata()
+		//if the source listing already told us the Etag, we don't need to ask
+		//the source again
+		if f.Spec.Etag != "" && f.Spec.Etag == metadata.Get("Source-Etag") {
+			logg.Debug("skipping %s: Etag from source listing matches target", object.FullName())
+			t.Result = TransferSkipped
+			return false
+		}
+		if f.Job.Deduplication != nil && f.Spec.Checksum != nil && f.Spec.Checksum.String() == metadata.Get("Source-Checksum") {
+			logg.Debug("skipping %s: checksum from source listing matches target", object.FullName())
+			t.Result = TransferSkipped
+			return false
+		}
+		if f.Spec.matchesTargetState(hdr) {
+			logg.Debug("skipping %s: size and mtime from source listing match target", object.FullName())
+			t.Result = TransferSkipped
+			return false
+		}
 		if val := metadata.Get("Source-Etag"); val != "" {
-			requestHeaders.Set("If-None-Match", val)
+			t.RequestHeaders.Set("If-None-Match", val)
 		}
 		if val := metadata.Get("Source-Last-Modified"); val != "" {
-			requestHeaders.Set("If-Modified-Since", val)
+			t.RequestHeaders.Set("If-Modified-Since", val)
+		}
+	}
+	return true
+}
+
+//Downloads the file from the source and uploads it into all the given
+//targets. The result for each target is written into t.Result, unless the
+//upload is deferred to the given BulkUploader. Returns the size of the file.
+func (f File) transferToTargets(targets []*transferTarget, bulk *BulkUploader) int64 {
+	//a conditional GET is only possible if all targets agree on the request
+	//headers; otherwise each target has to decide by itself after the GET
+	requestHeaders := targets[0].RequestHeaders
+	for _, t := range targets[1:] {
+		if !hasSameConditionalHeaders(requestHeaders, t.RequestHeaders) {
+			requestHeaders = schwift.NewObjectHeaders()
+			break
 		}
 	}
 
 	var (
 		body        io.ReadCloser
 		sourceState FileState
+		err         error
 	)
 	if f.Spec.Contents == nil {
 		body, sourceState, err = f.Job.Source.GetFile(f.Spec.Path, requestHeaders)
@@ -161,69 +316,372 @@ func (f File) PerformTransfer() (TransferResult, int64) {
 	}
 	if err != nil {
 		logg.Error("GET %s failed: %s", f.Spec.Path, err.Error())
-		return TransferFailed, 0
+		for _, t := range targets {
+			t.Result = TransferFailed
+		}
+		return 0
 	}
 	if body != nil {
 		defer body.Close()
 	}
+	if f.transferRedirectAsSymlink(targets, sourceState) {
+		return 0
+	}
 	if sourceState.SkipTransfer { // 304 Not Modified
-		return TransferSkipped, 0
+		for _, t := range targets {
+			t.Result = TransferSkipped
+		}
+		return 0
 	}
 
-	if util.LogIndividualTransfers {
-		logg.Info("transferring to %s", object.FullName())
+	var uploadTargets []*transferTarget
+	for _, t := range targets {
+		if len(targets) > 1 && sourceState.isNotModified(t.RequestHeaders) {
+			logg.Debug("skipping %s: source file was not modified", t.Object.FullName())
+			t.Result = TransferSkipped
+		} else {
+			uploadTargets = append(uploadTargets, t)
+		}
+	}
+	if len(uploadTargets) == 0 {
+		return 0
+	}
+
+	//upload file to target(s)
+	uploadHeaders := f.uploadHeaders(sourceState)
+	size := sourceState.SizeBytes
+
+	//when deduplicating, the checksums of the uploaded contents are recorded
+	//so that later files with the same contents can refer to this file
+	var hasher *contentHasher
+	if f.Job.Deduplication != nil {
+		hasher = newContentHasher(body, f.dedupAlgorithms())
+		body = hasher
+	}
+
+	//small files are collected for bulk uploads where possible (this requires
+	//the file to be read into memory; the other targets are then served from
+	//memory as well)
+	var bulkTargets, otherTargets []*transferTarget
+	for _, t := range uploadTargets {
+		if bulk.accepts(f, t, uploadHeaders, sourceState) {
+			bulkTargets = append(bulkTargets, t)
+		} else {
+			otherTargets = append(otherTargets, t)
+		}
+	}
+	if len(bulkTargets) > 0 {
+		contents, err := ioutil.ReadAll(io.LimitReader(body, size+1))
+		if err == nil && int64(len(contents)) != size {
+			err = fmt.Errorf("expected %d bytes, got %d bytes", size, len(contents))
+		}
+		if err != nil {
+			logg.Error("GET %s failed: %s", f.Spec.Path, err.Error())
+			for _, t := range uploadTargets {
+				t.Result = TransferFailed
+			}
+			return 0
+		}
+		for _, t := range bulkTargets {
+			if util.LogIndividualTransfers {
+				logg.Info("transferring to %s (in bulk)", t.Object.FullName())
+			}
+			t.BulkEntry = &bulkEntry{Target: t, Contents: contents, Headers: uploadHeaders, Checksums: hasher.Checksums(size)}
+		}
+		if len(otherTargets) == 0 {
+			return size
+		}
+		uploadTargets = otherTargets
+		//the original body is still closed by the deferred call above
+		body = ioutil.NopCloser(bytes.NewReader(contents))
+	}
+	switch {
+	case f.canUploadInParallel(uploadTargets, sourceState):
+		f.uploadInParallel(uploadTargets, body, sourceState, uploadHeaders)
+	case len(uploadTargets) == 1:
+		f.upload(uploadTargets[0], body, uploadHeaders, sourceState, true)
+	default:
+		consumers := make([]func(io.Reader), len(uploadTargets))
+		for idx, t := range uploadTargets {
+			t := t
+			consumers[idx] = func(r io.Reader) {
+				f.upload(t, r, uploadHeaders, sourceState, false)
+			}
+		}
+		util.FanOut(body, consumers...)
+	}
+
+	for _, t := range uploadTargets {
+		f.indexUploadedObject(t, hasher.Checksums(size), size)
 	}
+	return size
+}
 
-	//store some headers from the source to later identify whether this
-	//resource has changed
-	uploadHeaders := schwift.NewObjectHeaders()
-	uploadHeaders.ContentType().Set(sourceState.ContentType)
+//Returns the headers for uploading a file in the given state. Some headers
+//from the source are stored to later identify whether this resource has
+//changed.
+func (f File) uploadHeaders(sourceState FileState) schwift.ObjectHeaders {
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set(sourceState.ContentType)
 	if sourceState.Etag != "" {
-		uploadHeaders.Metadata().Set("Source-Etag", sourceState.Etag)
+		hdr.Metadata().Set("Source-Etag", sourceState.Etag)
 	}
 	if sourceState.LastModified != "" {
-		uploadHeaders.Metadata().Set("Source-Last-Modified", sourceState.LastModified)
+		hdr.Metadata().Set("Source-Last-Modified", sourceState.LastModified)
+	}
+	if f.Job.Deduplication != nil && f.Spec.Checksum != nil {
+		hdr.Metadata().Set("Source-Checksum", f.Spec.Checksum.String())
 	}
 	if f.Job.Expiration.Enabled && sourceState.ExpiryTime != nil {
 		delay := time.Duration(f.Job.Expiration.DelaySeconds) * time.Second
-		uploadHeaders.ExpiresAt().Set(sourceState.ExpiryTime.Add(delay))
+		hdr.ExpiresAt().Set(sourceState.ExpiryTime.Add(delay))
+	}
+	return hdr
+}
+
+//Uploads the file into the given target, and writes the result into t.Result.
+//If canSeek is true, the body is not shared with other targets, so the upload
+//may skip parts of the body by downloading the rest of the file with a range
+//request instead.
+func (f File) upload(t *transferTarget, body io.Reader, hdr schwift.ObjectHeaders, sourceState FileState, canSeek bool) {
+	if util.LogIndividualTransfers {
+		logg.Info("transferring to %s", t.Object.FullName())
 	}
 
-	//upload file to target
 	var ok bool
 	size := sourceState.SizeBytes
-	if f.Job.Segmenting != nil && size > 0 && uint64(size) >= f.Job.Segmenting.MinObjectSize {
-		ok = f.uploadLargeObject(body, uploadHeaders, hdr.IsLargeObject())
+	switch {
+	case f.Job.Segmenting == nil || size <= 0 || uint64(size) < f.Job.Segmenting.MinObjectSize:
+		ok = f.uploadNormalObject(t, body, hdr)
+	case f.canUploadDelta(t, sourceState):
+		ok = f.uploadDelta(t, body, hdr, sourceState)
+	default:
+		ok = f.uploadLargeObject(t, body, hdr, sourceState, canSeek)
+	}
+	if ok {
+		t.Result = TransferSuccess
 	} else {
-		ok = f.uploadNormalObject(body, uploadHeaders, hdr.IsLargeObject())
+		t.Result = TransferFailed
 	}
+}
 
-	if ok {
-		return TransferSuccess, size
+//Returns whether the two request headers contain the same conditions.
+func hasSameConditionalHeaders(lhs, rhs schwift.ObjectHeaders) bool {
+	for _, key := range []string{"If-None-Match", "If-Modified-Since"} {
+		if lhs.Get(key) != rhs.Get(key) {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns whether a conditional GET with the given request headers would have
+//resulted in 304 (Not Modified) for a file in this state.
+func (s FileState) isNotModified(requestHeaders schwift.ObjectHeaders) bool {
+	if etag := requestHeaders.Get("If-None-Match"); etag != "" && s.Etag != "" {
+		return etag == s.Etag
+	}
+	if val := requestHeaders.Get("If-Modified-Since"); val != "" && s.LastModified != "" {
+		targetMtime, err := http.ParseTime(val)
+		if err != nil {
+			return false
+		}
+		sourceMtime, err := http.ParseTime(s.LastModified)
+		if err != nil {
+			return false
+		}
+		return !sourceMtime.After(targetMtime)
+	}
+	return false
+}
+
+//Copies the unchanged file from the previous snapshot into the new snapshot.
+func (f File) copyFromPreviousSnapshot(t *transferTarget) TransferResult {
+	var ropts *schwift.RequestOptions
+	if t.PreviousHeaders.IsLargeObject() {
+		//only copy the manifest; the copy refers to the same segments
+		ropts = &schwift.RequestOptions{
+			Values: url.Values{"multipart-manifest": []string{"get"}},
+		}
+	}
+	err := t.PreviousObject.CopyTo(t.Object, nil, ropts)
+	if err != nil {
+		logg.Error("COPY %s to %s failed: %s", t.PreviousObject.FullName(), t.Object.FullName(), err.Error())
+		return TransferFailed
+	}
+	logg.Debug("copied %s from previous snapshot", t.Object.FullName())
+	return TransferSkipped
+}
+
+//Returns the source object if the file can be copied into the given target on
+//the server side (i.e. if the source is in the same Swift account as the
+//target), or nil otherwise.
+func (f File) serverSideCopySource(t *transferTarget) *schwift.Object {
+	source, ok := f.Job.Source.(*SwiftLocation)
+	if !ok || f.Spec.Contents != nil || !source.isSameAccount(*t.Location) {
+		return nil
 	}
-	return TransferFailed, 0
+	return source.ObjectAtPath(f.Spec.Path)
 }
 
-func (f File) uploadSymlink(previousTarget *schwift.Object, cleanupOldSegments bool) TransferResult {
-	object := f.TargetObject()
-	newTarget := f.Job.Target.ObjectAtPath(f.Spec.SymlinkTargetPath)
+//Transfers the file into the given target with a server-side COPY, and writes
+//the result into t.Result. Returns the size of the file.
+func (f File) copyOnServer(t *transferTarget, sourceObject *schwift.Object) int64 {
+	hdr, err := sourceObject.Headers()
+	if err != nil {
+		logg.Error("HEAD %s failed: %s", sourceObject.FullName(), err.Error())
+		t.Result = TransferFailed
+		return 0
+	}
+	sourceState := swiftFileState(hdr)
+	if sourceState.isNotModified(t.RequestHeaders) {
+		logg.Debug("skipping %s: source file was not modified", t.Object.FullName())
+		t.Result = TransferSkipped
+		return 0
+	}
+
+	if util.LogIndividualTransfers {
+		logg.Info("copying %s to %s", sourceObject.FullName(), t.Object.FullName())
+	}
 
-	if previousTarget != nil && newTarget.IsEqualTo(previousTarget) {
+	uploadHeaders := f.uploadHeaders(sourceState)
+	if hdr.IsLargeObject() && t.Location.SegmentContainer != nil {
+		err = f.copyLargeObjectOnServer(t, sourceObject, uploadHeaders, sourceState.SizeBytes)
+	} else {
+		err = f.copyNormalObjectOnServer(t, sourceObject, uploadHeaders)
+	}
+	if err == nil {
+		t.Result = TransferSuccess
+		return sourceState.SizeBytes
+	}
+
+	logg.Error("COPY %s to %s failed: %s", sourceObject.FullName(), t.Object.FullName(), err.Error())
+	if !schwift.Is(err, StatusSwiftRateLimit) {
+		cleanupFailedUpload(t.Object)
+	}
+	t.Result = TransferFailed
+	return 0
+}
+
+func (f File) copyNormalObjectOnServer(t *transferTarget, sourceObject *schwift.Object, hdr schwift.ObjectHeaders) error {
+	//when overwriting a large object, its segments need to be cleaned up
+	//afterwards (COPY does not have an option for that, unlike PUT)
+	var oldSegments []*schwift.Object
+	if t.Headers.IsLargeObject() {
+		lo, err := t.Object.AsLargeObject()
+		if err != nil {
+			return err
+		}
+		oldSegments = lo.SegmentObjects()
+	}
+
+	//the headers of the copy are only those that we would have set on upload
+	err := sourceObject.CopyTo(t.Object, &schwift.CopyOptions{FreshMetadata: true}, hdr.ToOpts())
+	if err != nil {
+		return err
+	}
+
+	if len(oldSegments) > 0 {
+		_, _, err := t.Location.Account.BulkDelete(oldSegments, nil, nil)
+		if err != nil {
+			logg.Error("could not delete old segments of %s: %s", t.Object.FullName(), err.Error())
+		}
+	}
+	return nil
+}
+
+//Large objects are copied segment by segment into the target's segment
+//container, so that the copy does not refer to the segments of the source
+//object (which may be deleted at any time).
+func (f File) copyLargeObjectOnServer(t *transferTarget, sourceObject *schwift.Object, hdr schwift.ObjectHeaders, sizeBytes int64) error {
+	sourceLO, err := sourceObject.AsLargeObject()
+	if err != nil {
+		return err
+	}
+	segments, err := sourceLO.Segments()
+	if err != nil {
+		return err
+	}
+
+	strategy := f.largeObjectStrategy(t, sizeBytes)
+	lo, err := t.Object.AsNewLargeObject(schwift.SegmentingOptions{
+		SegmentContainer: t.Location.SegmentContainer,
+		SegmentPrefix:    f.newSegmentPrefix(t.Object, strategy, sizeBytes),
+		Strategy:         strategy,
+	}, &schwift.TruncateOptions{
+		DeleteSegments: t.Headers.IsLargeObject(),
+	})
+	if err != nil {
+		return err
+	}
+
+	segmentHeaders := f.segmentHeadersFor(hdr)
+	for _, segment := range segments {
+		//data segments are embedded in the manifest and can be reused as-is
+		if segment.Object != nil {
+			segmentObject := lo.NextSegmentObject()
+			err := segment.Object.CopyTo(segmentObject, &schwift.CopyOptions{FreshMetadata: true}, segmentHeaders.ToOpts())
+			if err != nil {
+				return err
+			}
+			segment.Object = segmentObject
+		}
+		err := lo.AddSegment(segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = lo.WriteManifest(hdr.ToOpts())
+	if err == nil {
+		logg.Info("COPY %s has created a %s with segments in %s/%s",
+			t.Object.FullName(), largeObjectType(strategy), lo.SegmentContainer().Name(), lo.SegmentPrefix(),
+		)
+	}
+	return err
+}
+
+//Uploads the file into the given target as a symlink to the given object.
+func (f File) uploadSymlink(t *transferTarget, newTarget *schwift.Object, hdr schwift.ObjectHeaders) TransferResult {
+	object := t.Object
+	if t.SymlinkTarget != nil && newTarget.IsEqualTo(t.SymlinkTarget) {
 		logg.Debug("skipping %s: already symlinked to the correct target", object.FullName())
 		return TransferSkipped
 	}
 
 	err := object.SymlinkTo(newTarget, &schwift.SymlinkOptions{
-		DeleteSegments: cleanupOldSegments,
-	}, nil)
+		DeleteSegments: t.Headers.IsLargeObject(),
+	}, hdr.ToOpts())
 	if err == nil {
 		return TransferSuccess
 	}
 
+	logg.Error("PUT %s as symlink to %s failed: %s", object.FullName(), newTarget.FullName(), err.Error())
+
 	cleanupFailedUpload(object)
 	return TransferFailed
 }
 
+//Returns whether the size and modification time reported by the source
+//listing match the state of the source file that was recorded on the target
+//during the last transfer.
+func (s FileSpec) matchesTargetState(hdr schwift.ObjectHeaders) bool {
+	if s.SizeBytes == nil || s.LastModified == nil || !hdr.SizeBytes().Exists() {
+		return false
+	}
+	if hdr.SizeBytes().Get() != uint64(*s.SizeBytes) {
+		return false
+	}
+	recordedMtime, err := http.ParseTime(hdr.Metadata().Get("Source-Last-Modified"))
+	if err != nil {
+		return false
+	}
+	if s.LastModifiedPrecision > 0 {
+		recordedMtime = recordedMtime.Truncate(s.LastModifiedPrecision)
+	}
+	return recordedMtime.Equal(*s.LastModified)
+}
+
 func (s FileSpec) toTransferFormat(requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
 	targetState := FileState{
 		Etag:         requestHeaders.Get("If-None-Match"),
@@ -260,10 +718,10 @@ func (s FileSpec) toTransferFormat(requestHeaders schwift.ObjectHeaders) (io.Rea
 //indicate Too Many Requests.
 const StatusSwiftRateLimit = 498
 
-func (f File) uploadNormalObject(body io.Reader, hdr schwift.ObjectHeaders, cleanupOldSegments bool) (ok bool) {
-	object := f.TargetObject()
+func (f File) uploadNormalObject(t *transferTarget, body io.Reader, hdr schwift.ObjectHeaders) (ok bool) {
+	object := t.Object
 	err := object.Upload(body, &schwift.UploadOptions{
-		DeleteSegments: cleanupOldSegments,
+		DeleteSegments: t.Headers.IsLargeObject(),
 	}, hdr.ToOpts())
 	if err == nil {
 		return true
@@ -281,35 +739,61 @@ func (f File) uploadNormalObject(body io.Reader, hdr schwift.ObjectHeaders, clea
 	return false
 }
 
-func (f File) uploadLargeObject(body io.Reader, hdr schwift.ObjectHeaders, cleanupOldSegments bool) (ok bool) {
-	object := f.TargetObject()
+func (f File) uploadLargeObject(t *transferTarget, body io.Reader, hdr schwift.ObjectHeaders, sourceState FileState, canSeek bool) (ok bool) {
+	object := t.Object
+
+	//if an earlier upload was interrupted, continue where it left off
+	strategy := f.largeObjectStrategy(t, sourceState.SizeBytes)
+	resumed := f.findResumableUpload(t, strategy, hdr, sourceState.SizeBytes)
+	segmentPrefix := f.newSegmentPrefix(object, strategy, sourceState.SizeBytes)
+	if resumed != nil {
+		segmentPrefix = resumed.SegmentPrefix
+	}
 
 	lo, err := object.AsNewLargeObject(schwift.SegmentingOptions{
-		SegmentContainer: f.Job.Segmenting.Container,
-		Strategy:         schwift.StaticLargeObject,
+		SegmentContainer: t.Location.SegmentContainer,
+		SegmentPrefix:    segmentPrefix,
+		Strategy:         strategy,
 	}, &schwift.TruncateOptions{
-		DeleteSegments: cleanupOldSegments,
+		DeleteSegments: t.Headers.IsLargeObject(),
 	})
-	if err == nil {
-		XDeleteAtHeader := schwift.NewObjectHeaders()
-		if hdr.ExpiresAt().Exists() {
-			XDeleteAtHeader.ExpiresAt().Set(hdr.ExpiresAt().Get())
+	if err == nil && resumed != nil {
+		var offset int64
+		for _, segment := range resumed.Segments {
+			offset += int64(segment.SizeBytes)
+			err = lo.AddSegment(segment)
+			if err != nil {
+				break
+			}
 		}
-		err = lo.Append(body, int64(f.Job.Segmenting.SegmentSize), XDeleteAtHeader.ToOpts())
+		if err == nil {
+			logg.Info("resuming upload of %s at offset %d (%d segments already uploaded)",
+				object.FullName(), offset, len(resumed.Segments))
+			var closer io.Closer
+			body, closer, err = f.resumeReader(body, sourceState, offset, canSeek)
+			if closer != nil {
+				defer closer.Close()
+			}
+		}
+	}
+	if err == nil {
+		err = lo.Append(body, int64(f.Job.Segmenting.SegmentSize), f.segmentHeadersFor(hdr).ToOpts())
 	}
 	if err == nil {
 		err = lo.WriteManifest(hdr.ToOpts())
 	}
 	if err == nil {
-		logg.Info("PUT %s has created a Static Large Object with segments in %s/%s/",
-			object.FullName(), lo.SegmentContainer().Name(), lo.SegmentPrefix(),
+		logg.Info("PUT %s has created a %s with segments in %s/%s",
+			object.FullName(), largeObjectType(strategy), lo.SegmentContainer().Name(), lo.SegmentPrefix(),
 		)
 		return true
 	}
 
-	logg.Error("PUT %s as Static Large Object failed: %s", object.FullName(), err.Error())
+	logg.Error("PUT %s as %s failed: %s", object.FullName(), largeObjectType(strategy), err.Error())
 
-	//file was not transferred correctly - cleanup manifest and segments
+	//file was not transferred correctly - cleanup manifest (the segments that
+	//were uploaded completely are kept, so that the next run can resume the
+	//upload)
 	cleanupFailedUpload(object)
 	return false
 }
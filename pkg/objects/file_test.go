@@ -0,0 +1,890 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestTransferToMultipleTargets(t *testing.T) {
+	var sourceGETs int64
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&sourceGETs, 1)
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello world"))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  - { storage_url: %[2]s/v1/AUTH_one, auth_token: unused, container: mirror }
+  - { storage_url: %[2]s/v1/AUTH_two, auth_token: unused, container: mirror }
+  - { storage_url: %[2]s/v1/AUTH_three, auth_token: unused, container: mirror }
+`, source.URL, swift.URL)
+	job := compileTestJob(t, configYAML)
+	if len(job.Targets) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(job.Targets))
+	}
+	file := File{Job: job, Spec: FileSpec{Path: "/file.txt"}}
+
+	//the first target already has the file; the third target fails all uploads
+	swift.failPUT["/v1/AUTH_three"] = true
+	swift.objects["/v1/AUTH_one/mirror/file.txt"] = &fakeSwiftObject{
+		Contents: []byte("hello world"),
+		Headers:  http.Header{"X-Object-Meta-Source-Etag": {`"v1"`}},
+	}
+
+	results, size := file.PerformTransfer(job.Targets)
+	expected := []TransferResult{TransferSkipped, TransferSuccess, TransferFailed}
+	for idx, result := range results {
+		if result != expected[idx] {
+			t.Errorf("expected result %d for target %d, got %d", expected[idx], idx, result)
+		}
+	}
+	if size != 11 {
+		t.Errorf("expected 11 bytes transferred, got %d", size)
+	}
+	if sourceGETs != 1 {
+		t.Errorf("expected 1 GET on source, got %d", sourceGETs)
+	}
+	obj := swift.object("AUTH_two/mirror/file.txt")
+	if obj == nil || string(obj.Contents) != "hello world" {
+		t.Errorf("file was not uploaded into second target: %#v", obj)
+	}
+
+	//retry the failed target only
+	swift.failPUT["/v1/AUTH_three"] = false
+	results, _ = file.PerformTransfer(job.Targets[2:])
+	if len(results) != 1 || results[0] != TransferSuccess {
+		t.Errorf("expected retry to succeed, got %#v", results)
+	}
+
+	//when all targets are in sync, a single conditional GET suffices
+	sourceGETs = 0
+	file.Spec.Etag = ""
+	results, _ = file.PerformTransfer(job.Targets)
+	for idx, result := range results {
+		if result != TransferSkipped {
+			t.Errorf("expected target %d to be skipped, got %d", idx, result)
+		}
+	}
+	if sourceGETs != 1 {
+		t.Errorf("expected 1 GET on source, got %d", sourceGETs)
+	}
+}
+
+func TestServerSideCopy(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  storage_url: %[1]s/v1/AUTH_test
+  auth_token: unused
+  container: source
+to:
+  storage_url: %[1]s/v1/AUTH_test
+  auth_token: unused
+  container: target
+segmenting:
+  min_bytes: 8
+  segment_bytes: 8
+expiration:
+  delay_seconds: 60
+`, swift.URL)
+	job := compileTestJob(t, configYAML)
+
+	//prepare a plain object and a large object on the source side
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	swift.containers["/v1/AUTH_test/source_segments"] = true
+	swift.objects["/v1/AUTH_test/source/small.txt"] = &fakeSwiftObject{
+		Contents: []byte("hello"),
+		Headers: http.Header{
+			"Etag":            {"5d41402abc4b2a76b9719d911017c592"},
+			"Content-Type":    {"text/plain"},
+			"X-Delete-At":     {fmt.Sprintf("%d", expiresAt)},
+			"X-Object-Meta-X": {"not copied"},
+		},
+	}
+	swift.objects["/v1/AUTH_test/source_segments/large.txt/1"] = &fakeSwiftObject{Contents: []byte("hello "), Headers: http.Header{"Etag": {"seg1"}}}
+	swift.objects["/v1/AUTH_test/source_segments/large.txt/2"] = &fakeSwiftObject{Contents: []byte("world"), Headers: http.Header{"Etag": {"seg2"}}}
+	swift.objects["/v1/AUTH_test/source/large.txt"] = &fakeSwiftObject{
+		Contents: []byte(`[{"path":"/source_segments/large.txt/1","size_bytes":6,"etag":"seg1"},{"path":"/source_segments/large.txt/2","size_bytes":5,"etag":"seg2"}]`),
+		Headers:  http.Header{"Etag": {`"slo"`}, "X-Static-Large-Object": {"True"}},
+	}
+
+	for _, path := range []string{"/small.txt", "/large.txt"} {
+		file := File{Job: job, Spec: FileSpec{Path: path}}
+		results, _ := file.PerformTransfer(job.Targets)
+		if results[0] != TransferSuccess {
+			t.Errorf("expected transfer of %s to succeed, got %d", path, results[0])
+		}
+		//second transfer is skipped since the source has not changed
+		results, _ = file.PerformTransfer(job.Targets)
+		if results[0] != TransferSkipped {
+			t.Errorf("expected second transfer of %s to be skipped, got %d", path, results[0])
+		}
+	}
+
+	//no file contents shall have been downloaded (only manifests)
+	for _, request := range swift.requests {
+		if strings.HasPrefix(request, "GET /v1/AUTH_test/source/") && !strings.Contains(request, "multipart-manifest=get") {
+			t.Errorf("unexpected request: %s", request)
+		}
+	}
+
+	obj := swift.object("AUTH_test/target/small.txt")
+	switch {
+	case obj == nil:
+		t.Fatal("small.txt was not copied")
+	case string(obj.Contents) != "hello":
+		t.Errorf("small.txt has wrong contents: %q", string(obj.Contents))
+	case obj.Headers.Get("X-Object-Meta-X") != "":
+		t.Error("small.txt has metadata from source object")
+	case obj.Headers.Get("X-Object-Meta-Source-Etag") != "5d41402abc4b2a76b9719d911017c592":
+		t.Errorf("small.txt has wrong Source-Etag: %q", obj.Headers.Get("X-Object-Meta-Source-Etag"))
+	case obj.Headers.Get("X-Delete-At") != fmt.Sprintf("%d", expiresAt+60):
+		t.Errorf("small.txt has wrong expiry: %q", obj.Headers.Get("X-Delete-At"))
+	}
+
+	//the large object must not refer to the source's segments
+	obj = swift.object("AUTH_test/target/large.txt")
+	if obj == nil || obj.Headers.Get("X-Static-Large-Object") == "" {
+		t.Fatalf("large.txt was not copied as a large object: %#v", obj)
+	}
+	if strings.Contains(string(obj.Contents), "source_segments") {
+		t.Errorf("large.txt refers to segments of source object: %s", string(obj.Contents))
+	}
+	swift.mutex.Lock()
+	contents := swift.contentsOf("/v1/AUTH_test", obj)
+	swift.mutex.Unlock()
+	if string(contents) != "hello world" {
+		t.Errorf("large.txt has wrong contents: %q", string(contents))
+	}
+}
+
+func TestParallelSegmentUpload(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	var (
+		rangeGETs      int64
+		activeGETs     int64
+		maxActiveGETs  int64
+		maxActiveMutex sync.Mutex
+	)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&rangeGETs, 1)
+		active := atomic.AddInt64(&activeGETs, 1)
+		defer atomic.AddInt64(&activeGETs, -1)
+		maxActiveMutex.Lock()
+		if active > maxActiveGETs {
+			maxActiveGETs = active
+		}
+		maxActiveMutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+
+		w.Header().Set("Etag", `"v1"`)
+		http.ServeContent(w, r, "file.iso", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  storage_url: %[2]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+segmenting:
+  min_bytes: 32
+  segment_bytes: 16
+  parallelism: 4
+`, source.URL, swift.URL)
+	job := compileTestJob(t, configYAML)
+
+	file := File{Job: job, Spec: FileSpec{Path: "/file.iso"}}
+	results, size := file.PerformTransfer(job.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected transfer to succeed, got %d", results[0])
+	}
+	if size != int64(len(contents)) {
+		t.Errorf("expected %d bytes transferred, got %d", len(contents), size)
+	}
+
+	//one initial GET, and one range request for each of the other 6 segments
+	if rangeGETs != 7 {
+		t.Errorf("expected 7 GET requests on source, got %d", rangeGETs)
+	}
+	if maxActiveGETs < 2 {
+		t.Errorf("expected segments to be downloaded in parallel, but max. concurrency was %d", maxActiveGETs)
+	}
+
+	obj := swift.object("AUTH_test/mirror/file.iso")
+	if obj == nil || obj.Headers.Get("X-Static-Large-Object") == "" {
+		t.Fatalf("file.iso was not uploaded as a large object: %#v", obj)
+	}
+	swift.mutex.Lock()
+	uploaded := swift.contentsOf("/v1/AUTH_test", obj)
+	swift.mutex.Unlock()
+	if !bytes.Equal(uploaded, contents) {
+		t.Errorf("file.iso has wrong contents: %q", string(uploaded))
+	}
+}
+
+func TestResumeLargeObjectUpload(t *testing.T) {
+	for _, parallelism := range []int{1, 4} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			testResumeLargeObjectUpload(t, parallelism)
+		})
+	}
+}
+
+func testResumeLargeObjectUpload(t *testing.T, parallelism int) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	var (
+		ranges      []string
+		rangesMutex sync.Mutex
+	)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		rangesMutex.Unlock()
+		w.Header().Set("Etag", `"v2"`)
+		http.ServeContent(w, r, "file.iso", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+  segmenting: false
+to:
+  storage_url: %[2]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+segmenting:
+  min_bytes: 32
+  segment_bytes: 16
+  parallelism: %[3]d
+`, source.URL, swift.URL, parallelism)
+	job := compileTestJob(t, configYAML)
+
+	//an interrupted upload of the current version left three complete segments
+	//and one incomplete segment; an interrupted upload of an older version also
+	//left a segment
+	addSegment := func(name string, segmentContents []byte, sourceEtag string) {
+		hash := md5.Sum(segmentContents)
+		swift.objects["/v1/AUTH_test/mirror_segments/file.iso/slo/"+name] = &fakeSwiftObject{
+			Contents: segmentContents,
+			Headers: http.Header{
+				"Etag":                      {hex.EncodeToString(hash[:])},
+				"X-Object-Meta-Source-Etag": {sourceEtag},
+			},
+		}
+	}
+	addSegment("1600000000.000000000/100/16/0000000000000001", []byte("0123456789012345"), `"v2"`)
+	addSegment("1600000000.000000000/100/16/0000000000000002", []byte("6789012345678901"), `"v2"`)
+	addSegment("1600000000.000000000/100/16/0000000000000003", []byte("2345678901234567"), `"v2"`)
+	addSegment("1600000000.000000000/100/16/0000000000000004", []byte("89"), `"v2"`)
+	addSegment("1500000000.000000000/100/16/0000000000000001", []byte("abcdefghijklmnop"), `"v1"`)
+
+	file := File{Job: job, Spec: FileSpec{Path: "/file.iso"}}
+	results, _ := file.PerformTransfer(job.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected transfer to succeed, got %d", results[0])
+	}
+
+	//the remainder of the file is downloaded with a range request
+	expectedRanges := map[string]bool{"bytes=48-99": true}
+	if parallelism > 1 {
+		expectedRanges = map[string]bool{"bytes=48-63": true, "bytes=64-79": true, "bytes=80-95": true, "bytes=96-99": true}
+	}
+	for _, r := range ranges[1:] {
+		if !expectedRanges[r] {
+			t.Errorf("unexpected range request on source: %q", r)
+		}
+	}
+	if len(ranges) != len(expectedRanges)+1 {
+		t.Errorf("expected %d requests on source, got %#v", len(expectedRanges)+1, ranges)
+	}
+
+	obj := swift.object("AUTH_test/mirror/file.iso")
+	if obj == nil || obj.Headers.Get("X-Static-Large-Object") == "" {
+		t.Fatalf("file.iso was not uploaded as a large object: %#v", obj)
+	}
+	if !strings.Contains(string(obj.Contents), "/mirror_segments/file.iso/slo/1600000000.000000000/100/16/0000000000000001") {
+		t.Errorf("expected manifest to reuse existing segments, got %s", string(obj.Contents))
+	}
+	swift.mutex.Lock()
+	uploaded := swift.contentsOf("/v1/AUTH_test", obj)
+	swift.mutex.Unlock()
+	if !bytes.Equal(uploaded, contents) {
+		t.Errorf("file.iso has wrong contents: %q", string(uploaded))
+	}
+	if swift.object("AUTH_test/mirror_segments/file.iso/slo/1500000000.000000000/100/16/0000000000000001") != nil {
+		t.Error("expected stale segment to be deleted")
+	}
+}
+
+func TestDeltaUpdateOfLargeObject(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	etag := `"v1"`
+	var ranges []string
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Etag", etag)
+		http.ServeContent(w, r, "disk.img", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+  segmenting: false
+to:
+  storage_url: %[2]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+segmenting:
+  min_bytes: 32
+  segment_bytes: 16
+  delta_updates: true
+`, source.URL, swift.URL)
+	job := compileTestJob(t, configYAML)
+	file := File{Job: job, Spec: FileSpec{Path: "/disk.img"}}
+
+	expectTransfer := func(expectedRanges []string, expectedSegmentPUTs int) {
+		t.Helper()
+		ranges = nil
+		swift.requests = nil
+		results, _ := file.PerformTransfer(job.Targets)
+		if results[0] != TransferSuccess {
+			t.Fatalf("expected transfer to succeed, got %d", results[0])
+		}
+		if fmt.Sprintf("%q", ranges) != fmt.Sprintf("%q", expectedRanges) {
+			t.Errorf("expected requests with ranges %q on source, got %q", expectedRanges, ranges)
+		}
+		segmentPUTs := 0
+		for _, request := range swift.requests {
+			if strings.HasPrefix(request, "PUT /v1/AUTH_test/mirror_segments/") {
+				segmentPUTs++
+			}
+		}
+		if segmentPUTs != expectedSegmentPUTs {
+			t.Errorf("expected %d segments to be uploaded, got %d", expectedSegmentPUTs, segmentPUTs)
+		}
+
+		obj := swift.object("AUTH_test/mirror/disk.img")
+		if obj == nil || obj.Headers.Get("X-Static-Large-Object") == "" {
+			t.Fatalf("disk.img was not uploaded as a large object: %#v", obj)
+		}
+		swift.mutex.Lock()
+		uploaded := swift.contentsOf("/v1/AUTH_test", obj)
+		swift.mutex.Unlock()
+		if !bytes.Equal(uploaded, contents) {
+			t.Errorf("disk.img has wrong contents: %q", string(uploaded))
+		}
+	}
+
+	//initial upload
+	expectTransfer([]string{""}, 7)
+
+	//change one segment in the middle: only that segment is uploaded
+	contents = append([]byte(nil), contents...)
+	contents[40] = 'X'
+	etag = `"v2"`
+	expectTransfer([]string{"", "bytes=32-47"}, 1)
+
+	//append to the file: only the last segment has changed (this also checks
+	//the segment that was uploaded by the previous delta update)
+	contents = append(contents, []byte("abc")...)
+	etag = `"v3"`
+	expectTransfer([]string{"", "bytes=96-102"}, 1)
+
+	//old segments that are not referenced anymore were deleted
+	segmentCount := 0
+	for path := range swift.objects {
+		if strings.HasPrefix(path, "/v1/AUTH_test/mirror_segments/") {
+			segmentCount++
+		}
+	}
+	if segmentCount != 7 {
+		t.Errorf("expected 7 segments to remain, got %d", segmentCount)
+	}
+}
+
+func TestLargeObjectStrategy(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		http.ServeContent(w, r, "file.iso", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	//each account caches the capabilities of the cluster, so each cluster
+	//configuration needs its own account
+	account := "AUTH_test"
+	compile := func(segmentingYAML string) (*Job, []error) {
+		t.Helper()
+		configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+  segmenting: false
+to:
+  storage_url: %[2]s/v1/%[3]s
+  auth_token: unused
+  container: mirror
+segmenting:
+  min_bytes: 32
+%[4]s`, source.URL, swift.URL, account, segmentingYAML)
+		var cfg JobConfiguration
+		err := yaml.Unmarshal([]byte(configYAML), &cfg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return cfg.Compile("jobs[0]", SwiftLocation{})
+	}
+	expectCompileError := func(segmentingYAML, expectedMessage string) {
+		t.Helper()
+		_, errs := compile(segmentingYAML)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), expectedMessage) {
+			t.Errorf("expected error containing %q, got %v", expectedMessage, errs)
+		}
+	}
+	expectUpload := func(segmentingYAML, path, expectedHeader string) *fakeSwiftObject {
+		t.Helper()
+		job, errs := compile(segmentingYAML)
+		if len(errs) > 0 {
+			t.Fatal(errs[0].Error())
+		}
+		file := File{Job: job, Spec: FileSpec{Path: "/" + path}}
+		results, _ := file.PerformTransfer(job.Targets)
+		if results[0] != TransferSuccess {
+			t.Fatalf("expected transfer of %s to succeed, got %d", path, results[0])
+		}
+		obj := swift.object(account + "/mirror/" + path)
+		if obj == nil || obj.Headers.Get(expectedHeader) == "" {
+			t.Fatalf("%s was not uploaded with %s: %#v", path, expectedHeader, obj)
+		}
+		swift.mutex.Lock()
+		uploaded := swift.contentsOf("/v1/"+account, obj)
+		swift.mutex.Unlock()
+		if !bytes.Equal(uploaded, contents) {
+			t.Errorf("%s has wrong contents: %q", path, string(uploaded))
+		}
+		return obj
+	}
+
+	//invalid configurations are rejected early
+	expectCompileError("  segment_bytes: 16\n  strategy: foo\n", "invalid value for jobs[0].segmenting.strategy")
+	expectCompileError("  segment_bytes: 16\n  segment_prefix: \"segments/{timestamp}/\"\n", "must start with {object}/")
+	expectCompileError("  segment_bytes: 16\n  segment_prefix: \"{object}/{uuid}/\"\n", "unknown placeholder {uuid}")
+	expectCompileError("  segment_bytes: 16\n  storage_policy: gold\n", `does not have a storage policy named "gold"`)
+
+	//segments are named after the template and stored with the requested storage policy
+	expectUpload("  segment_bytes: 16\n  segment_prefix: \"{object}/segments/{timestamp}/\"\n  storage_policy: cold\n", "a.iso", "X-Static-Large-Object")
+	if policy := swift.policies["/v1/AUTH_test/mirror_segments"]; policy != "cold" {
+		t.Errorf("expected segment container to have storage policy %q, got %q", "cold", policy)
+	}
+	segmentRx := regexp.MustCompile(`^/v1/AUTH_test/mirror_segments/a\.iso/segments/[0-9]+\.[0-9]{9}/[0-9]{16}$`)
+	for path := range swift.objects {
+		if strings.HasPrefix(path, "/v1/AUTH_test/mirror_segments/a.iso/") && !segmentRx.MatchString(path) {
+			t.Errorf("unexpected segment name: %s", path)
+		}
+	}
+	expectCompileError("  segment_bytes: 16\n  storage_policy: archive\n", "container already exists with a different storage policy")
+
+	//when an SLO manifest would have too many segments, DLO is used instead
+	swift.capabilities = `{"swift":{"version":"2.25.0"},"slo":{"max_manifest_segments":4}}`
+	account = "AUTH_limited"
+	expectUpload("  segment_bytes: 32\n", "b.iso", "X-Static-Large-Object")
+	obj := expectUpload("  segment_bytes: 16\n", "c.iso", "X-Object-Manifest")
+	if !strings.HasPrefix(obj.Headers.Get("X-Object-Manifest"), "mirror_segments/c.iso/dlo/") {
+		t.Errorf("unexpected DLO manifest: %q", obj.Headers.Get("X-Object-Manifest"))
+	}
+
+	//on clusters without SLO support, DLO is used unless SLO is requested explicitly
+	swift.capabilities = `{"swift":{"version":"2.25.0"}}`
+	account = "AUTH_legacy"
+	expectUpload("  segment_bytes: 16\n", "d.iso", "X-Object-Manifest")
+	expectCompileError("  segment_bytes: 16\n  strategy: slo\n", "does not support Static Large Objects")
+}
+
+func TestBulkUpload(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + r.URL.Path + `"`
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.URL.Path == "/big.txt" {
+			w.Write(bytes.Repeat([]byte("x"), 200))
+			return
+		}
+		w.Write([]byte("contents of " + r.URL.Path))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	compile := func(account string) *Job {
+		t.Helper()
+		configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  storage_url: %[2]s/v1/%[3]s
+  auth_token: unused
+  container: mirror
+bulk_upload:
+  max_file_bytes: 64
+  batch_size: 2
+`, source.URL, swift.URL, account)
+		return compileTestJob(t, configYAML)
+	}
+	countRequests := func(prefix string) int {
+		swift.mutex.Lock()
+		defer swift.mutex.Unlock()
+		count := 0
+		for _, req := range swift.requests {
+			if strings.HasPrefix(req, prefix) {
+				count++
+			}
+		}
+		return count
+	}
+
+	var (
+		bulk    BulkUploader
+		results = make(map[string]TransferResult)
+	)
+	transfer := func(job *Job, path string) {
+		t.Helper()
+		file := File{Job: job, Spec: FileSpec{Path: "/" + path}}
+		bulk.Transfer(file, job.Targets, func(r []TransferResult, size int64) {
+			results[path] = r[0]
+		})
+	}
+	expectResults := func(expected map[string]TransferResult) {
+		t.Helper()
+		for path, result := range expected {
+			if actual, ok := results[path]; !ok {
+				t.Errorf("expected transfer of %s to be complete", path)
+			} else if actual != result {
+				t.Errorf("expected result %d for %s, got %d", result, path, actual)
+			}
+		}
+		for path := range results {
+			if _, ok := expected[path]; !ok {
+				t.Errorf("did not expect transfer of %s to be complete yet", path)
+			}
+		}
+		results = make(map[string]TransferResult)
+	}
+	expectObject := func(account, path string) {
+		t.Helper()
+		obj := swift.object(account + "/mirror/" + path)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", path)
+			return
+		}
+		if etag := obj.Headers.Get("X-Object-Meta-Source-Etag"); etag != `"/`+path+`"` {
+			t.Errorf("%s has wrong Source-Etag: %q", path, etag)
+		}
+		if obj.Headers.Get("Content-Type") == "" {
+			t.Errorf("%s has no Content-Type", path)
+		}
+	}
+
+	//small files are collected until a batch is full
+	job := compile("AUTH_test")
+	extractPrefix := "PUT /v1/AUTH_test/mirror/?extract-archive=tar"
+	transfer(job, "a.txt")
+	expectResults(nil)
+	transfer(job, "b.txt")
+	expectResults(map[string]TransferResult{"a.txt": TransferSuccess, "b.txt": TransferSuccess})
+	if count := countRequests(extractPrefix); count != 1 {
+		t.Errorf("expected 1 bulk upload, got %d", count)
+	}
+	expectObject("AUTH_test", "a.txt")
+	expectObject("AUTH_test", "b.txt")
+
+	//large files are uploaded individually
+	transfer(job, "big.txt")
+	expectResults(map[string]TransferResult{"big.txt": TransferSuccess})
+	if count := countRequests("PUT /v1/AUTH_test/mirror/big.txt"); count != 1 {
+		t.Errorf("expected big.txt to be uploaded individually, got %d PUTs", count)
+	}
+
+	//files that the bulk middleware rejects are uploaded individually
+	swift.failBulkUpload["/v1/AUTH_test/mirror/c.txt"] = true
+	transfer(job, "c.txt")
+	transfer(job, "d.txt")
+	expectResults(map[string]TransferResult{"c.txt": TransferSuccess, "d.txt": TransferSuccess})
+	if count := countRequests("PUT /v1/AUTH_test/mirror/c.txt"); count != 1 {
+		t.Errorf("expected c.txt to be uploaded individually, got %d PUTs", count)
+	}
+	if count := countRequests("PUT /v1/AUTH_test/mirror/d.txt"); count != 0 {
+		t.Errorf("expected d.txt to be uploaded in bulk, got %d PUTs", count)
+	}
+	expectObject("AUTH_test", "c.txt")
+	expectObject("AUTH_test", "d.txt")
+
+	//incomplete batches are uploaded by Flush()
+	transfer(job, "e.txt")
+	expectResults(nil)
+	bulk.Flush()
+	expectResults(map[string]TransferResult{"e.txt": TransferSuccess})
+	expectObject("AUTH_test", "e.txt")
+	if count := countRequests(extractPrefix); count != 3 {
+		t.Errorf("expected 3 bulk uploads, got %d", count)
+	}
+
+	//unchanged files are skipped as usual
+	transfer(job, "a.txt")
+	expectResults(map[string]TransferResult{"a.txt": TransferSkipped})
+
+	//when the bulk middleware does not retain metadata, files are uploaded individually
+	swift.ignorePAXHeaders = true
+	job = compile("AUTH_old")
+	transfer(job, "a.txt")
+	transfer(job, "b.txt")
+	expectResults(map[string]TransferResult{"a.txt": TransferSuccess, "b.txt": TransferSuccess})
+	transfer(job, "c.txt")
+	expectResults(map[string]TransferResult{"c.txt": TransferSuccess})
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		expectObject("AUTH_old", path)
+		if count := countRequests("PUT /v1/AUTH_old/mirror/" + path); count != 1 {
+			t.Errorf("expected %s to be uploaded individually, got %d PUTs", path, count)
+		}
+	}
+	if count := countRequests("PUT /v1/AUTH_old/mirror/?extract-archive=tar"); count != 1 {
+		t.Errorf("expected 1 bulk upload, got %d", count)
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	var (
+		mutex      sync.Mutex
+		sourceGETs = make(map[string]int)
+	)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		sourceGETs[r.URL.Path]++
+		mutex.Unlock()
+		w.Write([]byte("duplicate contents"))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	compile := func(account, method string, extraYAML ...string) *Job {
+		t.Helper()
+		configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  storage_url: %[2]s/v1/%[3]s
+  auth_token: unused
+  container: mirror
+deduplication:
+  method: %[4]s
+%[5]s`, source.URL, swift.URL, account, method, strings.Join(extraYAML, "\n"))
+		return compileTestJob(t, configYAML)
+	}
+	sha256Hash := sha256.Sum256([]byte("duplicate contents"))
+	sha256Sum := Checksum{Algorithm: "sha256", Digest: sha256Hash[:]}
+	transfer := func(job *Job, path string, checksum *Checksum, expectedResult TransferResult, expectedGETs int) {
+		t.Helper()
+		mutex.Lock()
+		sourceGETs[path] = 0
+		mutex.Unlock()
+		file := File{Job: job, Spec: FileSpec{Path: path, Checksum: checksum}}
+		results, _ := file.PerformTransfer(job.Targets)
+		if results[0] != expectedResult {
+			t.Errorf("expected result %d for %s, got %d", expectedResult, path, results[0])
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if sourceGETs[path] != expectedGETs {
+			t.Errorf("expected %d GETs for %s, got %d", expectedGETs, path, sourceGETs[path])
+		}
+	}
+	expectContents := func(account, path string) *fakeSwiftObject {
+		t.Helper()
+		obj := swift.object(account + "/mirror" + path)
+		if obj == nil {
+			t.Fatalf("%s was not uploaded", path)
+		}
+		swift.mutex.Lock()
+		contents := swift.contentsOf("/v1/"+account, obj)
+		swift.mutex.Unlock()
+		if string(contents) != "duplicate contents" {
+			t.Errorf("%s has wrong contents: %q", path, string(contents))
+		}
+		return obj
+	}
+
+	//the first file is downloaded, the duplicate is copied on the server side
+	job := compile("AUTH_test", "copy")
+	transfer(job, "/a.bin", &sha256Sum, TransferSuccess, 1)
+	transfer(job, "/b.bin", &sha256Sum, TransferSuccess, 0)
+	obj := expectContents("AUTH_test", "/b.bin")
+	if checksum := obj.Headers.Get("X-Object-Meta-Source-Checksum"); checksum != sha256Sum.String() {
+		t.Errorf("expected Source-Checksum %q on /b.bin, got %q", sha256Sum.String(), checksum)
+	}
+	if obj.Headers.Get("X-Symlink-Target") != "" {
+		t.Error("expected /b.bin to be a copy, but it is a symlink")
+	}
+
+	//files whose checksum matches the target are skipped without a GET
+	transfer(job, "/b.bin", &sha256Sum, TransferSkipped, 0)
+
+	//when the original objects were overwritten, the duplicate is downloaded
+	for _, path := range []string{"/v1/AUTH_test/mirror/a.bin", "/v1/AUTH_test/mirror/b.bin"} {
+		swift.objects[path] = &fakeSwiftObject{
+			Contents: []byte("other contents"),
+			Headers:  http.Header{"Etag": {"unrelated"}},
+		}
+	}
+	transfer(job, "/c.bin", &sha256Sum, TransferSuccess, 1)
+
+	//duplicates can also be uploaded as symlinks
+	job = compile("AUTH_symlink", "symlink")
+	transfer(job, "/a.bin", &sha256Sum, TransferSuccess, 1)
+	transfer(job, "/b.bin", &sha256Sum, TransferSuccess, 0)
+	obj = expectContents("AUTH_symlink", "/b.bin")
+	if target := obj.Headers.Get("X-Symlink-Target"); target != "mirror/a.bin" {
+		t.Errorf("expected /b.bin to be a symlink to mirror/a.bin, got %q", target)
+	}
+
+	//duplicates of objects from other jobs are copied instead, since the other
+	//job could delete the original object
+	otherJob := compile("AUTH_symlink", "symlink")
+	transfer(otherJob, "/c.bin", &sha256Sum, TransferSuccess, 0)
+	obj = expectContents("AUTH_symlink", "/c.bin")
+	if target := obj.Headers.Get("X-Symlink-Target"); target != "" {
+		t.Errorf("expected /c.bin to be a copy, but it is a symlink to %q", target)
+	}
+	delete(swift.objects, "/v1/AUTH_symlink/mirror/a.bin")
+	expectContents("AUTH_symlink", "/c.bin")
+
+	//same for jobs that delete objects that disappear from the source
+	job = compile("AUTH_symlinkcleanup", "symlink", "cleanup:", "  strategy: delete")
+	transfer(job, "/a.bin", &sha256Sum, TransferSuccess, 1)
+	transfer(job, "/b.bin", &sha256Sum, TransferSuccess, 0)
+	obj = expectContents("AUTH_symlinkcleanup", "/b.bin")
+	if target := obj.Headers.Get("X-Symlink-Target"); target != "" {
+		t.Errorf("expected /b.bin to be a copy, but it is a symlink to %q", target)
+	}
+	delete(swift.objects, "/v1/AUTH_symlinkcleanup/mirror/a.bin")
+	expectContents("AUTH_symlinkcleanup", "/b.bin")
+
+	//objects that already exist on the target are found by their Etag
+	contentsHash := md5.Sum([]byte("duplicate contents"))
+	swift.containers["/v1/AUTH_existing/mirror"] = true
+	swift.objects["/v1/AUTH_existing/mirror/a.bin"] = &fakeSwiftObject{
+		Contents: []byte("duplicate contents"),
+		Headers:  http.Header{"Etag": {hex.EncodeToString(contentsHash[:])}},
+	}
+	md5Sum := Checksum{Algorithm: "md5", Digest: contentsHash[:]}
+	job = compile("AUTH_existing", "copy")
+	transfer(job, "/a.bin", nil, TransferSuccess, 1)
+	transfer(job, "/b.bin", &md5Sum, TransferSuccess, 0)
+	expectContents("AUTH_existing", "/b.bin")
+}
+
+func TestMatchesTargetState(t *testing.T) {
+	hdr := schwift.NewObjectHeaders()
+	hdr.SizeBytes().Set(42)
+	hdr.Metadata().Set("Source-Last-Modified", "Mon, 12 Oct 2020 10:00:30 GMT")
+
+	size := int64(42)
+	testCases := []struct {
+		LastModified string
+		Precision    time.Duration
+		Expected     bool
+	}{
+		{"2020-10-12T10:00:30Z", 0, true},
+		{"2020-10-12T10:00:45Z", 0, false},
+		{"2020-10-12T10:00:00Z", 0, false},
+		//HTML listings without seconds are compared with minute precision
+		{"2020-10-12T10:00:00Z", time.Minute, true},
+		{"2020-10-12T10:01:00Z", time.Minute, false},
+	}
+	for _, tc := range testCases {
+		mtime, err := time.Parse(time.RFC3339, tc.LastModified)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		spec := FileSpec{Path: "/file.txt", LastModified: &mtime, SizeBytes: &size, LastModifiedPrecision: tc.Precision}
+		actual := spec.matchesTargetState(hdr)
+		if actual != tc.Expected {
+			t.Errorf("expected matchesTargetState = %t for listed mtime %s (precision %s), got %t", tc.Expected, tc.LastModified, tc.Precision, actual)
+		}
+	}
+
+	//same for a file from an actual nginx listing (which shows "12-Oct-2020 10:00")
+	uri, _ := url.Parse("http://example.com/files/")
+	hdr.SizeBytes().Set(44040192)
+	specs := parseHTMLListing(strings.NewReader(nginxListing), uri, "/", time.UTC)
+	if len(specs) != 2 || specs[1].Path != "/foo.tar.gz" || !specs[1].matchesTargetState(hdr) {
+		t.Errorf("expected /foo.tar.gz from nginx listing to match target state, got %#v", specs)
+	}
+}
@@ -0,0 +1,390 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+)
+
+//FTPSource is a source that's accessible via FTP or FTPS (i.e. FTP with
+//explicit TLS).
+type FTPSource struct {
+	//options from config file
+	URLString                string       `yaml:"url"`
+	Password                 AuthPassword `yaml:"password"`
+	TLS                      bool         `yaml:"tls"`
+	ClientCertificatePath    string       `yaml:"cert"`
+	ClientCertificateKeyPath string       `yaml:"key"`
+	ServerCAPath             string       `yaml:"ca"`
+	//compiled configuration
+	url       *url.URL    `yaml:"-"`
+	userName  string      `yaml:"-"`
+	tlsConfig *tls.Config `yaml:"-"`
+	//FTP connections cannot be used by multiple transfer workers at the same
+	//time, so we keep a pool of idle connections
+	idleConns      []*ftp.ServerConn `yaml:"-"`
+	idleConnsMutex sync.Mutex        `yaml:"-"`
+	//entries is filled by ListAllFiles() and used by GetFile()
+	entries map[string]*ftp.Entry `yaml:"-"`
+}
+
+//Validate implements the Source interface.
+func (s *FTPSource) Validate(name string) (result []error) {
+	var err error
+	s.url, err = url.Parse(s.URLString)
+	if err != nil {
+		return []error{fmt.Errorf("invalid value for %s.url: %s", name, err.Error())}
+	}
+	if s.url.Scheme != "ftp" || s.url.Host == "" {
+		result = append(result, fmt.Errorf(`invalid value for %s.url: expected "ftp://host/path/", got %q`, name, s.URLString))
+	}
+	if _, hasPassword := s.url.User.Password(); hasPassword {
+		result = append(result, fmt.Errorf("invalid value for %s.url: password must be given in %s.password instead", name, name))
+	}
+	if s.url.Port() == "" {
+		s.url.Host = net.JoinHostPort(s.url.Hostname(), "21")
+	}
+	if !strings.HasSuffix(s.url.Path, "/") {
+		s.url.Path += "/"
+	}
+
+	s.userName = s.url.User.Username()
+	if s.userName == "" {
+		s.userName = "anonymous"
+		if s.Password == "" {
+			s.Password = "anonymous"
+		}
+	}
+
+	if s.ClientCertificatePath != "" || s.ClientCertificateKeyPath != "" {
+		if s.ClientCertificatePath == "" {
+			result = append(result, fmt.Errorf("missing value for %s.cert", name))
+		}
+		if s.ClientCertificateKeyPath == "" {
+			result = append(result, fmt.Errorf("missing value for %s.key", name))
+		}
+	}
+	if !s.TLS && (s.ClientCertificatePath != "" || s.ServerCAPath != "") {
+		result = append(result, fmt.Errorf("invalid value for %s.tls: must be true when %s.cert or %s.ca is given", name, name, name))
+	}
+
+	return
+}
+
+//Connect implements the Source interface.
+func (s *FTPSource) Connect(name string) error {
+	if s.TLS {
+		var err error
+		s.tlsConfig, err = loadTLSConfig(s.ClientCertificatePath, s.ClientCertificateKeyPath, s.ServerCAPath)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig.ServerName = s.url.Hostname()
+	}
+
+	//check that the connection works
+	conn, err := s.getConn()
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", s.url.Host, err.Error())
+	}
+	s.putConn(conn)
+	return nil
+}
+
+//Takes an idle connection from the pool, or establishes a new connection.
+//The connection must be returned with putConn() or discarded with dropConn().
+func (s *FTPSource) getConn() (*ftp.ServerConn, error) {
+	s.idleConnsMutex.Lock()
+	if count := len(s.idleConns); count > 0 {
+		conn := s.idleConns[count-1]
+		s.idleConns = s.idleConns[:count-1]
+		s.idleConnsMutex.Unlock()
+		//check that the connection is still alive
+		if conn.NoOp() == nil {
+			return conn, nil
+		}
+		s.dropConn(conn)
+	} else {
+		s.idleConnsMutex.Unlock()
+	}
+
+	logg.Debug("connecting to %s", s.url.Host)
+	options := []ftp.DialOption{ftp.DialWithTimeout(time.Minute)}
+	if s.tlsConfig != nil {
+		options = append(options, ftp.DialWithExplicitTLS(s.tlsConfig))
+	}
+	conn, err := ftp.Dial(s.url.Host, options...)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Login(s.userName, string(s.Password))
+	if err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//Returns a connection that was obtained from getConn() to the pool.
+func (s *FTPSource) putConn(conn *ftp.ServerConn) {
+	s.idleConnsMutex.Lock()
+	defer s.idleConnsMutex.Unlock()
+	s.idleConns = append(s.idleConns, conn)
+}
+
+//Discards a connection that was obtained from getConn() after an error.
+func (s *FTPSource) dropConn(conn *ftp.ServerConn) {
+	err := conn.Quit()
+	if err != nil {
+		logg.Debug("error while closing connection to %s: %s", s.url.Host, err.Error())
+	}
+}
+
+//Returns whether the given error is an error response from the FTP server (as
+//opposed to a connection error).
+func isFTPErrorResponse(err error) bool {
+	_, ok := err.(*textproto.Error)
+	return ok
+}
+
+//ListEntries implements the Source interface.
+func (s *FTPSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	return nil, &ListEntriesError{
+		Location: s.url.String(),
+		Message:  "ListEntries is not implemented for FTPSource",
+	}
+}
+
+//ListAllFiles implements the Source interface.
+func (s *FTPSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, &ListEntriesError{s.url.String(), "cannot connect", err}
+	}
+
+	logg.Debug("listing files at %s recursively", s.url.String())
+	var result []FileSpec
+	entries := make(map[string]*ftp.Entry)
+	directories := []string{"/"}
+	for len(directories) > 0 {
+		directoryPath := directories[len(directories)-1]
+		directories = directories[:len(directories)-1]
+
+		//this uses MLSD if the server supports it, and falls back to LIST otherwise
+		listing, err := conn.List(path.Join(s.url.Path, directoryPath))
+		if err != nil {
+			if isFTPErrorResponse(err) {
+				s.putConn(conn)
+			} else {
+				s.dropConn(conn)
+			}
+			location := s.url.ResolveReference(&url.URL{Path: strings.TrimPrefix(directoryPath, "/")}).String()
+			return nil, &ListEntriesError{location, "cannot list directory", err}
+		}
+
+		for _, entry := range listing {
+			if entry.Name == "." || entry.Name == ".." || strings.Contains(entry.Name, "/") {
+				continue
+			}
+			entryPath := path.Join(directoryPath, entry.Name)
+			switch entry.Type {
+			case ftp.EntryTypeFolder:
+				directories = append(directories, entryPath)
+			case ftp.EntryTypeFile:
+				entries[entryPath] = entry
+				spec := FileSpec{Path: entryPath}
+				if !entry.Time.IsZero() {
+					mtime := entry.Time.UTC()
+					spec.LastModified = &mtime
+				}
+				size := int64(entry.Size)
+				spec.SizeBytes = &size
+				result = append(result, spec)
+			default:
+				//symlinks are only reported by LIST, and we cannot tell whether they
+				//point to files or directories
+				logg.Debug("ignoring symlink %s", entryPath)
+			}
+		}
+	}
+
+	s.putConn(conn)
+	s.entries = entries
+	return result, nil
+}
+
+//GetFile implements the Source interface.
+func (s *FTPSource) GetFile(relPath string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	serverPath := path.Join(s.url.Path, relPath)
+	reader := &ftpFileReader{Source: s, Path: serverPath, Size: -1}
+	sourceState := FileState{
+		SizeBytes:  -1,
+		ExpiryTime: nil, //no way to get this information via FTP
+	}
+
+	//FTP has no cheap way to get the mtime of a single file (MDTM is not
+	//supported everywhere), so we use what the listing told us
+	if entry, exists := s.entries[relPath]; exists {
+		if !entry.Time.IsZero() {
+			sourceState.LastModified = entry.Time.UTC().Format(http.TimeFormat)
+
+			//emulate the semantics of a conditional GET
+			if val := requestHeaders.Get("If-Modified-Since"); val != "" {
+				ifModifiedSince, err := http.ParseTime(val)
+				if err == nil && !entry.Time.Truncate(time.Second).After(ifModifiedSince) {
+					sourceState.SkipTransfer = true
+					return nil, sourceState, nil
+				}
+			}
+		}
+	}
+
+	err := reader.open()
+	if err != nil {
+		return nil, FileState{}, fmt.Errorf("skipping %s: %s", serverPath, err.Error())
+	}
+	sourceState.SizeBytes = reader.Size
+	return reader, sourceState, nil
+}
+
+//ftpFileReader is an io.ReadCloser that downloads a file via FTP. When the
+//connection breaks, the download is resumed at the same offset (using the REST
+//command) on a new connection, as long as the file size does not change in the
+//meantime.
+type ftpFileReader struct {
+	Source *FTPSource
+	Path   string
+	Size   int64 //-1 if not known
+	//this object's internal state
+	started   bool
+	conn      *ftp.ServerConn
+	response  *ftp.Response
+	bytesRead int64
+	retries   util.ReadRetryCounter
+}
+
+//Starts the download (again) at the current offset.
+func (r *ftpFileReader) open() error {
+	conn, err := r.Source.getConn()
+	if err != nil {
+		return err
+	}
+
+	//the SIZE command is not strictly required by the standard, so we can do
+	//without it if necessary
+	size, err := conn.FileSize(r.Path)
+	if err != nil {
+		if !isFTPErrorResponse(err) {
+			r.Source.dropConn(conn)
+			return err
+		}
+		size = -1
+	}
+	if !r.started {
+		r.Size = size
+		r.started = true
+	} else if r.Size != size {
+		r.Source.putConn(conn)
+		return fmt.Errorf("file size has changed mid-transfer: %d -> %d", r.Size, size)
+	}
+
+	response, err := conn.RetrFrom(r.Path, uint64(r.bytesRead))
+	if err != nil {
+		if isFTPErrorResponse(err) {
+			r.Source.putConn(conn)
+		} else {
+			r.Source.dropConn(conn)
+		}
+		return err
+	}
+	r.conn = conn
+	r.response = response
+	return nil
+}
+
+//Read implements the io.Reader interface.
+func (r *ftpFileReader) Read(buf []byte) (int, error) {
+	if r.response == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.response.Read(buf)
+	r.bytesRead += int64(n)
+	if err == io.EOF {
+		if r.Size >= 0 && r.bytesRead < r.Size {
+			err = fmt.Errorf("connection closed after %d of %d bytes", r.bytesRead, r.Size)
+		} else {
+			return n, io.EOF
+		}
+	}
+	if err != nil {
+		if !r.retries.ShouldRetry("FTP download of "+r.Path, r.bytesRead) {
+			return n, err
+		}
+		logg.Error("restarting FTP download of %s after read error at offset %d: %s",
+			r.Path, r.bytesRead, err.Error(),
+		)
+		//close the control connection first, so that closing the data
+		//connection does not wait for a response from the server
+		r.Source.dropConn(r.conn)
+		r.response.Close()
+		r.response = nil
+		r.conn = nil
+		//the next Read() will reconnect
+		return n, nil
+	}
+	return n, nil
+}
+
+//Close implements the io.Closer interface.
+func (r *ftpFileReader) Close() error {
+	if r.response == nil {
+		return nil
+	}
+	//this also reads the server's response to the completed transfer, so the
+	//connection can be reused afterwards
+	err := r.response.Close()
+	if err == nil {
+		r.Source.putConn(r.conn)
+	} else {
+		r.Source.dropConn(r.conn)
+	}
+	r.response = nil
+	r.conn = nil
+	return err
+}
@@ -0,0 +1,443 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+//fakeFTPServer is an in-process FTP server that serves files from memory. It
+//only implements the commands that are used by package
+//github.com/jlaffaye/ftp, and only passive mode data connections via EPSV.
+type fakeFTPServer struct {
+	Listener net.Listener
+	//if false, the server does not advertise MLST and rejects MLSD, so that
+	//the client has to fall back to LIST
+	SupportsMLSD bool
+	mutex        sync.Mutex
+	files        map[string]*fakeFTPFile //key = absolute path
+	dirs         map[string]bool
+	links        map[string]string //key = absolute path, value = link target
+	//RETR of these files drops the data connection once when reaching the
+	//given offset
+	dropDataAt map[string]int64
+	//all commands received so far, in order
+	commands []string
+}
+
+type fakeFTPFile struct {
+	Contents []byte
+	ModTime  time.Time
+}
+
+func newFakeFTPServer(t *testing.T, supportsMLSD bool) *fakeFTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &fakeFTPServer{
+		Listener:     listener,
+		SupportsMLSD: supportsMLSD,
+		files:        make(map[string]*fakeFTPFile),
+		dirs:         map[string]bool{"/": true},
+		links:        make(map[string]string),
+		dropDataAt:   make(map[string]int64),
+	}
+	go s.acceptConnections()
+	return s
+}
+
+func (s *fakeFTPServer) Close() {
+	s.Listener.Close()
+}
+
+//Adds a file (and its parent directories) to the server.
+func (s *fakeFTPServer) addFile(filePath, contents string, mtime time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[filePath] = &fakeFTPFile{Contents: []byte(contents), ModTime: mtime}
+	for dir := path.Dir(filePath); dir != "/"; dir = path.Dir(dir) {
+		s.dirs[dir] = true
+	}
+}
+
+//Returns whether a command starting with the given prefix was received.
+func (s *fakeFTPServer) hasReceived(prefix string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeFTPServer) acceptConnections() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConnection(conn)
+	}
+}
+
+func (s *fakeFTPServer) serveConnection(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 fake FTP server ready")
+
+	var dataListener net.Listener
+	var restOffset int64
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, line)
+		s.mutex.Unlock()
+
+		fields := strings.SplitN(line, " ", 2)
+		command, arg := strings.ToUpper(fields[0]), ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+
+		switch command {
+		case "FEAT":
+			if s.SupportsMLSD {
+				tc.PrintfLine("211-Features:\r\n MLST type*;size*;modify*;\r\n SIZE\r\n211 End")
+			} else {
+				tc.PrintfLine("211-Features:\r\n SIZE\r\n211 End")
+			}
+		case "USER":
+			tc.PrintfLine("331 password required")
+		case "PASS":
+			if arg == "anonymous" {
+				tc.PrintfLine("230 logged in")
+			} else {
+				tc.PrintfLine("530 login incorrect")
+			}
+		case "TYPE", "NOOP":
+			tc.PrintfLine("200 OK")
+		case "QUIT":
+			tc.PrintfLine("221 goodbye")
+			return
+		case "EPSV":
+			if dataListener != nil {
+				dataListener.Close()
+			}
+			dataListener, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				tc.PrintfLine("425 cannot open data connection")
+				continue
+			}
+			port := dataListener.Addr().(*net.TCPAddr).Port
+			tc.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+		case "SIZE":
+			s.mutex.Lock()
+			file, exists := s.files[arg]
+			s.mutex.Unlock()
+			if exists {
+				tc.PrintfLine("213 %d", len(file.Contents))
+			} else {
+				tc.PrintfLine("550 no such file")
+			}
+		case "REST":
+			restOffset, err = strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				tc.PrintfLine("501 invalid offset")
+			} else {
+				tc.PrintfLine("350 restarting at %d", restOffset)
+			}
+		case "MLSD", "LIST":
+			if command == "MLSD" && !s.SupportsMLSD {
+				tc.PrintfLine("500 unknown command")
+				continue
+			}
+			lines, exists := s.listDirectory(arg, command == "MLSD")
+			if !exists {
+				tc.PrintfLine("550 no such directory")
+				continue
+			}
+			s.sendData(tc, &dataListener, []byte(strings.Join(lines, "\r\n")+"\r\n"), false)
+		case "RETR":
+			s.mutex.Lock()
+			file, exists := s.files[arg]
+			var data []byte
+			var drop bool
+			if exists {
+				data = file.Contents[restOffset:]
+				if dropAt, ok := s.dropDataAt[arg]; ok && dropAt > restOffset {
+					data = data[:dropAt-restOffset]
+					drop = true
+					delete(s.dropDataAt, arg)
+				}
+			}
+			s.mutex.Unlock()
+			restOffset = 0
+			if !exists {
+				tc.PrintfLine("550 no such file")
+				continue
+			}
+			s.sendData(tc, &dataListener, data, drop)
+		default:
+			tc.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+//Sends data over the data connection that was prepared by the last EPSV
+//command. If `drop` is true, the transfer is reported as aborted.
+func (s *fakeFTPServer) sendData(tc *textproto.Conn, dataListener *net.Listener, data []byte, drop bool) {
+	if *dataListener == nil {
+		tc.PrintfLine("425 use EPSV first")
+		return
+	}
+	defer func() {
+		(*dataListener).Close()
+		*dataListener = nil
+	}()
+
+	tc.PrintfLine("150 opening data connection")
+	conn, err := (*dataListener).Accept()
+	if err != nil {
+		tc.PrintfLine("425 cannot open data connection")
+		return
+	}
+	conn.Write(data)
+	conn.Close()
+	if drop {
+		tc.PrintfLine("426 connection closed; transfer aborted")
+	} else {
+		tc.PrintfLine("226 transfer complete")
+	}
+}
+
+//Renders a directory listing in the format of either MLSD or LIST.
+func (s *fakeFTPServer) listDirectory(dirPath string, useMLSD bool) (lines []string, exists bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dirPath = path.Clean("/" + dirPath)
+	if !s.dirs[dirPath] {
+		return nil, false
+	}
+
+	formatLine := func(name string, isDir bool, size int, mtime time.Time) string {
+		if useMLSD {
+			entryType := "file"
+			if isDir {
+				entryType = "dir"
+			}
+			return fmt.Sprintf("type=%s;size=%d;modify=%s; %s", entryType, size, mtime.Format("20060102150405"), name)
+		}
+		mode := "-rw-r--r--"
+		if isDir {
+			mode = "drwxr-xr-x"
+		}
+		return fmt.Sprintf("%s 1 owner group %d %s %s", mode, size, mtime.Format("Jan _2  2006"), name)
+	}
+
+	dirMtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if useMLSD {
+		lines = append(lines, fmt.Sprintf("type=cdir;modify=%s; .", dirMtime.Format("20060102150405")))
+	}
+	for filePath, file := range s.files {
+		if path.Dir(filePath) == dirPath {
+			lines = append(lines, formatLine(path.Base(filePath), false, len(file.Contents), file.ModTime))
+		}
+	}
+	for subdirPath := range s.dirs {
+		if subdirPath != "/" && path.Dir(subdirPath) == dirPath {
+			lines = append(lines, formatLine(path.Base(subdirPath), true, 4096, dirMtime))
+		}
+	}
+	//symlinks only appear in LIST output
+	if !useMLSD {
+		for linkPath, target := range s.links {
+			if path.Dir(linkPath) == dirPath {
+				lines = append(lines, fmt.Sprintf("lrwxrwxrwx 1 owner group %d %s %s -> %s",
+					len(target), dirMtime.Format("Jan _2  2006"), path.Base(linkPath), target))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func newTestFTPSource(t *testing.T, server *fakeFTPServer) *FTPSource {
+	t.Helper()
+	source := &FTPSource{
+		URLString: "ftp://" + server.Listener.Addr().String() + "/pub/",
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return source
+}
+
+func TestFTPSourceListing(t *testing.T) {
+	mtime := time.Date(2020, 10, 12, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		SupportsMLSD bool
+		Expected     string
+	}{
+		//MLSD reports exact mtimes
+		{true, "/a.txt 2020-10-12T10:00:00Z 5\n/empty.txt 2020-10-12T10:00:00Z 0\n/sub/b.txt 2020-10-12T11:00:00Z 3"},
+		//LIST (in the format of `ls -l`) only reports the date for files that are not recent
+		{false, "/a.txt 2020-10-12T00:00:00Z 5\n/empty.txt 2020-10-12T00:00:00Z 0\n/sub/b.txt 2020-10-12T00:00:00Z 3"},
+	}
+
+	for _, tc := range testCases {
+		server := newFakeFTPServer(t, tc.SupportsMLSD)
+		server.addFile("/pub/a.txt", "hello", mtime)
+		server.addFile("/pub/empty.txt", "", mtime)
+		server.addFile("/pub/sub/b.txt", "foo", mtime.Add(time.Hour))
+		server.addFile("/elsewhere/c.txt", "not below the source URL", mtime)
+		server.links["/pub/link"] = "a.txt"
+
+		source := newTestFTPSource(t, server)
+		files, lerr := source.ListAllFiles()
+		if lerr != nil {
+			t.Fatal(lerr.FullMessage())
+		}
+		var lines []string
+		for _, file := range files {
+			if file.SizeBytes == nil {
+				t.Errorf("expected size for %s, got nil", file.Path)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %d", file.Path, file.LastModified.Format(time.RFC3339), *file.SizeBytes))
+		}
+		sort.Strings(lines)
+		if actual := strings.Join(lines, "\n"); actual != tc.Expected {
+			t.Errorf("expected listing with MLSD = %t:\n%s\nbut got:\n%s", tc.SupportsMLSD, tc.Expected, actual)
+		}
+
+		usedCommand := "LIST /pub"
+		if tc.SupportsMLSD {
+			usedCommand = "MLSD /pub"
+		}
+		if !server.hasReceived(usedCommand) {
+			t.Errorf("expected server with MLSD = %t to receive %q", tc.SupportsMLSD, usedCommand)
+		}
+		server.Close()
+	}
+}
+
+func TestFTPSourceDownload(t *testing.T) {
+	server := newFakeFTPServer(t, true)
+	defer server.Close()
+	mtime := time.Date(2020, 10, 12, 10, 0, 0, 0, time.UTC)
+	largeContents := strings.Repeat("0123456789abcdef", 16384) //256 KiB
+	server.addFile("/pub/a.txt", "hello", mtime)
+	server.addFile("/pub/b.bin", largeContents, mtime)
+
+	source := newTestFTPSource(t, server)
+	_, lerr := source.ListAllFiles()
+	if lerr != nil {
+		t.Fatal(lerr.FullMessage())
+	}
+
+	//the mtime from the listing is used to emulate conditional GET
+	hdr := schwift.NewObjectHeaders()
+	hdr.Set("If-Modified-Since", mtime.Format(http.TimeFormat))
+	body, sourceState, err := source.GetFile("/a.txt", hdr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if body != nil || !sourceState.SkipTransfer {
+		t.Error("expected conditional GET of unchanged file to skip the transfer")
+	}
+
+	//when the data connection is dropped, the download is resumed at the same
+	//offset with REST
+	server.mutex.Lock()
+	server.dropDataAt["/pub/b.bin"] = 100000
+	server.mutex.Unlock()
+	body, sourceState, err = source.GetFile("/b.bin", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sourceState.SizeBytes != int64(len(largeContents)) {
+		t.Errorf("expected size %d, got %d", len(largeContents), sourceState.SizeBytes)
+	}
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = body.Close()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if !bytes.Equal(contents, []byte(largeContents)) {
+		t.Errorf("download after dropped connection yielded %d bytes instead of the original %d bytes", len(contents), len(largeContents))
+	}
+	if !server.hasReceived("REST 100000") {
+		t.Error("expected download to be resumed with REST 100000")
+	}
+
+	//if the file size changes before the download is resumed, the download fails
+	server.mutex.Lock()
+	server.dropDataAt["/pub/b.bin"] = 100000
+	server.mutex.Unlock()
+	body, _, err = source.GetFile("/b.bin", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := make([]byte, 65536)
+	_, err = io.ReadFull(body, buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server.addFile("/pub/b.bin", largeContents+"more", mtime.Add(time.Hour))
+	_, err = ioutil.ReadAll(body)
+	body.Close()
+	expectedError := fmt.Sprintf("file size has changed mid-transfer: %d -> %d", len(largeContents), len(largeContents)+4)
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("expected error %q, got %v", expectedError, err)
+	}
+}
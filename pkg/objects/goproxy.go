@@ -0,0 +1,509 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+)
+
+//The verifier key of sum.golang.org (as built into the go command).
+const defaultSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ay0Zrq8hbCE5ldOw"
+
+//GoProxySource is a URLSource serving the GOPROXY protocol. This type reuses
+//the Validate() and Connect() logic of URLSource, but adds a custom scraping
+//implementation that enumerates the versions of the configured modules
+//instead of relying on directory listings.
+//
+//Since the paths in the source are transferred verbatim, the target container
+//can be used as a GOPROXY itself when it is served via staticweb.
+type GoProxySource struct {
+	//options from config file
+	URLString                string   `yaml:"url"`
+	ClientCertificatePath    string   `yaml:"cert"`
+	ClientCertificateKeyPath string   `yaml:"key"`
+	ServerCAPath             string   `yaml:"ca"`
+	HTTPAuth                 HTTPAuth `yaml:",inline"`
+	Modules                  []string `yaml:"modules"`
+	SumDBURLString           string   `yaml:"sumdb"`
+	SumDBKey                 string   `yaml:"sumdb_key"`
+	GoSumPaths               []string `yaml:"go_sum"`
+	//compiled configuration
+	urlSource   *URLSource    `yaml:"-"`
+	sumdbURL    *url.URL      `yaml:"-"`
+	sumdbClient *sumdb.Client `yaml:"-"`
+	//knownHashes is filled from the go.sum files in Connect() and from the
+	//sumdb in ListAllFiles(). The keys look like the first two fields of a
+	//go.sum line, e.g. "golang.org/x/text v0.3.0" or "golang.org/x/text
+	//v0.3.0/go.mod".
+	knownHashes map[string]string `yaml:"-"`
+}
+
+//Validate implements the Source interface.
+func (s *GoProxySource) Validate(name string) (result []error) {
+	if s.URLString == "" {
+		s.URLString = "https://proxy.golang.org/"
+	}
+	s.urlSource = &URLSource{
+		URLString:                s.URLString,
+		ClientCertificatePath:    s.ClientCertificatePath,
+		ClientCertificateKeyPath: s.ClientCertificateKeyPath,
+		ServerCAPath:             s.ServerCAPath,
+		HTTPAuth:                 s.HTTPAuth,
+	}
+	result = s.urlSource.Validate(name)
+
+	if len(s.Modules) == 0 {
+		result = append(result, fmt.Errorf("missing value for %s.modules", name))
+	}
+	for idx, module := range s.Modules {
+		modulePath := strings.SplitN(module, "@", 2)[0]
+		if modulePath == "" || strings.HasPrefix(modulePath, "/") || strings.HasSuffix(modulePath, "/") {
+			result = append(result, fmt.Errorf("invalid value for %s.modules[%d]: %q is not a module path", name, idx, module))
+		}
+	}
+
+	if s.SumDBURLString != "" {
+		var err error
+		s.sumdbURL, err = url.Parse(s.SumDBURLString)
+		if err != nil {
+			result = append(result, fmt.Errorf("invalid value for %s.sumdb: %s", name, err.Error()))
+		} else if !strings.HasSuffix(s.sumdbURL.Path, "/") {
+			s.sumdbURL.Path += "/"
+		}
+		if s.SumDBKey == "" {
+			s.SumDBKey = defaultSumDBKey
+		}
+		_, err = note.NewVerifier(s.SumDBKey)
+		if err != nil {
+			result = append(result, fmt.Errorf("invalid value for %s.sumdb_key: %s", name, err.Error()))
+		}
+	} else if s.SumDBKey != "" {
+		result = append(result, fmt.Errorf("invalid value for %s.sumdb_key: only allowed when %s.sumdb is set", name, name))
+	}
+
+	return result
+}
+
+//Connect implements the Source interface.
+func (s *GoProxySource) Connect(name string) error {
+	s.knownHashes = make(map[string]string)
+	for _, path := range s.GoSumPaths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot load go.sum file from %s: %s", path, err.Error())
+		}
+		err = parseGoSumLines(buf, s.knownHashes)
+		if err != nil {
+			return fmt.Errorf("cannot load go.sum file from %s: %s", path, err.Error())
+		}
+		logg.Debug("go.sum file %s loaded", path)
+	}
+
+	err := s.urlSource.Connect(name)
+	if err != nil {
+		return err
+	}
+	if s.sumdbURL != nil {
+		s.sumdbClient = sumdb.NewClient(&sumdbClientOps{
+			URL:    s.sumdbURL,
+			Client: s.urlSource.HTTPClient,
+			Key:    s.SumDBKey,
+		})
+	}
+	return nil
+}
+
+//ListEntries implements the Source interface.
+func (s *GoProxySource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	return nil, &ListEntriesError{
+		Location: s.urlSource.getURLForPath(directoryPath).String(),
+		Message:  "ListEntries is not implemented for GoProxySource",
+	}
+}
+
+//ListAllFiles implements the Source interface.
+func (s *GoProxySource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	//collect the versions that we want to mirror for each module
+	var (
+		modulePaths    []string
+		versions       = make(map[string][]string)
+		isListedModule = make(map[string]bool)
+	)
+	for _, module := range s.Modules {
+		fields := strings.SplitN(module, "@", 2)
+		modulePath := fields[0]
+		if _, exists := versions[modulePath]; !exists {
+			modulePaths = append(modulePaths, modulePath)
+			versions[modulePath] = nil
+		}
+
+		if len(fields) == 2 {
+			//mirror only a single version (this can also be used for
+			//pseudo-versions, which do not appear in the version list)
+			versions[modulePath] = append(versions[modulePath], fields[1])
+			continue
+		}
+
+		listPath := escapeModulePath(modulePath) + "/@v/list"
+		buf, _, lerr := s.urlSource.getFileContents(listPath, make(map[string]FileSpec))
+		if lerr != nil {
+			return nil, lerr
+		}
+		for _, line := range strings.Split(string(buf), "\n") {
+			version := strings.TrimSpace(line)
+			if version != "" {
+				versions[modulePath] = append(versions[modulePath], version)
+			}
+		}
+		isListedModule[modulePath] = true
+	}
+
+	var result []FileSpec
+	for _, modulePath := range modulePaths {
+		//some versions may be listed multiple times if they are also pinned
+		seen := make(map[string]bool)
+		var moduleVersions []string
+		for _, version := range versions[modulePath] {
+			if !seen[version] {
+				moduleVersions = append(moduleVersions, version)
+				seen[version] = true
+			}
+		}
+
+		versionDir := escapeModulePath(modulePath) + "/@v/"
+		for _, version := range moduleVersions {
+			if s.sumdbURL != nil {
+				lerr := s.lookupSumDB(modulePath, version)
+				if lerr != nil {
+					return nil, lerr
+				}
+			}
+			basePath := versionDir + escapeModulePath(version)
+			result = append(result,
+				FileSpec{Path: basePath + ".info"},
+				FileSpec{Path: basePath + ".mod"},
+				FileSpec{Path: basePath + ".zip"},
+			)
+		}
+
+		//transfer the version list at the very end, when all the versions
+		//mentioned in it have already been uploaded (to avoid situations where a
+		//client might see a version without being able to download it)
+		if isListedModule[modulePath] {
+			contents := make([]byte, 0, 16*len(moduleVersions))
+			for _, version := range moduleVersions {
+				contents = append(contents, version+"\n"...)
+			}
+			result = append(result, FileSpec{
+				Path:     versionDir + "list",
+				Contents: contents,
+				Headers:  http.Header{"Content-Type": {"text/plain; charset=UTF-8"}},
+			})
+		}
+	}
+
+	return result, nil
+}
+
+//GetFile implements the Source interface.
+func (s *GoProxySource) GetFile(path string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	body, sourceState, err := s.urlSource.GetFile(path, requestHeaders)
+	if err != nil || sourceState.SkipTransfer || (s.sumdbURL == nil && len(s.GoSumPaths) == 0) {
+		return body, sourceState, err
+	}
+
+	//when a sumdb or go.sum file is configured, module zips and go.mod files
+	//must be verified against the known hashes before we upload them
+	modulePath, version, ext, ok := parseGoProxyPath(path)
+	if !ok || (ext != ".zip" && ext != ".mod") {
+		return body, sourceState, nil
+	}
+	key := modulePath + " " + version
+	if ext == ".mod" {
+		key += "/go.mod"
+	}
+	expectedHash, exists := s.knownHashes[key]
+	if !exists {
+		body.Close()
+		return nil, FileState{}, fmt.Errorf("cannot verify %s: no checksum known for %s", path, key)
+	}
+
+	//the module zip needs to be stored on disk since the hash can only be
+	//computed once the whole file has been downloaded
+	file, err := ioutil.TempFile("", "swift-http-import-goproxy-")
+	if err == nil {
+		_, err = io.Copy(file, body)
+	}
+	body.Close()
+	if err != nil {
+		if file != nil {
+			cleanupTempFile(file)
+		}
+		return nil, FileState{}, fmt.Errorf("cannot verify %s: %s", path, err.Error())
+	}
+
+	var actualHash string
+	if ext == ".zip" {
+		actualHash, err = dirhash.HashZip(file.Name(), dirhash.Hash1)
+	} else {
+		actualHash, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return os.Open(file.Name())
+		})
+	}
+	if err == nil && actualHash != expectedHash {
+		err = fmt.Errorf("expected %s, but got %s", expectedHash, actualHash)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, FileState{}, fmt.Errorf("cannot verify %s: %s", path, err.Error())
+	}
+
+	logg.Debug("verified checksum of %s for %s", path, key)
+	return tempFileReader{file}, sourceState, nil
+}
+
+//Helper function for GoProxySource.ListAllFiles(). The sumdb client verifies
+//the signature of the sumdb's tree head with the configured key, and that the
+//records for this module version are contained in the tree.
+func (s *GoProxySource) lookupSumDB(modulePath, version string) *ListEntriesError {
+	location := s.sumdbURL.String() + "lookup/" + escapeModulePath(modulePath) + "@" + escapeModulePath(version)
+	hashes := make(map[string]string)
+	//the hashes of the module zip and of the go.mod file are looked up
+	//separately (but the sumdb client only downloads the record once)
+	for _, v := range []string{version, version + "/go.mod"} {
+		lines, err := s.sumdbClient.Lookup(modulePath, v)
+		if err != nil {
+			return &ListEntriesError{location, "sumdb lookup failed", err}
+		}
+		err = parseGoSumLines([]byte(strings.Join(lines, "\n")), hashes)
+		if err != nil {
+			return &ListEntriesError{location, "cannot parse sumdb response", err}
+		}
+	}
+
+	//a local go.sum must not contradict the sumdb
+	for key, hash := range hashes {
+		if knownHash, exists := s.knownHashes[key]; exists && knownHash != hash {
+			return &ListEntriesError{
+				Location: location,
+				Message:  fmt.Sprintf("checksum mismatch for %s: go.sum has %s, but sumdb has %s", key, knownHash, hash),
+			}
+		}
+		s.knownHashes[key] = hash
+	}
+	return nil
+}
+
+//sumdbClientOps implements the sumdb.ClientOps interface. The sumdb's latest
+//tree head and all downloaded tiles are only kept in memory, so each run of
+//swift-http-import verifies the sumdb from scratch.
+type sumdbClientOps struct {
+	URL    *url.URL
+	Client *http.Client
+	Key    string
+
+	mutex  sync.Mutex
+	config map[string][]byte
+	cache  map[string][]byte
+}
+
+//ReadRemote implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) ReadRemote(path string) ([]byte, error) {
+	uri := o.URL.ResolveReference(&url.URL{Path: strings.TrimPrefix(path, "/")}).String()
+	resp, err := o.Client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %s", uri, resp.Status)
+	}
+	return buf, nil
+}
+
+//ReadConfig implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.Key), nil
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	//an unknown file yields an empty result, which means that we start with
+	//an empty tree
+	return o.config[file], nil
+}
+
+//WriteConfig implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) WriteConfig(file string, oldData, newData []byte) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !bytes.Equal(o.config[file], oldData) {
+		return sumdb.ErrWriteConflict
+	}
+	if o.config == nil {
+		o.config = make(map[string][]byte)
+	}
+	o.config[file] = newData
+	return nil
+}
+
+//ReadCache implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) ReadCache(file string) ([]byte, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	buf, exists := o.cache[file]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return buf, nil
+}
+
+//WriteCache implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) WriteCache(file string, data []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cache == nil {
+		o.cache = make(map[string][]byte)
+	}
+	o.cache[file] = data
+}
+
+//Log implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) Log(msg string) {
+	logg.Debug("sumdb: %s", msg)
+}
+
+//SecurityError implements the sumdb.ClientOps interface.
+func (o *sumdbClientOps) SecurityError(msg string) {
+	//the lookup fails with sumdb.ErrSecurity, so we only need to log the details
+	logg.Error("sumdb: %s", msg)
+}
+
+//parseGoSumLines parses lines in the go.sum format ("$MODULE $VERSION
+//h1:$HASH" or "$MODULE $VERSION/go.mod h1:$HASH") and puts the hashes into
+//the given map.
+func parseGoSumLines(buf []byte, hashes map[string]string) error {
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed go.sum line: %q", line)
+		}
+		//we only understand the "h1" hash algorithm
+		if strings.HasPrefix(fields[2], "h1:") {
+			hashes[fields[0]+" "+fields[1]] = fields[2]
+		}
+	}
+	return nil
+}
+
+//escapeModulePath applies the case-encoding of module paths and versions
+//that is used in the GOPROXY protocol, e.g. "github.com/BurntSushi/toml"
+//becomes "github.com/!burnt!sushi/toml".
+func escapeModulePath(path string) string {
+	var buf strings.Builder
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			buf.WriteByte('!')
+			buf.WriteRune(r + ('a' - 'A'))
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+//unescapeModulePath is the reverse of escapeModulePath.
+func unescapeModulePath(path string) string {
+	var buf strings.Builder
+	bang := false
+	for _, r := range path {
+		switch {
+		case r == '!':
+			bang = true
+			continue
+		case bang && 'a' <= r && r <= 'z':
+			buf.WriteRune(r - ('a' - 'A'))
+		default:
+			buf.WriteRune(r)
+		}
+		bang = false
+	}
+	return buf.String()
+}
+
+//parseGoProxyPath splits a path like "golang.org/x/text/@v/v0.3.0.zip" into
+//module path, version and extension.
+func parseGoProxyPath(path string) (modulePath, version, ext string, ok bool) {
+	fields := strings.SplitN(strings.TrimPrefix(path, "/"), "/@v/", 2)
+	if len(fields) != 2 {
+		return "", "", "", false
+	}
+	for _, e := range []string{".info", ".mod", ".zip"} {
+		if strings.HasSuffix(fields[1], e) {
+			escapedVersion := strings.TrimSuffix(fields[1], e)
+			return unescapeModulePath(fields[0]), unescapeModulePath(escapedVersion), e, true
+		}
+	}
+	return "", "", "", false
+}
+
+//tempFileReader is an io.ReadCloser for a temporary file that deletes the
+//file when closed.
+type tempFileReader struct {
+	*os.File
+}
+
+//Close implements the io.ReadCloser interface.
+func (r tempFileReader) Close() error {
+	return cleanupTempFile(r.File)
+}
+
+func cleanupTempFile(file *os.File) error {
+	err := file.Close()
+	removeErr := os.Remove(file.Name())
+	if err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,315 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/schwift"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestEscapeModulePath(t *testing.T) {
+	testcases := map[string]string{
+		"golang.org/x/text":               "golang.org/x/text",
+		"github.com/BurntSushi/toml":      "github.com/!burnt!sushi/toml",
+		"github.com/Azure/azure-sdk-ABC":  "github.com/!azure/azure-sdk-!a!b!c",
+		"v1.0.0-RC1":                      "v1.0.0-!r!c1",
+		"v0.0.0-20200728195943-123391ffb": "v0.0.0-20200728195943-123391ffb",
+	}
+
+	for input, expected := range testcases {
+		actual := escapeModulePath(input)
+		if actual != expected {
+			t.Errorf("expected %q to escape into %q, but got %q", input, expected, actual)
+		}
+		roundtrip := unescapeModulePath(actual)
+		if roundtrip != input {
+			t.Errorf("expected %q to unescape into %q, but got %q", actual, input, roundtrip)
+		}
+	}
+
+	modulePath, version, ext, ok := parseGoProxyPath("/github.com/!burnt!sushi/toml/@v/v0.3.1.zip")
+	if !ok || modulePath != "github.com/BurntSushi/toml" || version != "v0.3.1" || ext != ".zip" {
+		t.Errorf("unexpected result from parseGoProxyPath: %q, %q, %q, %t", modulePath, version, ext, ok)
+	}
+}
+
+//goProxyFixture is a GOPROXY and sumdb serving a single module version.
+type goProxyFixture struct {
+	Proxy     *httptest.Server
+	SumDB     *httptest.Server
+	SumDBKey  string
+	Contents  map[string][]byte //keys are paths below the GOPROXY root
+	ZipHash   string
+	GoModHash string
+}
+
+func newGoProxyFixture(t *testing.T) *goProxyFixture {
+	t.Helper()
+	f := &goProxyFixture{Contents: make(map[string][]byte)}
+
+	goMod := []byte("module example.com/hello\n")
+	zipContents := buildModuleZip(t, "package hello\n")
+	f.Contents["/example.com/hello/@v/list"] = []byte("v1.0.0\n")
+	f.Contents["/example.com/hello/@v/v1.0.0.info"] = []byte(`{"Version":"v1.0.0"}`)
+	f.Contents["/example.com/hello/@v/v1.0.0.mod"] = goMod
+	f.Contents["/example.com/hello/@v/v1.0.0.zip"] = zipContents
+	f.Proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, exists := f.Contents[r.URL.Path]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(contents)
+	}))
+
+	//compute the expected hashes with the reference implementation
+	f.ZipHash = expectedZipHash(t, zipContents)
+	var err error
+	f.GoModHash, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(goMod)), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	signerKey, verifierKey, err := note.GenerateKey(rand.Reader, "sumdb.example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.SumDBKey = verifierKey
+	sumdbServer := sumdb.NewServer(sumdb.NewTestServer(signerKey, func(path, vers string) ([]byte, error) {
+		if path != "example.com/hello" || vers != "v1.0.0" {
+			return nil, fmt.Errorf("no such module: %s@%s", path, vers)
+		}
+		return []byte(fmt.Sprintf("%[1]s %[2]s %[3]s\n%[1]s %[2]s/go.mod %[4]s\n", path, vers, f.ZipHash, f.GoModHash)), nil
+	}))
+	f.SumDB = httptest.NewServer(http.StripPrefix("/sumdb", sumdbServer))
+	return f
+}
+
+func (f *goProxyFixture) Close() {
+	f.Proxy.Close()
+	f.SumDB.Close()
+}
+
+//Returns a connected GoProxySource for this fixture.
+func (f *goProxyFixture) Source(t *testing.T, extraConfig func(*GoProxySource)) *GoProxySource {
+	t.Helper()
+	s := &GoProxySource{
+		URLString:      f.Proxy.URL + "/",
+		Modules:        []string{"example.com/hello"},
+		SumDBURLString: f.SumDB.URL + "/sumdb/",
+		SumDBKey:       f.SumDBKey,
+	}
+	if extraConfig != nil {
+		extraConfig(s)
+	}
+	errs := s.Validate("jobs[0].from")
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := s.Connect("jobs[0].from")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return s
+}
+
+//Builds the zip for version v1.0.0 of the module example.com/hello.
+func buildModuleZip(t *testing.T, helloGo string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range []struct{ Name, Contents string }{
+		{"example.com/hello@v1.0.0/go.mod", "module example.com/hello\n"},
+		{"example.com/hello@v1.0.0/hello.go", helloGo},
+	} {
+		w, err := zw.Create(file.Name)
+		if err == nil {
+			_, err = w.Write([]byte(file.Contents))
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func expectedZipHash(t *testing.T, contents []byte) string {
+	t.Helper()
+	file, err := ioutil.TempFile("", "swift-http-import-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.Write(contents)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hash, err := dirhash.HashZip(file.Name(), dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return hash
+}
+
+func expectGoProxyFile(t *testing.T, s *GoProxySource, path string, expectedContents []byte) {
+	t.Helper()
+	body, _, err := s.GetFile(path, schwift.NewObjectHeaders())
+	if err != nil {
+		t.Errorf("expected GetFile(%q) to succeed, but got error: %s", path, err.Error())
+		return
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(contents, expectedContents) {
+		t.Errorf("GetFile(%q) returned unexpected contents", path)
+	}
+}
+
+func TestGoProxySourceWithSumDB(t *testing.T) {
+	f := newGoProxyFixture(t)
+	defer f.Close()
+
+	//with the correct key, the sumdb records are accepted and used to verify
+	//module zips and go.mod files
+	s := f.Source(t, nil)
+	files, lerr := s.ListAllFiles()
+	if lerr != nil {
+		t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+	}
+	if len(files) != 4 {
+		t.Errorf("expected 4 files, got %d", len(files))
+	}
+	for _, path := range []string{"/example.com/hello/@v/v1.0.0.mod", "/example.com/hello/@v/v1.0.0.zip"} {
+		expectGoProxyFile(t, s, path, f.Contents[path])
+	}
+
+	//a sumdb that is not signed with the configured key is rejected
+	_, otherKey, err := note.GenerateKey(rand.Reader, "sumdb.example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s = f.Source(t, func(s *GoProxySource) { s.SumDBKey = otherKey })
+	_, lerr = s.ListAllFiles()
+	if lerr == nil {
+		t.Error("expected sumdb with unknown signature to be rejected, but it was accepted")
+	} else if lerr.Inner == nil || !strings.Contains(lerr.Inner.Error(), "no verifiable signatures") {
+		t.Errorf("expected sumdb to be rejected because of its signature, but got: %s", lerr.FullMessage())
+	}
+
+	//invalid keys are rejected during validation
+	s = &GoProxySource{Modules: []string{"example.com/hello"}, SumDBURLString: f.SumDB.URL, SumDBKey: "invalid"}
+	errs := s.Validate("jobs[0].from")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "sumdb_key") {
+		t.Errorf("expected invalid sumdb_key to be rejected, got %v", errs)
+	}
+}
+
+
+
+func TestGoProxySourceRejectsMismatchingFiles(t *testing.T) {
+	f := newGoProxyFixture(t)
+	defer f.Close()
+
+	//files that do not match the hashes from the sumdb are not transferred
+	s := f.Source(t, nil)
+	_, lerr := s.ListAllFiles()
+	if lerr != nil {
+		t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+	}
+	f.Contents["/example.com/hello/@v/v1.0.0.zip"] = buildModuleZip(t, "package hello // tampered\n")
+	f.Contents["/example.com/hello/@v/v1.0.0.mod"] = []byte("module example.com/tampered\n")
+	for _, path := range []string{"/example.com/hello/@v/v1.0.0.mod", "/example.com/hello/@v/v1.0.0.zip"} {
+		body, _, err := s.GetFile(path, schwift.NewObjectHeaders())
+		if err == nil {
+			body.Close()
+			t.Errorf("expected GetFile(%q) to fail because of checksum mismatch, but it succeeded", path)
+		} else if !strings.Contains(err.Error(), "expected h1:") {
+			t.Errorf("expected GetFile(%q) to fail because of checksum mismatch, but got: %s", path, err.Error())
+		}
+	}
+}
+
+func TestGoProxySourceWithGoSum(t *testing.T) {
+	f := newGoProxyFixture(t)
+	defer f.Close()
+
+	writeGoSum := func(zipHash string) string {
+		t.Helper()
+		file, err := ioutil.TempFile("", "swift-http-import-test-")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer file.Close()
+		_, err = fmt.Fprintf(file, "example.com/hello v1.0.0 %s\nexample.com/hello v1.0.0/go.mod %s\n", zipHash, f.GoModHash)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return file.Name()
+	}
+
+	//a go.sum file can be used without sumdb
+	goodGoSum := writeGoSum(f.ZipHash)
+	defer os.Remove(goodGoSum)
+	s := f.Source(t, func(s *GoProxySource) {
+		s.SumDBURLString = ""
+		s.SumDBKey = ""
+		s.GoSumPaths = []string{goodGoSum}
+	})
+	_, lerr := s.ListAllFiles()
+	if lerr != nil {
+		t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+	}
+	expectGoProxyFile(t, s, "/example.com/hello/@v/v1.0.0.zip", f.Contents["/example.com/hello/@v/v1.0.0.zip"])
+
+	//when go.sum and sumdb disagree, the listing fails
+	badGoSum := writeGoSum("h1:v/u/g2S1hZaWZImyAVXAGG42N1pWX/UTgAYidytBT84x")
+	defer os.Remove(badGoSum)
+	s = f.Source(t, func(s *GoProxySource) { s.GoSumPaths = []string{badGoSum} })
+	_, lerr = s.ListAllFiles()
+	if lerr == nil {
+		t.Error("expected mismatch between go.sum and sumdb to be rejected, but it was accepted")
+	} else if !strings.Contains(lerr.Message, "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, but got: %s", lerr.Message)
+	}
+}
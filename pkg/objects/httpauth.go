@@ -0,0 +1,152 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//HTTPAuth contains the options for authenticating with an HTTP server, other
+//than TLS client certificates. It is used by URLSource and the custom source
+//types that are based on it.
+type HTTPAuth struct {
+	BasicAuthUser     string                   `yaml:"basic_auth_user"`
+	BasicAuthPassword AuthPassword             `yaml:"basic_auth_password"`
+	BearerToken       AuthPassword             `yaml:"bearer_token"`
+	Headers           map[string]AuthPassword  `yaml:"headers"`
+	OAuth2            *OAuth2ClientCredentials `yaml:"oauth2"`
+}
+
+//Validate reports errors in the HTTPAuth options.
+func (a *HTTPAuth) Validate(name string) (result []error) {
+	if a.BasicAuthUser == "" && a.BasicAuthPassword != "" {
+		result = append(result, fmt.Errorf("missing value for %s.basic_auth_user", name))
+	}
+	if a.BasicAuthUser != "" && a.BearerToken != "" {
+		result = append(result, fmt.Errorf("invalid value for %s.bearer_token: cannot be combined with %s.basic_auth_user", name, name))
+	}
+	if a.OAuth2 != nil {
+		if a.BasicAuthUser != "" || a.BearerToken != "" {
+			result = append(result, fmt.Errorf("invalid value for %s.oauth2: cannot be combined with %s.basic_auth_user or %s.bearer_token", name, name, name))
+		}
+		result = append(result, a.OAuth2.Validate(name+".oauth2")...)
+	}
+
+	//normalize header names, so that we can detect conflicts
+	headers := make(map[string]AuthPassword, len(a.Headers))
+	for key, value := range a.Headers {
+		canonicalKey := textproto.CanonicalMIMEHeaderKey(key)
+		if _, exists := headers[canonicalKey]; exists {
+			result = append(result, fmt.Errorf("invalid value for %s.headers: header %q is given multiple times", name, canonicalKey))
+		}
+		headers[canonicalKey] = value
+	}
+	if _, exists := headers["Authorization"]; exists && (a.BasicAuthUser != "" || a.BearerToken != "" || a.OAuth2 != nil) {
+		result = append(result, fmt.Errorf("invalid value for %s.headers: cannot set Authorization header when %s.basic_auth_user, %s.bearer_token or %s.oauth2 is given", name, name, name, name))
+	}
+	a.Headers = headers
+
+	return
+}
+
+//IsEmpty returns whether no authentication options have been given.
+func (a HTTPAuth) IsEmpty() bool {
+	return a.BasicAuthUser == "" && a.BearerToken == "" && len(a.Headers) == 0 && a.OAuth2 == nil
+}
+
+//Apply adds the configured static credentials to the given request. OAuth2
+//access tokens are added by httpAuthRoundTripper.
+func (a HTTPAuth) Apply(req *http.Request) {
+	if a.BasicAuthUser != "" {
+		req.SetBasicAuth(a.BasicAuthUser, string(a.BasicAuthPassword))
+	}
+	if a.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+string(a.BearerToken))
+	}
+	for key, value := range a.Headers {
+		req.Header.Set(key, string(value))
+	}
+}
+
+//httpAuthRoundTripper is an http.RoundTripper that adds the credentials from
+//an HTTPAuth to every request. Since the credentials are added at the
+//transport level, they are also present on requests made by helper functions
+//like util.EnhancedGet().
+type httpAuthRoundTripper struct {
+	Inner http.RoundTripper
+	Auth  HTTPAuth
+	//credentials are only sent to this host (i.e. not when following redirects
+	//to other servers)
+	Host string
+	//only set if Auth.OAuth2 is set
+	TokenSource *oauth2TokenSource
+}
+
+//RoundTrip implements the http.RoundTripper interface.
+func (t *httpAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.Host {
+		return t.Inner.RoundTrip(req)
+	}
+
+	//RoundTrip() may not modify the original request
+	authReq := req.Clone(req.Context())
+	t.Auth.Apply(authReq)
+	if t.TokenSource == nil {
+		return t.Inner.RoundTrip(authReq)
+	}
+
+	token, err := t.TokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(authReq)
+	resp, err := t.Inner.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	//the token was rejected (most likely because it was revoked or expired
+	//early) -> obtain a new token and try again, unless the request body
+	//cannot be replayed
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	logg.Info("%s %s returned status 401, retrying with new OAuth2 access token", req.Method, req.URL.String())
+	resp.Body.Close()
+	t.TokenSource.Invalidate(token)
+	token, err = t.TokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+	authReq = req.Clone(req.Context())
+	if req.GetBody != nil {
+		authReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.Auth.Apply(authReq)
+	token.SetAuthHeader(authReq)
+	return t.Inner.RoundTrip(authReq)
+}
@@ -0,0 +1,212 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestURLSourceWithHTTPAuth(t *testing.T) {
+	//this server only allows access with the correct credentials
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" || r.Header.Get("X-Api-Key") != "secret-key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="file.txt">file.txt</a>`))
+		case "/file.txt":
+			w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "swift-http-import-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	tokenPath := filepath.Join(tempDir, "token")
+	err = ioutil.WriteFile(tokenPath, []byte("secret-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("TEST_API_KEY", "secret-key")
+	defer os.Unsetenv("TEST_API_KEY")
+
+	var source URLSource
+	err = yaml.Unmarshal([]byte(`
+url: `+server.URL+`/
+bearer_token: { fromFile: `+tokenPath+` }
+headers:
+  x-api-key: { fromEnv: TEST_API_KEY }
+`), &source)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err = source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	files, lerr := source.ListEntries("/")
+	if lerr != nil {
+		t.Fatal(lerr.FullMessage())
+	}
+	if len(files) != 1 || files[0].Path != "/file.txt" {
+		t.Fatalf("unexpected listing: %#v", files)
+	}
+
+	//this also covers util.EnhancedGet() since segmenting is enabled by default
+	body, _, err := source.GetFile("/file.txt", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "hello" {
+		t.Errorf("expected file contents %q, got %q", "hello", string(contents))
+	}
+}
+
+func TestHTTPAuthIsOnlySentToSourceHost(t *testing.T) {
+	var receivedAuth []string
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAuth = append(receivedAuth, r.Header.Get("Authorization"))
+		w.Write([]byte("hello"))
+	}))
+	defer otherServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAuth = append(receivedAuth, r.Header.Get("Authorization"))
+		http.Redirect(w, r, otherServer.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+
+	source := URLSource{
+		URLString: server.URL + "/",
+		HTTPAuth:  HTTPAuth{BasicAuthUser: "user", BasicAuthPassword: "password"},
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _, err := source.GetFile("/file.txt", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body.Close()
+
+	if len(receivedAuth) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(receivedAuth))
+	}
+	if receivedAuth[0] != "Basic dXNlcjpwYXNzd29yZA==" {
+		t.Errorf("expected basic auth on source host, got %q", receivedAuth[0])
+	}
+	if receivedAuth[1] != "" {
+		t.Errorf("expected no credentials on redirect target, got %q", receivedAuth[1])
+	}
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	//the token endpoint issues a new token on every request
+	var issuedTokens []string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || clientID != "client" || clientSecret != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		token := fmt.Sprintf("token%d", len(issuedTokens)+1)
+		issuedTokens = append(issuedTokens, token)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"bearer","expires_in":3600}`, token)
+	}))
+	defer tokenServer.Close()
+
+	//the file server only accepts the latest token, and only for a few requests
+	//(to simulate the token being revoked in the middle of a segmented download)
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if len(issuedTokens) == 0 || r.Header.Get("Authorization") != "Bearer "+issuedTokens[len(issuedTokens)-1] || requestCount%3 == 0 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("hello world"))
+	}))
+	defer server.Close()
+
+	source := URLSource{
+		URLString:   server.URL + "/",
+		SegmentSize: 4,
+		HTTPAuth: HTTPAuth{OAuth2: &OAuth2ClientCredentials{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "client",
+			ClientSecret: "secret",
+		}},
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	body, _, err := source.GetFile("/file.txt", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "hello world" {
+		t.Errorf("expected file contents %q, got %q", "hello world", string(contents))
+	}
+	if len(issuedTokens) < 2 {
+		t.Errorf("expected the token to be refreshed, but only %d tokens were issued", len(issuedTokens))
+	}
+}
@@ -0,0 +1,238 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//JSONListingMapping describes where to find the relevant information in a
+//directory listing in JSON format. Each field contains the path to a value in
+//the JSON document, with path elements separated by dots.
+type JSONListingMapping struct {
+	//path to the list of entries ("" if the document itself is the list)
+	EntriesPath string `yaml:"entries"`
+	//paths to values within each entry
+	NameField  string `yaml:"name"`
+	TypeField  string `yaml:"type"`
+	SizeField  string `yaml:"size"`
+	MtimeField string `yaml:"mtime"`
+	//if the type field is a string, entries with this value are directories
+	//(if the type field is a boolean, true means directory)
+	DirectoryType string `yaml:"directory_type"`
+	//one of "rfc3339" (default), "http" or "unix"
+	MtimeFormat string `yaml:"mtime_format"`
+}
+
+//The mappings for well-known JSON listing formats.
+var (
+	//nginx with `autoindex_format json;`
+	nginxJSONListingMapping = JSONListingMapping{
+		NameField:     "name",
+		TypeField:     "type",
+		DirectoryType: "directory",
+		SizeField:     "size",
+		MtimeField:    "mtime",
+		MtimeFormat:   "http",
+	}
+	//Caddy's browse directive (with "Accept: application/json")
+	caddyJSONListingMapping = JSONListingMapping{
+		NameField:   "name",
+		TypeField:   "is_dir",
+		SizeField:   "size",
+		MtimeField:  "mod_time",
+		MtimeFormat: "rfc3339",
+	}
+)
+
+//Validate reports errors in a user-supplied JSONListingMapping.
+func (m *JSONListingMapping) Validate(name string) (result []error) {
+	if m.NameField == "" {
+		result = append(result, fmt.Errorf("missing value for %s.name", name))
+	}
+	switch m.MtimeFormat {
+	case "":
+		m.MtimeFormat = "rfc3339"
+	case "rfc3339", "http", "unix":
+		//ok
+	default:
+		result = append(result, fmt.Errorf(`invalid value for %s.mtime_format: expected "rfc3339", "http" or "unix", got %q`, name, m.MtimeFormat))
+	}
+	return
+}
+
+//Implementation of URLSource.ListEntries() for the JSON listing formats.
+func (u URLSource) listEntriesViaJSON(uri *url.URL, directoryPath string, mapping JSONListingMapping) ([]FileSpec, *ListEntriesError) {
+	logg.Debug("scraping %s", uri)
+
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, &ListEntriesError{uri.String(), "GET failed", err}
+	}
+	req.Header.Set("Accept", "application/json")
+	response, err := u.HTTPClient.Do(req)
+	if err != nil {
+		return nil, &ListEntriesError{uri.String(), "GET failed", err}
+	}
+	defer response.Body.Close()
+
+	if !strings.HasPrefix(response.Status, "2") {
+		return nil, &ListEntriesError{uri.String(), "GET returned status " + response.Status, nil}
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&document)
+	if err != nil {
+		return nil, &ListEntriesError{uri.String(), "cannot parse directory listing", err}
+	}
+	entries, ok := lookupJSONPath(document, mapping.EntriesPath).([]interface{})
+	if !ok {
+		return nil, &ListEntriesError{uri.String(), fmt.Sprintf("cannot find list of entries at %q in directory listing", mapping.EntriesPath), nil}
+	}
+
+	var result []FileSpec
+	for _, entry := range entries {
+		spec, err := mapping.parseEntry(entry)
+		if err != nil {
+			logg.Error("scrape %s: ignoring entry: %s", uri.String(), err.Error())
+			continue
+		}
+		if spec.Path == "" {
+			continue
+		}
+		spec.Path = filepath.Join(directoryPath, spec.Path)
+		result = append(result, spec)
+	}
+	return result, nil
+}
+
+//Converts a single entry of a JSON directory listing into a FileSpec with a
+//path relative to the directory. An empty path is returned for entries that
+//shall be ignored.
+func (m JSONListingMapping) parseEntry(entry interface{}) (FileSpec, error) {
+	var spec FileSpec
+
+	name, ok := lookupJSONPath(entry, m.NameField).(string)
+	if !ok {
+		return spec, fmt.Errorf("no string value at %q", m.NameField)
+	}
+	//some servers add a trailing slash to directory names
+	if strings.HasSuffix(name, "/") {
+		spec.IsDirectory = true
+		name = strings.TrimSuffix(name, "/")
+	}
+	//ignore entries that could lead outside the current directory
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return FileSpec{}, nil
+	}
+	spec.Path = name
+
+	if m.TypeField != "" {
+		switch value := lookupJSONPath(entry, m.TypeField).(type) {
+		case bool:
+			spec.IsDirectory = spec.IsDirectory || value
+		case string:
+			spec.IsDirectory = spec.IsDirectory || value == m.DirectoryType
+		}
+	}
+	if spec.IsDirectory {
+		return spec, nil
+	}
+
+	if m.SizeField != "" {
+		if value, ok := lookupJSONPath(entry, m.SizeField).(json.Number); ok {
+			size, err := value.Int64()
+			if err != nil {
+				return spec, fmt.Errorf("invalid size for %q: %s", name, err.Error())
+			}
+			spec.SizeBytes = &size
+		}
+	}
+
+	if m.MtimeField != "" {
+		mtime, err := m.parseMtime(lookupJSONPath(entry, m.MtimeField))
+		if err != nil {
+			return spec, fmt.Errorf("invalid mtime for %q: %s", name, err.Error())
+		}
+		spec.LastModified = mtime
+	}
+
+	return spec, nil
+}
+
+func (m JSONListingMapping) parseMtime(value interface{}) (*time.Time, error) {
+	var (
+		mtime time.Time
+		err   error
+	)
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		if m.MtimeFormat != "unix" {
+			return nil, fmt.Errorf("expected string, got number %s", value)
+		}
+		var seconds float64
+		seconds, err = value.Float64()
+		mtime = time.Unix(0, int64(seconds*1e9)).UTC()
+	case string:
+		switch m.MtimeFormat {
+		case "http":
+			mtime, err = http.ParseTime(value)
+		case "rfc3339":
+			mtime, err = time.Parse(time.RFC3339Nano, value)
+		default:
+			return nil, fmt.Errorf("expected number, got %q", value)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected value %v", value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mtime, nil
+}
+
+//lookupJSONPath finds the value at the given path (with path elements
+//separated by dots) within a JSON document that was decoded into an
+//interface{}. If there is no value at this path, nil is returned.
+func lookupJSONPath(document interface{}, path string) interface{} {
+	if path == "" {
+		return document
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		document = object[key]
+	}
+	return document
+}
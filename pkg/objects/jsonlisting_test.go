@@ -0,0 +1,113 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestJSONListingMappings(t *testing.T) {
+	mtime := time.Date(2020, 10, 12, 10, 0, 0, 0, time.UTC)
+	size := int64(42)
+
+	testcases := []struct {
+		Mapping  JSONListingMapping
+		Input    string
+		Expected FileSpec
+	}{
+		{nginxJSONListingMapping,
+			`{"name":"foo.tar.gz","type":"file","mtime":"Mon, 12 Oct 2020 10:00:00 GMT","size":42}`,
+			FileSpec{Path: "foo.tar.gz", LastModified: &mtime, SizeBytes: &size}},
+		{nginxJSONListingMapping,
+			`{"name":"subdir","type":"directory","mtime":"Mon, 12 Oct 2020 10:00:00 GMT"}`,
+			FileSpec{Path: "subdir", IsDirectory: true}},
+		{caddyJSONListingMapping,
+			`{"name":"foo.tar.gz","size":42,"url":"./foo.tar.gz","mod_time":"2020-10-12T12:00:00+02:00","mode":420,"is_dir":false,"is_symlink":false}`,
+			FileSpec{Path: "foo.tar.gz", LastModified: &mtime, SizeBytes: &size}},
+		{caddyJSONListingMapping,
+			`{"name":"subdir/","size":4096,"url":"./subdir/","mod_time":"2020-10-12T10:00:00Z","mode":2147484141,"is_dir":true,"is_symlink":false}`,
+			FileSpec{Path: "subdir", IsDirectory: true}},
+		{JSONListingMapping{NameField: "meta.filename", SizeField: "meta.bytes", MtimeField: "created", MtimeFormat: "unix"},
+			`{"meta":{"filename":"foo.tar.gz","bytes":42},"created":1602496800}`,
+			FileSpec{Path: "foo.tar.gz", LastModified: &mtime, SizeBytes: &size}},
+		{nginxJSONListingMapping,
+			`{"name":"..","type":"directory"}`,
+			FileSpec{}},
+	}
+
+	for idx, tc := range testcases {
+		var entry interface{}
+		decoder := json.NewDecoder(strings.NewReader(tc.Input))
+		decoder.UseNumber()
+		err := decoder.Decode(&entry)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		actual, err := tc.Mapping.parseEntry(entry)
+		if err != nil {
+			t.Errorf("testcase %d: unexpected error: %s", idx, err.Error())
+			continue
+		}
+		if actual.Path != tc.Expected.Path || actual.IsDirectory != tc.Expected.IsDirectory {
+			t.Errorf("testcase %d: expected path %q (directory = %t), got %q (directory = %t)",
+				idx, tc.Expected.Path, tc.Expected.IsDirectory, actual.Path, actual.IsDirectory)
+		}
+		if (actual.SizeBytes == nil) != (tc.Expected.SizeBytes == nil) ||
+			(actual.SizeBytes != nil && *actual.SizeBytes != *tc.Expected.SizeBytes) {
+			t.Errorf("testcase %d: expected size %v, got %v", idx, tc.Expected.SizeBytes, actual.SizeBytes)
+		}
+		if (actual.LastModified == nil) != (tc.Expected.LastModified == nil) ||
+			(actual.LastModified != nil && !actual.LastModified.Equal(*tc.Expected.LastModified)) {
+			t.Errorf("testcase %d: expected mtime %v, got %v", idx, tc.Expected.LastModified, actual.LastModified)
+		}
+	}
+}
+
+func TestJSONListingWithoutMtimeRejectsNotOlderThan(t *testing.T) {
+	configYAML := `
+from:
+  url: http://localhost/
+  listing_format: json
+  listing_json:
+    name: name
+to:
+  storage_url: http://localhost/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+match:
+  not_older_than: 3 days
+`
+	var cfg JobConfiguration
+	err := yaml.Unmarshal([]byte(configYAML), &cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, errs := cfg.Compile("jobs[0]", SwiftLocation{})
+	expected := "invalid value for jobs[0].match.not_older_than: requires jobs[0].from.listing_json.mtime to be set"
+	if len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, errs)
+	}
+}
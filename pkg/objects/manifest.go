@@ -0,0 +1,264 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/majewsky/schwift"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ManifestSource is a source whose file listing is not obtained by scraping,
+//but comes from a manifest file that lists the URLs of all files explicitly.
+//The URLs may be located on arbitrary hosts. This type reuses the Connect()
+//and GetFile() logic of URLSource.
+type ManifestSource struct {
+	//options from config file
+	Manifest                 string `yaml:"manifest"`
+	ManifestFormat           string `yaml:"manifest_format"`
+	ClientCertificatePath    string `yaml:"cert"`
+	ClientCertificateKeyPath string `yaml:"key"`
+	ServerCAPath             string `yaml:"ca"`
+	SegmentingIn             *bool  `yaml:"segmenting"`
+	SegmentSize              uint64 `yaml:"segment_bytes"`
+	//compiled configuration
+	urlSource   *URLSource `yaml:"-"`
+	manifestURL *url.URL   `yaml:"-"` //nil if the manifest is a local file
+	//entries is filled by ListAllFiles() and used by GetFile()
+	entries map[string]manifestEntry `yaml:"-"`
+}
+
+//manifestEntry describes a single file listed in a manifest.
+type manifestEntry struct {
+	URL      string `json:"url" yaml:"url"`
+	Path     string `json:"path" yaml:"path"`
+	Checksum string `json:"checksum" yaml:"checksum"`
+	//compiled attributes
+	checksum *Checksum
+}
+
+//Validate implements the Source interface.
+func (s *ManifestSource) Validate(name string) (result []error) {
+	if s.Manifest == "" {
+		result = append(result, fmt.Errorf("missing value for %s.manifest", name))
+	} else if strings.HasPrefix(s.Manifest, "http://") || strings.HasPrefix(s.Manifest, "https://") {
+		var err error
+		s.manifestURL, err = url.Parse(s.Manifest)
+		if err != nil {
+			result = append(result, fmt.Errorf("invalid value for %s.manifest: %s", name, err.Error()))
+		}
+	}
+
+	switch s.ManifestFormat {
+	case "":
+		switch strings.ToLower(filepath.Ext(s.Manifest)) {
+		case ".json":
+			s.ManifestFormat = "json"
+		case ".yaml", ".yml":
+			s.ManifestFormat = "yaml"
+		default:
+			s.ManifestFormat = "text"
+		}
+	case "text", "json", "yaml":
+		//ok
+	default:
+		result = append(result, fmt.Errorf(`invalid value for %s.manifest_format: expected "text", "json" or "yaml", got %q`, name, s.ManifestFormat))
+	}
+
+	s.urlSource = &URLSource{
+		ClientCertificatePath:    s.ClientCertificatePath,
+		ClientCertificateKeyPath: s.ClientCertificateKeyPath,
+		ServerCAPath:             s.ServerCAPath,
+		SegmentingIn:             s.SegmentingIn,
+		SegmentSize:              s.SegmentSize,
+	}
+	return append(result, s.urlSource.validateConnectionOptions(name)...)
+}
+
+//Connect implements the Source interface.
+func (s *ManifestSource) Connect(name string) error {
+	return s.urlSource.Connect(name)
+}
+
+//ListEntries implements the Source interface.
+func (s *ManifestSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	return nil, &ListEntriesError{
+		Location: s.Manifest,
+		Message:  "ListEntries is not implemented for ManifestSource",
+	}
+}
+
+//ListAllFiles implements the Source interface.
+func (s *ManifestSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	var (
+		buf []byte
+		err error
+	)
+	if s.manifestURL == nil {
+		buf, err = ioutil.ReadFile(s.Manifest)
+		if err != nil {
+			return nil, &ListEntriesError{s.Manifest, "cannot read manifest", err}
+		}
+	} else {
+		var lerr *ListEntriesError
+		buf, _, lerr = s.urlSource.getContentsFromURL(s.manifestURL.String())
+		if lerr != nil {
+			return nil, lerr
+		}
+	}
+
+	entries, err := parseManifest(buf, s.ManifestFormat)
+	if err != nil {
+		return nil, &ListEntriesError{s.Manifest, "cannot parse manifest", err}
+	}
+
+	s.entries = make(map[string]manifestEntry, len(entries))
+	result := make([]FileSpec, 0, len(entries))
+	for _, entry := range entries {
+		if _, exists := s.entries[entry.Path]; exists {
+			return nil, &ListEntriesError{
+				Location: s.Manifest,
+				Message:  fmt.Sprintf("multiple entries with target path %q", entry.Path),
+			}
+		}
+		s.entries[entry.Path] = entry
+		result = append(result, FileSpec{Path: entry.Path, Checksum: entry.checksum})
+	}
+	return result, nil
+}
+
+//GetFile implements the Source interface.
+func (s *ManifestSource) GetFile(path string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	entry, exists := s.entries[path]
+	if !exists {
+		return nil, FileState{}, fmt.Errorf("skipping %s: not listed in manifest", path)
+	}
+
+	body, sourceState, err := s.urlSource.getFileFromURL(entry.URL, requestHeaders)
+	if err != nil || sourceState.SkipTransfer || entry.checksum == nil {
+		return body, sourceState, err
+	}
+	return entry.checksum.VerifyingReader(body, entry.URL), sourceState, nil
+}
+
+//parseManifest parses and validates the contents of a manifest file.
+func parseManifest(buf []byte, format string) ([]manifestEntry, error) {
+	var (
+		entries []manifestEntry
+		err     error
+	)
+	switch format {
+	case "json":
+		err = json.Unmarshal(buf, &entries)
+	case "yaml":
+		err = yaml.UnmarshalStrict(buf, &entries)
+	default:
+		entries, err = parseTextManifest(string(buf))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range entries {
+		entry := &entries[idx]
+		err := entry.compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry for %s: %s", entry.URL, err.Error())
+		}
+	}
+	return entries, nil
+}
+
+//parseTextManifest parses a manifest in the text format. Each line has the
+//format "URL [TARGET_PATH] [CHECKSUM]". Empty lines and comment lines
+//starting with "#" are ignored.
+func parseTextManifest(input string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	for idx, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := manifestEntry{URL: fields[0]}
+		for _, field := range fields[1:] {
+			switch {
+			case looksLikeChecksum(field) && entry.Checksum == "":
+				entry.Checksum = field
+			case entry.Path == "" && entry.Checksum == "":
+				entry.Path = field
+			default:
+				return nil, fmt.Errorf("line %d: expected \"URL [TARGET_PATH] [CHECKSUM]\", got %q", idx+1, line)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//looksLikeChecksum returns whether the given field from a text manifest has
+//the "<algorithm>:" prefix of a checksum (as opposed to being a path).
+func looksLikeChecksum(field string) bool {
+	fields := strings.SplitN(field, ":", 2)
+	_, isKnownAlgorithm := checksumAlgorithms[strings.ToLower(fields[0])]
+	return len(fields) == 2 && isKnownAlgorithm
+}
+
+func (e *manifestEntry) compile() error {
+	if e.URL == "" {
+		return fmt.Errorf("missing URL")
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("expected an absolute http:// or https:// URL")
+	}
+
+	//if no target path is given, use the path from the URL
+	if e.Path == "" {
+		e.Path = u.Path
+	}
+	e.Path = strings.TrimPrefix(e.Path, "/")
+	if e.Path == "" || strings.HasSuffix(e.Path, "/") {
+		return fmt.Errorf("target path %q does not refer to a file", e.Path)
+	}
+	if dotdotRx.MatchString(e.Path) {
+		return fmt.Errorf("target path %q may not contain \"..\"", e.Path)
+	}
+
+	if e.Checksum != "" {
+		checksum, err := ParseChecksum(e.Checksum)
+		if err != nil {
+			return err
+		}
+		e.checksum = &checksum
+	}
+	return nil
+}
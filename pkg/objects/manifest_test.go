@@ -0,0 +1,151 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/majewsky/schwift"
+)
+
+const emptySHA256 = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestParseTextManifest(t *testing.T) {
+	input := `
+# comment
+https://example.com/foo/bar.tar.gz
+https://example.org/download?id=42 other/file.zip
+https://example.org/empty ` + emptySHA256 + `
+https://example.org/empty2 /empty.txt ` + emptySHA256 + `
+`
+	entries, err := parseManifest([]byte(input), "text")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct{ Path, Checksum string }{
+		{"foo/bar.tar.gz", ""},
+		{"other/file.zip", ""},
+		{"empty", emptySHA256},
+		{"empty.txt", emptySHA256},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for idx, e := range expected {
+		entry := entries[idx]
+		if entry.Path != e.Path {
+			t.Errorf("entry %d: expected path %q, got %q", idx, e.Path, entry.Path)
+		}
+		actualChecksum := ""
+		if entry.checksum != nil {
+			actualChecksum = entry.checksum.String()
+		}
+		if actualChecksum != e.Checksum {
+			t.Errorf("entry %d: expected checksum %q, got %q", idx, e.Checksum, actualChecksum)
+		}
+	}
+
+	invalidInputs := []string{
+		"example.com/foo",                               //not an absolute URL
+		"https://example.com/",                          //no file name
+		"https://example.com/foo ../bar",                //path escapes from the container
+		"https://example.com/foo bar baz",               //too many paths
+		"https://example.com/foo sha256:0123456789abcd", //wrong digest size
+	}
+	for _, input := range invalidInputs {
+		_, err := parseManifest([]byte(input), "text")
+		if err == nil {
+			t.Errorf("expected manifest %q to be rejected, but it was accepted", input)
+		}
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	checksum, err := ParseChecksum("sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//read in the smallest possible chunks to exercise the lookahead logic
+	testcases := map[string]bool{"foo": true, "bar": false, "fo": false, "fooo": false}
+	for input, isValid := range testcases {
+		reader := checksum.VerifyingReader(ioutil.NopCloser(strings.NewReader(input)), "test")
+		buf, err := ioutil.ReadAll(iotest.OneByteReader(reader))
+		if string(buf) != input {
+			t.Errorf("expected to read %q, got %q", input, string(buf))
+		}
+		if isValid && err != nil {
+			t.Errorf("expected %q to match the checksum, but got error: %s", input, err.Error())
+		}
+		if !isValid && err == nil {
+			t.Errorf("expected checksum mismatch for %q, but got no error", input)
+		}
+	}
+}
+
+func TestManifestEntryOnUnreachableHost(t *testing.T) {
+	//obtain the URL of a closed port
+	server := httptest.NewServer(nil)
+	unreachableURL := server.URL + "/file.txt"
+	server.Close()
+
+	dir, err := ioutil.TempDir("", "swift-http-import-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	manifestPath := filepath.Join(dir, "manifest.txt")
+	err = ioutil.WriteFile(manifestPath, []byte(unreachableURL+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	segmenting := false
+	source := &ManifestSource{Manifest: manifestPath, SegmentingIn: &segmenting}
+	errs := source.Validate("jobs[0].from")
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err = source.Connect("jobs[0].from")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	files, lerr := source.ListAllFiles()
+	if lerr != nil {
+		t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	//this used to panic because of a nil response
+	body, _, err := source.GetFile(files[0].Path, schwift.NewObjectHeaders())
+	if err == nil {
+		body.Close()
+		t.Error("expected GET on unreachable host to fail, but it succeeded")
+	}
+}
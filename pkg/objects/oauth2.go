@@ -0,0 +1,130 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+//OAuth2ClientCredentials contains the configuration for obtaining access
+//tokens with the OAuth2 client credentials grant.
+type OAuth2ClientCredentials struct {
+	TokenURL       string            `yaml:"token_url"`
+	ClientID       string            `yaml:"client_id"`
+	ClientSecret   AuthPassword      `yaml:"client_secret"`
+	Scopes         []string          `yaml:"scopes"`
+	EndpointParams map[string]string `yaml:"params"`
+}
+
+//Validate reports errors in the OAuth2ClientCredentials options.
+func (c OAuth2ClientCredentials) Validate(name string) (result []error) {
+	if c.TokenURL == "" {
+		result = append(result, fmt.Errorf("missing value for %s.token_url", name))
+	} else {
+		tokenURL, err := url.Parse(c.TokenURL)
+		if err != nil {
+			result = append(result, fmt.Errorf("invalid value for %s.token_url: %s", name, err.Error()))
+		} else if tokenURL.Scheme != "http" && tokenURL.Scheme != "https" {
+			result = append(result, fmt.Errorf("invalid value for %s.token_url: expected http(s) URL, got %q", name, c.TokenURL))
+		}
+	}
+	if c.ClientID == "" {
+		result = append(result, fmt.Errorf("missing value for %s.client_id", name))
+	}
+	if c.ClientSecret == "" {
+		result = append(result, fmt.Errorf("missing value for %s.client_secret", name))
+	}
+	return
+}
+
+//Tokens are refreshed this long before they expire, so that requests do not
+//fail because the token expires while they are in flight.
+const oauth2TokenRefreshMargin = time.Minute
+
+//oauth2TokenSource obtains access tokens with the OAuth2 client credentials
+//grant and caches them until shortly before they expire. Unlike the
+//oauth2.TokenSource from the library, it allows to discard tokens that were
+//rejected by the server before they expire.
+type oauth2TokenSource struct {
+	config clientcredentials.Config
+	//the HTTP client for talking to the token endpoint
+	client *http.Client
+	//the current token, or nil if a new token needs to be obtained
+	token *oauth2.Token
+	mutex sync.Mutex
+}
+
+func newOAuth2TokenSource(c OAuth2ClientCredentials, client *http.Client) *oauth2TokenSource {
+	params := make(url.Values, len(c.EndpointParams))
+	for key, value := range c.EndpointParams {
+		params.Set(key, value)
+	}
+	return &oauth2TokenSource{
+		config: clientcredentials.Config{
+			ClientID:       c.ClientID,
+			ClientSecret:   string(c.ClientSecret),
+			TokenURL:       c.TokenURL,
+			Scopes:         c.Scopes,
+			EndpointParams: params,
+		},
+		client: client,
+	}
+}
+
+//Token returns a valid access token, obtaining a new one if necessary.
+func (s *oauth2TokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != nil {
+		if s.token.Expiry.IsZero() || time.Until(s.token.Expiry) > oauth2TokenRefreshMargin {
+			return s.token, nil
+		}
+	}
+
+	logg.Debug("requesting OAuth2 access token from %s", s.config.TokenURL)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, s.client)
+	token, err := s.config.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain OAuth2 access token: %s", err.Error())
+	}
+	s.token = token
+	return token, nil
+}
+
+//Invalidate discards the given token if it is still the current one, so that
+//the next call to Token() obtains a new token. This is called when the server
+//rejects a token before its expiry time.
+func (s *oauth2TokenSource) Invalidate(token *oauth2.Token) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token == token {
+		s.token = nil
+	}
+}
@@ -0,0 +1,139 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//SymlinkRoot implements the SymlinkSource interface.
+func (u URLSource) SymlinkRoot() (namespace, rootPath string, err error) {
+	return u.URL.Scheme + "://" + u.URL.Host, u.URL.Path, nil
+}
+
+//Returns a copy of this source's HTTP client that records the location of the
+//first redirect that it follows. This is used if RedirectsAsSymlinks is set,
+//so that redirects can be detected without sending additional requests.
+func (u URLSource) clientRecordingRedirects(location **url.URL) *http.Client {
+	client := *u.HTTPClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		//same limit as in the default policy of net/http
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if *location == nil {
+			*location = req.URL
+		}
+		return nil
+	}
+	return &client
+}
+
+//Helper function for URLSource.ListEntries() if RedirectsAsSymlinks is set:
+//If the directory listing redirects to a different directory within the
+//source root, all files in the directory are marked as symlinks to the
+//respective files in the redirect target.
+func (u URLSource) listEntriesDetectingRedirects(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	var location *url.URL
+	recordingSource := u
+	recordingSource.HTTPClient = u.clientRecordingRedirects(&location)
+	files, lerr := recordingSource.listEntries(directoryPath)
+	if lerr != nil || location == nil {
+		return files, lerr
+	}
+
+	targetDirectory := u.redirectTargetPath(u.getURLForPath(directoryPath), location)
+	if targetDirectory == "" {
+		return files, nil
+	}
+	logg.Debug("treating files in %s as symlinks into %s", directoryPath, targetDirectory)
+	for idx, file := range files {
+		if !file.IsDirectory {
+			files[idx].SymlinkTargetPath = path.Join(targetDirectory, path.Base(file.Path))
+		}
+	}
+	return files, nil
+}
+
+//Returns the path of the redirect target relative to the source root, or the
+//empty string if the redirect cannot be represented as a symlink.
+func (u URLSource) redirectTargetPath(uri, location *url.URL) string {
+	//only same-origin redirects without query can be represented as symlinks
+	if location.Scheme != u.URL.Scheme || location.Host != u.URL.Host || location.RawQuery != "" {
+		return ""
+	}
+	//the target must be within the source root
+	if !strings.HasPrefix(location.Path, u.URL.Path) {
+		return ""
+	}
+	//redirects that only add a trailing slash (which is common for
+	//directories) are not symlinks
+	if strings.TrimSuffix(location.Path, "/") == strings.TrimSuffix(uri.Path, "/") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(location.Path, u.URL.Path), "/")
+}
+
+//Helper function for File.transferToTargets(): If the source redirected the
+//GET request to a different file of the same job (see
+//URLSource.RedirectsAsSymlinks), the file is uploaded as a symlink to that
+//file instead, and true is returned. If the file cannot be uploaded as a
+//symlink, false is returned and the file is transferred normally.
+func (f File) transferRedirectAsSymlink(targets []*transferTarget, sourceState FileState) bool {
+	if sourceState.SymlinkTargetPath == "" {
+		return false
+	}
+	targetPath := "/" + sourceState.SymlinkTargetPath
+
+	//the redirect target must be transferred by this job (the GET response
+	//describes the redirect target, so we know its actual modification time)
+	var lastModified *time.Time
+	if t, err := http.ParseTime(sourceState.LastModified); err == nil {
+		lastModified = &t
+	}
+	if f.Job.Matcher.CheckRecursive(targetPath, lastModified) != nil {
+		logg.Debug("transferring %s as a regular file: redirect target %s is not transferred by this job", f.Spec.Path, targetPath)
+		return false
+	}
+	for _, t := range targets {
+		capabilities, err := t.Location.Container.Account().Capabilities()
+		if err != nil {
+			logg.Fatal("query /info on target failed: %s", err.Error())
+		}
+		if capabilities.Symlink == nil {
+			return false
+		}
+	}
+
+	//NOTE: The symlink does not get any Source-* metadata, so the next run will
+	//do an unconditional GET again to check whether the redirect still exists.
+	for _, t := range targets {
+		t.Result = f.uploadSymlink(t, t.Location.ObjectAtPath(targetPath), schwift.NewObjectHeaders())
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedirectsAsSymlinks(t *testing.T) {
+	listings := map[string]string{
+		"/pub/":       `<a href="1.2.3/">1.2.3/</a> <a href="latest/">latest/</a> <a href="1.2.3.tar.gz">1.2.3.tar.gz</a> <a href="current.tar.gz">current.tar.gz</a> <a href="external.tar.gz">external.tar.gz</a>`,
+		"/pub/1.2.3/": `<a href="foo.txt">foo.txt</a>`,
+	}
+	redirects := map[string]string{
+		"/pub/latest/":         "/pub/1.2.3/",
+		"/pub/current.tar.gz":  "/pub/1.2.3.tar.gz",
+		"/pub/external.tar.gz": "/other/external.tar.gz",
+	}
+	var (
+		mutex    sync.Mutex
+		requests = make(map[string]int)
+	)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mutex.Unlock()
+		if target, exists := redirects[r.URL.Path]; exists {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		if listing, exists := listings[r.URL.Path]; exists {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(listing))
+			return
+		}
+		w.Write([]byte("contents of " + r.URL.Path))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	compile := func(redirectsAsSymlinks bool, extraConfig string) *Job {
+		t.Helper()
+		configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/pub/
+  redirects_as_symlinks: %[2]t
+to:
+  storage_url: %[3]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+%[4]s`, source.URL, redirectsAsSymlinks, swift.URL, extraConfig)
+		return compileTestJob(t, configYAML)
+	}
+	expectSymlinks := func(job *Job, directoryPath string, expected map[string]string) {
+		t.Helper()
+		files, lerr := job.Source.ListEntries(directoryPath)
+		if lerr != nil {
+			t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+		}
+		actual := make(map[string]string)
+		for _, file := range files {
+			actual[file.Path] = file.SymlinkTargetPath
+		}
+		for filePath, targetPath := range expected {
+			if actual[filePath] != targetPath {
+				t.Errorf("expected %s to have symlink target %q, got %q", filePath, targetPath, actual[filePath])
+			}
+		}
+	}
+	expectTransfer := func(job *Job, filePath, expectedSymlinkTarget string) {
+		t.Helper()
+		results, _ := File{Job: job, Spec: FileSpec{Path: filePath}}.PerformTransfer(job.Targets)
+		if results[0] == TransferFailed {
+			t.Fatalf("transfer of %s failed", filePath)
+		}
+		obj := swift.object("AUTH_test/mirror" + filePath)
+		if obj == nil {
+			t.Fatalf("%s was not uploaded", filePath)
+		}
+		if target := obj.Headers.Get("X-Symlink-Target"); target != expectedSymlinkTarget {
+			t.Errorf("expected %s to have symlink target %q, got %q", filePath, expectedSymlinkTarget, target)
+		}
+	}
+
+	//redirects are only recorded as symlinks if enabled
+	job := compile(false, "")
+	expectSymlinks(job, "/latest/", map[string]string{
+		"/latest/foo.txt": "",
+	})
+	expectTransfer(job, "/current.tar.gz", "")
+
+	//when the directory listing redirects to a different directory within the
+	//source root, files therein refer to the files in the redirect target
+	job = compile(true, "")
+	expectSymlinks(job, "/", map[string]string{
+		"/1.2.3/":          "",
+		"/latest/":         "",
+		"/1.2.3.tar.gz":    "",
+		"/current.tar.gz":  "",
+		"/external.tar.gz": "",
+	})
+	expectSymlinks(job, "/latest/", map[string]string{
+		"/latest/foo.txt": "1.2.3/foo.txt",
+	})
+	expectSymlinks(job, "/1.2.3/", map[string]string{
+		"/1.2.3/foo.txt": "",
+	})
+
+	//the symlink target can be resolved to the file in the same job
+	link := File{Job: job, Spec: FileSpec{Path: "/latest/foo.txt", SymlinkTargetPath: "1.2.3/foo.txt"}}
+	namespace, targetPath, ok := link.SymlinkTargetLocation()
+	if !ok {
+		t.Fatal("expected symlink target location to be known")
+	}
+	filePath, ok := job.PathInSource(namespace, targetPath)
+	if !ok || filePath != "/1.2.3/foo.txt" {
+		t.Errorf("expected symlink target to be /1.2.3/foo.txt, got %q (ok = %t)", filePath, ok)
+	}
+
+	//when the GET for a file redirects to a different file within the source
+	//root, a symlink is uploaded instead (the existing regular file is replaced)
+	expectTransfer(job, "/current.tar.gz", "mirror/1.2.3.tar.gz")
+	expectTransfer(job, "/external.tar.gz", "")
+	expectTransfer(job, "/1.2.3.tar.gz", "")
+
+	//symlinks are only uploaded if the redirect target is transferred by the same job
+	job = compile(true, "except: 1\\.2\\.3\\.tar\\.gz$\n")
+	expectTransfer(job, "/current.tar.gz", "")
+
+	//redirects are detected without additional requests
+	mutex.Lock()
+	defer mutex.Unlock()
+	for request, count := range requests {
+		if strings.HasPrefix(request, "HEAD ") {
+			t.Errorf("expected no HEAD requests, but got %d for %s", count, request)
+		}
+	}
+}
@@ -0,0 +1,703 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+)
+
+//Returns whether the file can be uploaded with parallel segment uploads (see
+//SegmentingConfiguration.Parallelism).
+func (f File) canUploadInParallel(targets []*transferTarget, sourceState FileState) bool {
+	sc := f.Job.Segmenting
+	if sc == nil || sc.Parallelism <= 1 || f.Spec.Contents != nil || !sourceState.SupportsRanges {
+		return false
+	}
+	if _, ok := f.Job.Source.(RangeSource); !ok {
+		return false
+	}
+	//delta updates parallelize the upload of changed segments by themselves
+	for _, t := range targets {
+		if f.canUploadDelta(t, sourceState) {
+			return false
+		}
+	}
+	size := sourceState.SizeBytes
+	return size > 0 && uint64(size) >= sc.MinObjectSize && uint64(size) > sc.SegmentSize
+}
+
+//parallelUpload contains the state of an upload of a large object whose
+//segments are uploaded concurrently. The first segment is read from the body
+//of the original GET request, all other segments are downloaded with
+//separate range requests. Segments are streamed from the source into the
+//targets directly, so memory usage does not depend on the segment size.
+type parallelUpload struct {
+	File         File
+	Targets      []*transferTarget
+	LargeObjects []*schwift.LargeObject //same order as Targets, nil if AsNewLargeObject() failed
+	SourceState  FileState
+	Headers      schwift.ObjectHeaders //headers for the manifests
+	SegmentSize  int64
+	//the following fields are filled while segments are uploaded
+	SegmentEtags []string //hex-encoded MD5 of each segment
+	Failed       []bool   //same order as Targets
+	//number of segments that were already uploaded into each target by an
+	//earlier, interrupted upload (same order as Targets)
+	ResumedCounts []int
+	mutex         sync.Mutex
+}
+
+//Uploads the file into the given targets as large objects, with the segments
+//being uploaded in parallel. The result for each target is written into
+//t.Result.
+func (f File) uploadInParallel(targets []*transferTarget, body io.Reader, sourceState FileState, hdr schwift.ObjectHeaders) {
+	u := &parallelUpload{
+		File:         f,
+		Targets:      targets,
+		LargeObjects: make([]*schwift.LargeObject, len(targets)),
+		SourceState:  sourceState,
+		Headers:      hdr,
+		SegmentSize:  int64(f.Job.Segmenting.SegmentSize),
+	}
+	segmentCount := int((sourceState.SizeBytes + u.SegmentSize - 1) / u.SegmentSize)
+	u.SegmentEtags = make([]string, segmentCount)
+	u.Failed = make([]bool, len(targets))
+	u.ResumedCounts = make([]int, len(targets))
+
+	for idx, t := range targets {
+		if util.LogIndividualTransfers {
+			logg.Info("transferring to %s", t.Object.FullName())
+		}
+
+		//if an earlier upload was interrupted, only upload the missing segments
+		strategy := f.largeObjectStrategy(t, sourceState.SizeBytes)
+		resumed := f.findResumableUpload(t, strategy, hdr, sourceState.SizeBytes)
+		segmentPrefix := f.newSegmentPrefix(t.Object, strategy, sourceState.SizeBytes)
+		if resumed != nil {
+			segmentPrefix = resumed.SegmentPrefix
+			u.ResumedCounts[idx] = len(resumed.Segments)
+			for segmentIdx, segment := range resumed.Segments {
+				u.SegmentEtags[segmentIdx] = segment.Etag
+			}
+			logg.Info("resuming upload of %s (%d segments already uploaded)", t.Object.FullName(), len(resumed.Segments))
+		}
+
+		lo, err := t.Object.AsNewLargeObject(schwift.SegmentingOptions{
+			SegmentContainer: t.Location.SegmentContainer,
+			SegmentPrefix:    segmentPrefix,
+			Strategy:         strategy,
+		}, &schwift.TruncateOptions{
+			DeleteSegments: t.Headers.IsLargeObject(),
+		})
+		if err != nil {
+			logg.Error("PUT %s as %s failed: %s", t.Object.FullName(), largeObjectType(strategy), err.Error())
+			u.Failed[idx] = true
+			continue
+		}
+		u.LargeObjects[idx] = lo
+	}
+
+	//upload segments with a fixed number of workers
+	queue := make(chan int, segmentCount)
+	for idx := 0; idx < segmentCount; idx++ {
+		queue <- idx
+	}
+	close(queue)
+	workerCount := int(f.Job.Segmenting.Parallelism)
+	if workerCount > segmentCount {
+		workerCount = segmentCount
+	}
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for idx := 0; idx < workerCount; idx++ {
+		go func() {
+			defer wg.Done()
+			for segmentIdx := range queue {
+				u.uploadSegment(segmentIdx, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	//write manifests for all targets where all segments were uploaded
+	for idx, t := range targets {
+		lo := u.LargeObjects[idx]
+		if lo == nil {
+			t.Result = TransferFailed
+			continue
+		}
+		var err error
+		if u.Failed[idx] {
+			err = fmt.Errorf("could not upload all segments into %s/%s", lo.SegmentContainer().Name(), lo.SegmentPrefix())
+		} else {
+			err = u.writeManifest(idx)
+		}
+		if err != nil {
+			logg.Error("PUT %s as %s failed: %s", t.Object.FullName(), largeObjectType(lo.Strategy()), err.Error())
+			u.cleanup(idx)
+			t.Result = TransferFailed
+			continue
+		}
+		logg.Info("PUT %s has created a %s with segments in %s/%s (%d segments uploaded in parallel)",
+			t.Object.FullName(), largeObjectType(lo.Strategy()), lo.SegmentContainer().Name(), lo.SegmentPrefix(), segmentCount,
+		)
+		t.Result = TransferSuccess
+	}
+}
+
+//Returns the segment object for the given (0-based) segment index in the
+//given large object.
+func segmentObject(lo *schwift.LargeObject, segmentIdx int) *schwift.Object {
+	return lo.SegmentContainer().Object(segmentObjectName(lo.SegmentPrefix(), segmentIdx))
+}
+
+//Returns the name of the segment object for the given (0-based) segment index
+//below the given segment prefix. This is the same naming scheme as in
+//LargeObject.Append().
+func segmentObjectName(prefix string, segmentIdx int) string {
+	return fmt.Sprintf("%s%016d", prefix, segmentIdx+1)
+}
+
+//Returns the size of the segment with the given index.
+func (u *parallelUpload) segmentLength(segmentIdx int) int64 {
+	offset := int64(segmentIdx) * u.SegmentSize
+	if offset+u.SegmentSize > u.SourceState.SizeBytes {
+		return u.SourceState.SizeBytes - offset
+	}
+	return u.SegmentSize
+}
+
+//Returns the large objects of all targets that have not failed yet and still
+//need the segment with the given index.
+func (u *parallelUpload) activeLargeObjects(segmentIdx int) map[int]*schwift.LargeObject {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	result := make(map[int]*schwift.LargeObject)
+	for idx, lo := range u.LargeObjects {
+		if !u.Failed[idx] && segmentIdx >= u.ResumedCounts[idx] {
+			result[idx] = lo
+		}
+	}
+	return result
+}
+
+func (u *parallelUpload) markFailed(targetIdx int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.Failed[targetIdx] = true
+}
+
+//Downloads the segment with the given index from the source and uploads it
+//into all targets that have not failed yet.
+func (u *parallelUpload) uploadSegment(segmentIdx int, body io.Reader) {
+	los := u.activeLargeObjects(segmentIdx)
+	if len(los) == 0 {
+		return
+	}
+
+	//the first segment comes from the original GET request
+	offset := int64(segmentIdx) * u.SegmentSize
+	length := u.segmentLength(segmentIdx)
+	var reader io.Reader
+	if segmentIdx == 0 {
+		reader = io.LimitReader(body, length)
+	} else {
+		rangeSource := u.File.Job.Source.(RangeSource)
+		rangeBody, err := rangeSource.GetFileRange(u.File.Spec.Path, u.SourceState, offset, length)
+		if err != nil {
+			logg.Error(err.Error())
+			for targetIdx := range los {
+				u.markFailed(targetIdx)
+			}
+			return
+		}
+		defer rangeBody.Close()
+		reader = rangeBody
+	}
+
+	hasher := md5.New()
+	reader = io.TeeReader(reader, hasher)
+
+	segmentHeaders := u.File.segmentHeadersFor(u.Headers)
+	segmentHeaders.SizeBytes().Set(uint64(length))
+	opts := segmentHeaders.ToOpts()
+	var consumers []func(io.Reader)
+	for targetIdx, lo := range los {
+		targetIdx := targetIdx
+		segment := segmentObject(lo, segmentIdx)
+		consumers = append(consumers, func(r io.Reader) {
+			err := segment.Upload(r, nil, opts)
+			if err != nil {
+				logg.Error("PUT %s failed: %s", segment.FullName(), err.Error())
+				u.markFailed(targetIdx)
+			}
+		})
+	}
+	util.FanOut(reader, consumers...)
+
+	u.mutex.Lock()
+	u.SegmentEtags[segmentIdx] = hex.EncodeToString(hasher.Sum(nil))
+	u.mutex.Unlock()
+}
+
+//Writes the manifest for the large object in the given target.
+func (u *parallelUpload) writeManifest(targetIdx int) error {
+	lo := u.LargeObjects[targetIdx]
+	for segmentIdx, etag := range u.SegmentEtags {
+		err := lo.AddSegment(schwift.SegmentInfo{
+			Object:    segmentObject(lo, segmentIdx),
+			SizeBytes: uint64(u.segmentLength(segmentIdx)),
+			Etag:      etag,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return lo.WriteManifest(u.Headers.ToOpts())
+}
+
+//Deletes the target object after a failed upload. The segments that were
+//uploaded completely are kept, so that the next run can resume the upload.
+func (u *parallelUpload) cleanup(targetIdx int) {
+	cleanupFailedUpload(u.Targets[targetIdx].Object)
+}
+
+//resumableUpload describes the segments of an earlier upload of a large
+//object that was interrupted before the manifest could be written.
+type resumableUpload struct {
+	SegmentPrefix string
+	//the segments that were uploaded completely, in order
+	Segments []schwift.SegmentInfo
+}
+
+//The default for SegmentingConfiguration.SegmentPrefix. It follows the
+//conventions of the Swift CLI, so that an interrupted upload can be identified
+//by its object size and segment size.
+const defaultSegmentPrefix = "{object}/{strategy}/{timestamp}/{size}/{segment_size}/"
+
+var segmentPrefixPlaceholderRx = regexp.MustCompile(`\{[a-z_]+\}`)
+
+//The placeholders that can be used in SegmentingConfiguration.SegmentPrefix.
+//When looking for segments of earlier uploads, placeholders without a known
+//value are matched with these patterns. (The object name is captured, so that
+//the object can be identified from the names of its segments.)
+var segmentPrefixPlaceholders = map[string]string{
+	"{object}":       `(.+)`,
+	"{strategy}":     `(?:slo|dlo)`,
+	"{timestamp}":    `[0-9]+\.[0-9]{9}`,
+	"{size}":         `[0-9]+`,
+	"{segment_size}": `[0-9]+`,
+}
+
+func validateSegmentPrefix(template string) error {
+	for _, placeholder := range segmentPrefixPlaceholderRx.FindAllString(template, -1) {
+		if _, exists := segmentPrefixPlaceholders[placeholder]; !exists {
+			return fmt.Errorf("unknown placeholder %s", placeholder)
+		}
+	}
+	//segments must be listed below the object name, and each upload must have
+	//its own prefix (otherwise, DLO manifests would pick up foreign segments)
+	switch {
+	case !strings.HasPrefix(template, "{object}/"):
+		return errors.New("must start with {object}/")
+	case !strings.Contains(template, "{timestamp}"):
+		return errors.New("must contain {timestamp}")
+	case !strings.HasSuffix(template, "/"):
+		return errors.New("must end with a slash")
+	}
+	return nil
+}
+
+//Replaces the placeholders in the given segment prefix template by the given
+//values.
+func expandSegmentPrefix(template string, values map[string]string) string {
+	return segmentPrefixPlaceholderRx.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[placeholder]
+	})
+}
+
+//Returns a regex that matches all segment prefixes that can be generated from
+//the given template with the given values. Placeholders without a value match
+//any value.
+func segmentPrefixRegexp(template string, values map[string]string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	lastIdx := 0
+	for _, match := range segmentPrefixPlaceholderRx.FindAllStringIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[lastIdx:match[0]]))
+		placeholder := template[match[0]:match[1]]
+		if value, exists := values[placeholder]; exists {
+			pattern.WriteString(regexp.QuoteMeta(value))
+		} else {
+			pattern.WriteString(segmentPrefixPlaceholders[placeholder])
+		}
+		lastIdx = match[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[lastIdx:]))
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+//Returns the part of the segment prefix template that is the same for all
+//uploads of the given object, with placeholders expanded.
+func segmentPrefixListingPrefix(template, objectName string) string {
+	values := map[string]string{"{object}": objectName}
+	for _, match := range segmentPrefixPlaceholderRx.FindAllStringIndex(template, -1) {
+		if template[match[0]:match[1]] != "{object}" {
+			return expandSegmentPrefix(template[:match[0]], values)
+		}
+	}
+	return expandSegmentPrefix(template, values)
+}
+
+//Splits the segment index (as generated by LargeObject.Append()) from the
+//given segment name, and returns the remaining segment prefix.
+func segmentPrefixOf(segmentName string) (string, bool) {
+	if len(segmentName) <= 16 {
+		return "", false
+	}
+	idx := len(segmentName) - 16
+	for _, c := range segmentName[idx:] {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return segmentName[:idx], true
+}
+
+//Returns the values for the placeholders in the segment prefix template,
+//except for the timestamp.
+func (f File) segmentPrefixValues(object *schwift.Object, strategy schwift.LargeObjectStrategy, sizeBytes int64) map[string]string {
+	strategyName := "slo"
+	if strategy == schwift.DynamicLargeObject {
+		strategyName = "dlo"
+	}
+	return map[string]string{
+		"{object}":       object.Name(),
+		"{strategy}":     strategyName,
+		"{size}":         strconv.FormatInt(sizeBytes, 10),
+		"{segment_size}": strconv.FormatUint(f.Job.Segmenting.SegmentSize, 10),
+	}
+}
+
+//Returns the segment prefix for a new upload of the given object.
+func (f File) newSegmentPrefix(object *schwift.Object, strategy schwift.LargeObjectStrategy, sizeBytes int64) string {
+	now := time.Now()
+	values := f.segmentPrefixValues(object, strategy, sizeBytes)
+	values["{timestamp}"] = fmt.Sprintf("%d.%09d", now.Unix(), now.Nanosecond())
+	return expandSegmentPrefix(f.Job.Segmenting.SegmentPrefix, values)
+}
+
+//Returns the strategy for uploading a file of the given size into the given
+//target as a large object. If the target cluster limits the size of SLO
+//manifests and the manifest for this file would be too large, DLO is used
+//instead (unless SLO was requested explicitly).
+func (f File) largeObjectStrategy(t *transferTarget, sizeBytes int64) schwift.LargeObjectStrategy {
+	loc := t.Location
+	if loc.LargeObjectStrategy != schwift.StaticLargeObject || f.Job.Segmenting.Strategy != "" {
+		return loc.LargeObjectStrategy
+	}
+
+	segmentSize := f.Job.Segmenting.SegmentSize
+	segmentCount := (uint64(sizeBytes) + segmentSize - 1) / segmentSize
+	//rough estimate for the size of one manifest entry: the segment path, the
+	//segment prefix generated from the template, the etag and the size
+	entrySize := uint64(len(loc.SegmentContainer.Name()) + len(f.Job.Segmenting.SegmentPrefix) + len(t.Object.Name()) + 128)
+	tooManySegments := loc.MaxManifestSegments > 0 && segmentCount > uint64(loc.MaxManifestSegments)
+	tooLarge := loc.MaxManifestSize > 0 && segmentCount*entrySize > uint64(loc.MaxManifestSize)
+	if tooManySegments || tooLarge {
+		logg.Info("uploading %s as Dynamic Large Object: an SLO manifest with %d segments exceeds the limits of the cluster",
+			t.Object.FullName(), segmentCount)
+		return schwift.DynamicLargeObject
+	}
+	return schwift.StaticLargeObject
+}
+
+func largeObjectType(strategy schwift.LargeObjectStrategy) string {
+	if strategy == schwift.DynamicLargeObject {
+		return "Dynamic Large Object"
+	}
+	return "Static Large Object"
+}
+
+//Prepares the given target for jobs with segmenting: The large object
+//strategy is chosen based on the capabilities of the target cluster, and the
+//segment container is created if necessary.
+func (s *SwiftLocation) prepareSegmenting(sc SegmentingConfiguration, jobName, name string) error {
+	caps, err := s.Account.Capabilities()
+	if err != nil {
+		return fmt.Errorf("cannot query capabilities of %s: %s", name, err.Error())
+	}
+
+	slo := caps.StaticLargeObject
+	switch {
+	case sc.Strategy == "dlo":
+		s.LargeObjectStrategy = schwift.DynamicLargeObject
+	case slo != nil:
+		if sc.SegmentSize < uint64(slo.MinimumSegmentSize) {
+			return fmt.Errorf("invalid value for %s.segmenting.segment_bytes: %s requires segments of at least %d bytes",
+				jobName, name, slo.MinimumSegmentSize)
+		}
+		s.LargeObjectStrategy = schwift.StaticLargeObject
+		s.MaxManifestSegments = slo.MaximumManifestSegments
+		s.MaxManifestSize = slo.MaximumManifestSize
+	case sc.Strategy == "slo":
+		return fmt.Errorf("invalid value for %s.segmenting.strategy: %s does not support Static Large Objects", jobName, name)
+	default:
+		logg.Info("%s does not support Static Large Objects, will upload large objects as Dynamic Large Objects instead", name)
+		s.LargeObjectStrategy = schwift.DynamicLargeObject
+	}
+	if maxSize := caps.Swift.MaximumFileSize; maxSize > 0 && sc.SegmentSize > uint64(maxSize) {
+		return fmt.Errorf("invalid value for %s.segmenting.segment_bytes: %s does not accept objects larger than %d bytes",
+			jobName, name, maxSize)
+	}
+	s.SegmentPrefix = sc.SegmentPrefix
+
+	//unless specified otherwise, each target has its own segment container
+	containerName := sc.ContainerName
+	if containerName == "" {
+		containerName = s.ContainerName + "_segments"
+	}
+	container := s.Account.Container(containerName)
+	if sc.StoragePolicy == "" {
+		s.SegmentContainer, err = container.EnsureExists()
+		return err
+	}
+
+	if len(caps.Swift.Policies) > 0 && !hasStoragePolicy(caps.Swift.Policies, sc.StoragePolicy) {
+		return fmt.Errorf("invalid value for %s.segmenting.storage_policy: %s does not have a storage policy named %q",
+			jobName, name, sc.StoragePolicy)
+	}
+	hdr := schwift.NewContainerHeaders()
+	hdr.StoragePolicy().Set(sc.StoragePolicy)
+	err = container.Create(hdr.ToOpts())
+	if schwift.Is(err, http.StatusConflict) {
+		return fmt.Errorf("cannot use storage policy %q for segment container %s: container already exists with a different storage policy",
+			sc.StoragePolicy, containerName)
+	}
+	if err != nil {
+		return err
+	}
+	s.SegmentContainer = container
+	return nil
+}
+
+func hasStoragePolicy(policies []schwift.StoragePolicySpec, name string) bool {
+	for _, policy := range policies {
+		if policy.Name == name {
+			return true
+		}
+		for _, alias := range strings.Split(policy.Aliases, ",") {
+			if strings.TrimSpace(alias) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Returns the headers for uploading segments of a large object with the given
+//headers. Segments are tagged with the same Source-Etag and
+//Source-Last-Modified as the large object, so that an interrupted upload can
+//be resumed if the source file has not changed in the meantime.
+func (f File) segmentHeadersFor(hdr schwift.ObjectHeaders) schwift.ObjectHeaders {
+	result := schwift.NewObjectHeaders()
+	if hdr.ExpiresAt().Exists() {
+		delay := time.Duration(f.Job.Segmenting.ExpiryDelaySeconds) * time.Second
+		result.ExpiresAt().Set(hdr.ExpiresAt().Get().Add(delay))
+	}
+	for _, key := range []string{"Source-Etag", "Source-Last-Modified"} {
+		if val := hdr.Metadata().Get(key); val != "" {
+			result.Metadata().Set(key, val)
+		}
+	}
+	return result
+}
+
+//Looks for segments of an earlier upload of this file into the given target
+//that can be reused. Segments of other interrupted uploads (e.g. for an older
+//version of the source file) are deleted.
+func (f File) findResumableUpload(t *transferTarget, strategy schwift.LargeObjectStrategy, hdr schwift.ObjectHeaders, sizeBytes int64) *resumableUpload {
+	template := f.Job.Segmenting.SegmentPrefix
+	segmentContainer := t.Location.SegmentContainer
+	iter := segmentContainer.Objects()
+	iter.Prefix = segmentPrefixListingPrefix(template, t.Object.Name())
+	infos, err := iter.CollectDetailed()
+	if err != nil {
+		logg.Error("could not list segments in %s/%s: %s", segmentContainer.Name(), iter.Prefix, err.Error())
+		return nil
+	}
+	if len(infos) == 0 {
+		return nil
+	}
+
+	//group segments by upload (objects that do not look like segments of this
+	//object, e.g. segments of other objects with the same name prefix, are
+	//ignored)
+	isOwnPrefix := segmentPrefixRegexp(template, map[string]string{"{object}": t.Object.Name()})
+	segmentsByPrefix := make(map[string]map[string]schwift.ObjectInfo)
+	for _, info := range infos {
+		name := info.Object.Name()
+		prefix, ok := segmentPrefixOf(name)
+		if !ok || !isOwnPrefix.MatchString(prefix) {
+			continue
+		}
+		if segmentsByPrefix[prefix] == nil {
+			segmentsByPrefix[prefix] = make(map[string]schwift.ObjectInfo)
+		}
+		segmentsByPrefix[prefix][name] = info
+	}
+
+	//segments of the current version of the target object must not be touched
+	//(and cannot be resumed, since they are deleted when the new version is
+	//uploaded)
+	isInUse := make(map[string]bool)
+	isPrefixInUse := make(map[string]bool)
+	if t.Headers.IsLargeObject() {
+		lo, err := t.Object.AsLargeObject()
+		if err != nil {
+			logg.Error("could not read manifest of %s: %s", t.Object.FullName(), err.Error())
+			return nil
+		}
+		for _, segment := range lo.SegmentObjects() {
+			isInUse[segment.Name()] = true
+			if prefix, ok := segmentPrefixOf(segment.Name()); ok {
+				isPrefixInUse[prefix] = true
+			}
+		}
+	}
+
+	//consider the most recent upload first
+	prefixes := make([]string, 0, len(segmentsByPrefix))
+	for prefix := range segmentsByPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+
+	var (
+		result      *resumableUpload
+		stale       []*schwift.Object
+		isResumable = segmentPrefixRegexp(template, f.segmentPrefixValues(t.Object, strategy, sizeBytes))
+	)
+	for _, prefix := range prefixes {
+		if result == nil && isResumable.MatchString(prefix) && !isPrefixInUse[prefix] {
+			result = f.checkResumableUpload(prefix, segmentsByPrefix[prefix], hdr, sizeBytes)
+			if result != nil {
+				continue
+			}
+		}
+		for name, info := range segmentsByPrefix[prefix] {
+			if !isInUse[name] {
+				stale = append(stale, info.Object)
+			}
+		}
+	}
+
+	if len(stale) > 0 {
+		_, _, err := segmentContainer.Account().BulkDelete(stale, nil, nil)
+		if err != nil {
+			logg.Error("could not delete stale segments in %s/%s: %s", segmentContainer.Name(), iter.Prefix, err.Error())
+		}
+	}
+	return result
+}
+
+//Checks whether the segments below the given prefix belong to an interrupted
+//upload of the same version of the source file.
+func (f File) checkResumableUpload(prefix string, segments map[string]schwift.ObjectInfo, hdr schwift.ObjectHeaders, sizeBytes int64) *resumableUpload {
+	segmentSize := int64(f.Job.Segmenting.SegmentSize)
+	//collect the segments that were uploaded completely
+	result := &resumableUpload{SegmentPrefix: prefix}
+	for offset := int64(0); offset < sizeBytes; offset += segmentSize {
+		info, exists := segments[segmentObjectName(prefix, len(result.Segments))]
+		expectedSize := segmentSize
+		if offset+segmentSize > sizeBytes {
+			expectedSize = sizeBytes - offset
+		}
+		if !exists || info.SizeBytes != uint64(expectedSize) {
+			break
+		}
+		result.Segments = append(result.Segments, schwift.SegmentInfo{
+			Object:    info.Object,
+			SizeBytes: info.SizeBytes,
+			Etag:      info.Etag,
+		})
+	}
+	if len(result.Segments) == 0 {
+		return nil
+	}
+
+	//check that the segments were uploaded from the same version of the source file
+	segmentHdr, err := result.Segments[0].Object.Headers()
+	if err != nil {
+		logg.Error("HEAD %s failed: %s", result.Segments[0].Object.FullName(), err.Error())
+		return nil
+	}
+	expected := hdr.Metadata()
+	actual := segmentHdr.Metadata()
+	switch {
+	case expected.Get("Source-Etag") != "":
+		if expected.Get("Source-Etag") != actual.Get("Source-Etag") {
+			return nil
+		}
+	case expected.Get("Source-Last-Modified") != "":
+		if expected.Get("Source-Last-Modified") != actual.Get("Source-Last-Modified") {
+			return nil
+		}
+	default:
+		//cannot tell if the source file has changed
+		return nil
+	}
+	return result
+}
+
+//Returns a reader for the remainder of the file after the given offset. If
+//possible, the remainder is downloaded with a range request. Otherwise, the
+//part before the offset is read from the body and discarded. The returned
+//io.Closer (if not nil) must be closed by the caller.
+func (f File) resumeReader(body io.Reader, sourceState FileState, offset int64, canSeek bool) (io.Reader, io.Closer, error) {
+	if offset >= sourceState.SizeBytes {
+		//only the manifest is missing
+		return strings.NewReader(""), nil, nil
+	}
+	rangeSource, ok := f.Job.Source.(RangeSource)
+	if canSeek && ok && sourceState.SupportsRanges && f.Spec.Contents == nil {
+		rangeBody, err := rangeSource.GetFileRange(f.Spec.Path, sourceState, offset, sourceState.SizeBytes-offset)
+		return rangeBody, rangeBody, err
+	}
+	_, err := io.CopyN(ioutil.Discard, body, offset)
+	return body, nil, err
+}
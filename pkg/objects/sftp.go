@@ -0,0 +1,397 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//SFTPSource is a source that's accessible via SFTP.
+type SFTPSource struct {
+	//options from config file
+	URLString            string       `yaml:"url"`
+	Password             AuthPassword `yaml:"password"`
+	PrivateKeyPath       string       `yaml:"private_key"`
+	PrivateKeyPassphrase AuthPassword `yaml:"private_key_passphrase"`
+	KnownHostsPath       string       `yaml:"known_hosts"`
+	//compiled configuration
+	url          *url.URL          `yaml:"-"`
+	clientConfig *ssh.ClientConfig `yaml:"-"`
+	//connection state (the connection is shared by all transfer workers, and
+	//is re-established after connection errors)
+	client      *sftp.Client `yaml:"-"`
+	clientMutex sync.Mutex   `yaml:"-"`
+}
+
+//Validate implements the Source interface.
+func (s *SFTPSource) Validate(name string) (result []error) {
+	var err error
+	s.url, err = url.Parse(s.URLString)
+	if err != nil {
+		return []error{fmt.Errorf("invalid value for %s.url: %s", name, err.Error())}
+	}
+	if s.url.Scheme != "sftp" || s.url.Host == "" {
+		result = append(result, fmt.Errorf(`invalid value for %s.url: expected "sftp://user@host/path/", got %q`, name, s.URLString))
+	}
+	if s.url.User == nil || s.url.User.Username() == "" {
+		result = append(result, fmt.Errorf("invalid value for %s.url: missing user name", name))
+	}
+	if _, hasPassword := s.url.User.Password(); hasPassword {
+		result = append(result, fmt.Errorf("invalid value for %s.url: password must be given in %s.password instead", name, name))
+	}
+	if s.url.Port() == "" {
+		s.url.Host = net.JoinHostPort(s.url.Hostname(), "22")
+	}
+	if !strings.HasSuffix(s.url.Path, "/") {
+		s.url.Path += "/"
+	}
+
+	if s.Password == "" && s.PrivateKeyPath == "" {
+		result = append(result, fmt.Errorf("missing value for %s.password or %s.private_key", name, name))
+	}
+	if s.PrivateKeyPassphrase != "" && s.PrivateKeyPath == "" {
+		result = append(result, fmt.Errorf("missing value for %s.private_key", name))
+	}
+	if s.KnownHostsPath == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			result = append(result, fmt.Errorf("missing value for %s.known_hosts", name))
+		} else {
+			s.KnownHostsPath = filepath.Join(homeDir, ".ssh", "known_hosts")
+		}
+	}
+
+	return
+}
+
+//Connect implements the Source interface.
+func (s *SFTPSource) Connect(name string) error {
+	hostKeyCallback, err := knownhosts.New(s.KnownHostsPath)
+	if err != nil {
+		return fmt.Errorf("cannot load known hosts from %s: %s", s.KnownHostsPath, err.Error())
+	}
+
+	var authMethods []ssh.AuthMethod
+	if s.PrivateKeyPath != "" {
+		keyBytes, err := ioutil.ReadFile(s.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("cannot load private key from %s: %s", s.PrivateKeyPath, err.Error())
+		}
+		var signer ssh.Signer
+		if s.PrivateKeyPassphrase == "" {
+			signer, err = ssh.ParsePrivateKey(keyBytes)
+		} else {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(s.PrivateKeyPassphrase))
+		}
+		if err != nil {
+			return fmt.Errorf("cannot load private key from %s: %s", s.PrivateKeyPath, err.Error())
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		authMethods = append(authMethods, ssh.Password(string(s.Password)))
+	}
+
+	s.clientConfig = &ssh.ClientConfig{
+		User:            s.url.User.Username(),
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		ClientVersion:   "SSH-2.0-swift-http-import/" + util.Version,
+		Timeout:         time.Minute,
+	}
+
+	//check that the connection works
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", s.url.Host, err.Error())
+	}
+	_, err = client.Stat(s.url.Path)
+	if err != nil {
+		return fmt.Errorf("cannot access %s: %s", s.url.String(), err.Error())
+	}
+	return nil
+}
+
+//Returns the shared SFTP client, and establishes a new connection if
+//necessary.
+func (s *SFTPSource) getClient() (*sftp.Client, error) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	logg.Debug("connecting to %s", s.url.Host)
+	conn, err := ssh.Dial("tcp", s.url.Host, s.clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	s.client, err = sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s.client, nil
+}
+
+//Discards the given SFTP client after a connection error, so that the next
+//getClient() will reconnect. If another worker has already replaced the client,
+//nothing happens.
+func (s *SFTPSource) dropClient(client *sftp.Client) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if s.client == client {
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+//Returns the path on the server for the given path below the source URL.
+func (s *SFTPSource) getServerPath(relPath string) string {
+	return path.Join(s.url.Path, relPath)
+}
+
+//ListEntries implements the Source interface.
+func (s *SFTPSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	return nil, &ListEntriesError{
+		Location: s.url.String(),
+		Message:  "ListEntries is not implemented for SFTPSource",
+	}
+}
+
+//ListAllFiles implements the Source interface.
+func (s *SFTPSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, &ListEntriesError{s.url.String(), "cannot connect", err}
+	}
+
+	logg.Debug("listing files at %s recursively", s.url.String())
+	var (
+		result      []FileSpec
+		failedPaths []string
+		firstErr    error
+	)
+	walker := client.Walk(s.url.Path)
+	for walker.Step() {
+		err := walker.Err()
+		if err != nil {
+			if _, isStatusError := err.(*sftp.StatusError); !isStatusError {
+				//connection error -> reconnect on the next attempt
+				s.dropClient(client)
+				return nil, &ListEntriesError{s.url.String(), "cannot list " + walker.Path(), err}
+			}
+			//e.g. a permission error on a single directory -> list the others
+			logg.Error("cannot list %s: %s", walker.Path(), err.Error())
+			failedPaths = append(failedPaths, walker.Path())
+			if firstErr == nil {
+				firstErr = err
+			}
+			walker.SkipDir()
+			continue
+		}
+
+		info := walker.Stat()
+		//for symlinks, look at the file that the symlink points to (but do not
+		//follow symlinks to directories, since that can lead to loops)
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = client.Stat(walker.Path())
+			if err != nil {
+				logg.Error("ignoring symlink %s: %s", walker.Path(), err.Error())
+				continue
+			}
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(s.url.Path, "/"))
+		mtime := info.ModTime().UTC()
+		size := info.Size()
+		result = append(result, FileSpec{
+			Path:         relPath,
+			LastModified: &mtime,
+			SizeBytes:    &size,
+		})
+	}
+
+	if len(failedPaths) > 0 {
+		return result, &ListEntriesError{s.url.String(), "cannot list " + strings.Join(failedPaths, ", "), firstErr}
+	}
+	return result, nil
+}
+
+//GetFile implements the Source interface.
+func (s *SFTPSource) GetFile(relPath string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	serverPath := s.getServerPath(relPath)
+	reader := &sftpFileReader{Source: s, Path: serverPath}
+	err := reader.open()
+	if err != nil {
+		return nil, FileState{}, fmt.Errorf("skipping %s: %s", serverPath, err.Error())
+	}
+
+	sourceState := FileState{
+		LastModified: reader.ModTime.Format(http.TimeFormat),
+		SizeBytes:    reader.Size,
+		ExpiryTime:   nil, //no way to get this information via SFTP
+	}
+
+	//emulate the semantics of a conditional GET
+	if val := requestHeaders.Get("If-Modified-Since"); val != "" {
+		ifModifiedSince, err := http.ParseTime(val)
+		if err == nil && !reader.ModTime.Truncate(time.Second).After(ifModifiedSince) {
+			reader.Close()
+			sourceState.SkipTransfer = true
+			return nil, sourceState, nil
+		}
+	}
+
+	return reader, sourceState, nil
+}
+
+//sftpFileReader is an io.ReadCloser that downloads a file via SFTP. When the
+//connection breaks, the download is resumed at the same offset on a new
+//connection, as long as the file does not change in the meantime.
+type sftpFileReader struct {
+	Source *SFTPSource
+	Path   string
+	//the file's attributes when we first opened it (to detect changes between
+	//retries)
+	Size    int64
+	ModTime time.Time
+	//this object's internal state
+	file      *sftp.File
+	bytesRead int64
+	retries   util.ReadRetryCounter
+}
+
+//Opens the file (again), and seeks to the current offset. If the shared
+//connection turns out to be broken, it is re-established once.
+func (r *sftpFileReader) open() error {
+	var file *sftp.File
+	for attempt := 1; ; attempt++ {
+		client, err := r.Source.getClient()
+		if err != nil {
+			return err
+		}
+		file, err = client.Open(r.Path)
+		if err == nil {
+			break
+		}
+		if _, isStatusError := err.(*sftp.StatusError); isStatusError || attempt > 1 {
+			return err
+		}
+		r.Source.dropClient(client)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	mtime := info.ModTime().UTC()
+	if r.ModTime.IsZero() {
+		r.Size = info.Size()
+		r.ModTime = mtime
+	} else if r.Size != info.Size() || !r.ModTime.Equal(mtime) {
+		file.Close()
+		return fmt.Errorf("file has changed mid-transfer: size %d -> %d, mtime %s -> %s",
+			r.Size, info.Size(), r.ModTime.Format(time.RFC3339), mtime.Format(time.RFC3339))
+	}
+
+	if r.bytesRead > 0 {
+		_, err = file.Seek(r.bytesRead, io.SeekStart)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	r.file = file
+	return nil
+}
+
+//Read implements the io.Reader interface.
+func (r *sftpFileReader) Read(buf []byte) (int, error) {
+	if r.bytesRead >= r.Size {
+		return 0, io.EOF
+	}
+	if r.file == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	//never read beyond the size that we reported to the caller
+	if int64(len(buf)) > r.Size-r.bytesRead {
+		buf = buf[:r.Size-r.bytesRead]
+	}
+	n, err := r.file.Read(buf)
+	r.bytesRead += int64(n)
+	if err == io.EOF {
+		if r.bytesRead < r.Size {
+			return n, fmt.Errorf("file has been truncated mid-transfer to %d bytes", r.bytesRead)
+		}
+		return n, io.EOF
+	}
+	if err != nil {
+		if !r.retries.ShouldRetry("SFTP download of "+r.Path, r.bytesRead) {
+			return n, err
+		}
+		logg.Error("restarting SFTP download of %s after read error at offset %d: %s",
+			r.Path, r.bytesRead, err.Error(),
+		)
+		//only reopen this file; the connection is shared with other workers
+		//and is only re-established by open() if it is actually broken
+		r.file.Close()
+		r.file = nil
+		//the next Read() will reopen the file
+		return n, nil
+	}
+	return n, nil
+}
+
+//Close implements the io.Closer interface.
+func (r *sftpFileReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -0,0 +1,418 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//fakeSFTPServer is an in-process SFTP server that serves files from memory.
+type fakeSFTPServer struct {
+	Listener net.Listener
+	HostKey  ssh.Signer
+	mutex    sync.Mutex
+	files    map[string]*fakeSFTPFile //key = absolute path
+	dirs     map[string]bool          //value = false if listing is forbidden
+	//reads of these files fail once when they reach the given offset
+	failReadAt map[string]int64
+}
+
+type fakeSFTPFile struct {
+	Contents []byte
+	ModTime  time.Time
+}
+
+func newFakeSFTPServer(t *testing.T) *fakeSFTPServer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &fakeSFTPServer{
+		Listener:   listener,
+		HostKey:    hostKey,
+		files:      make(map[string]*fakeSFTPFile),
+		dirs:       map[string]bool{"/": true},
+		failReadAt: make(map[string]int64),
+	}
+	go s.acceptConnections()
+	return s
+}
+
+func (s *fakeSFTPServer) Close() {
+	s.Listener.Close()
+}
+
+//Adds a file (and its parent directories) to the server.
+func (s *fakeSFTPServer) addFile(filePath, contents string, mtime time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[filePath] = &fakeSFTPFile{Contents: []byte(contents), ModTime: mtime}
+	for dir := path.Dir(filePath); dir != "/"; dir = path.Dir(dir) {
+		if _, exists := s.dirs[dir]; !exists {
+			s.dirs[dir] = true
+		}
+	}
+}
+
+//Writes a known_hosts file that contains the given host key for this server.
+func (s *fakeSFTPServer) writeKnownHosts(t *testing.T, hostKey ssh.PublicKey) string {
+	t.Helper()
+	file, err := ioutil.TempFile("", "swift-http-import-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Listener.Addr().String())}, hostKey)
+	_, err = file.Write([]byte(line + "\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return file.Name()
+}
+
+func (s *fakeSFTPServer) acceptConnections() {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "partner" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(s.HostKey)
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConnection(conn, config)
+	}
+}
+
+func (s *fakeSFTPServer) serveConnection(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if isSFTP {
+					handler := fakeSFTPHandler{s}
+					server := sftp.NewRequestServer(channel, sftp.Handlers{
+						FileGet:  handler,
+						FilePut:  handler,
+						FileCmd:  handler,
+						FileList: handler,
+					})
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+//fakeSFTPHandler implements the handler interfaces of sftp.RequestServer.
+type fakeSFTPHandler struct {
+	s *fakeSFTPServer
+}
+
+func (h fakeSFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	h.s.mutex.Lock()
+	defer h.s.mutex.Unlock()
+	file, exists := h.s.files[r.Filepath]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return fakeSFTPReader{h.s, r.Filepath, file.Contents}, nil
+}
+
+func (h fakeSFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, os.ErrPermission
+}
+
+func (h fakeSFTPHandler) Filecmd(r *sftp.Request) error {
+	return os.ErrPermission
+}
+
+func (h fakeSFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	h.s.mutex.Lock()
+	defer h.s.mutex.Unlock()
+
+	switch r.Method {
+	case "Stat":
+		if file, exists := h.s.files[r.Filepath]; exists {
+			return fakeSFTPLister{fakeSFTPFileInfo{path.Base(r.Filepath), int64(len(file.Contents)), 0644, file.ModTime}}, nil
+		}
+		if _, exists := h.s.dirs[r.Filepath]; exists {
+			return fakeSFTPLister{fakeSFTPFileInfo{path.Base(r.Filepath), 0, os.ModeDir | 0755, time.Unix(0, 0)}}, nil
+		}
+		return nil, os.ErrNotExist
+	case "List":
+		isListable, exists := h.s.dirs[r.Filepath]
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		if !isListable {
+			return nil, os.ErrPermission
+		}
+		var result fakeSFTPLister
+		for filePath, file := range h.s.files {
+			if path.Dir(filePath) == r.Filepath {
+				result = append(result, fakeSFTPFileInfo{path.Base(filePath), int64(len(file.Contents)), 0644, file.ModTime})
+			}
+		}
+		for dirPath := range h.s.dirs {
+			if dirPath != "/" && path.Dir(dirPath) == r.Filepath {
+				result = append(result, fakeSFTPFileInfo{path.Base(dirPath), 0, os.ModeDir | 0755, time.Unix(0, 0)})
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+		return result, nil
+	default:
+		return nil, os.ErrInvalid
+	}
+}
+
+type fakeSFTPReader struct {
+	s        *fakeSFTPServer
+	path     string
+	contents []byte
+}
+
+func (r fakeSFTPReader) ReadAt(buf []byte, offset int64) (int, error) {
+	r.s.mutex.Lock()
+	failOffset, shouldFail := r.s.failReadAt[r.path]
+	if shouldFail && offset+int64(len(buf)) > failOffset {
+		delete(r.s.failReadAt, r.path)
+		r.s.mutex.Unlock()
+		return 0, errors.New("simulated read error")
+	}
+	r.s.mutex.Unlock()
+
+	if offset >= int64(len(r.contents)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, r.contents[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type fakeSFTPLister []os.FileInfo
+
+func (l fakeSFTPLister) ListAt(buf []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, l[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type fakeSFTPFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i fakeSFTPFileInfo) Name() string       { return i.name }
+func (i fakeSFTPFileInfo) Size() int64        { return i.size }
+func (i fakeSFTPFileInfo) Mode() os.FileMode  { return i.mode }
+func (i fakeSFTPFileInfo) ModTime() time.Time { return i.modTime }
+func (i fakeSFTPFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fakeSFTPFileInfo) Sys() interface{}   { return nil }
+
+////////////////////////////////////////////////////////////////////////////////
+
+func newTestSFTPSource(t *testing.T, server *fakeSFTPServer, knownHostsPath string) *SFTPSource {
+	t.Helper()
+	source := &SFTPSource{
+		URLString:      "sftp://partner@" + server.Listener.Addr().String() + "/outgoing/",
+		Password:       "secret",
+		KnownHostsPath: knownHostsPath,
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	return source
+}
+
+func TestSFTPSource(t *testing.T) {
+	server := newFakeSFTPServer(t)
+	defer server.Close()
+	mtime := time.Date(2020, 10, 12, 10, 0, 0, 0, time.UTC)
+	largeContents := strings.Repeat("0123456789abcdef", 16384) //256 KiB, i.e. several SFTP packets
+	server.addFile("/outgoing/a.txt", "hello", mtime)
+	server.addFile("/outgoing/sub/b.bin", largeContents, mtime.Add(time.Hour))
+	server.addFile("/outgoing/forbidden/c.txt", "secret", mtime)
+	server.addFile("/elsewhere/d.txt", "not below the source URL", mtime)
+	server.dirs["/outgoing/forbidden"] = false
+
+	knownHostsPath := server.writeKnownHosts(t, server.HostKey.PublicKey())
+	defer os.Remove(knownHostsPath)
+	source := newTestSFTPSource(t, server, knownHostsPath)
+	err := source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the recursive listing contains mtimes and sizes; the unreadable directory
+	//is reported, but does not prevent the other files from being listed
+	files, lerr := source.ListAllFiles()
+	if lerr == nil || !strings.Contains(lerr.Message, "/outgoing/forbidden") {
+		t.Errorf("expected error about /outgoing/forbidden, got %#v", lerr)
+	}
+	var lines []string
+	for _, file := range files {
+		lines = append(lines, fmt.Sprintf("%s %s %d", file.Path, file.LastModified.Format(time.RFC3339), *file.SizeBytes))
+	}
+	expected := "/a.txt 2020-10-12T10:00:00Z 5\n/sub/b.bin 2020-10-12T11:00:00Z 262144"
+	if actual := strings.Join(lines, "\n"); actual != expected {
+		t.Errorf("expected listing:\n%s\nbut got:\n%s", expected, actual)
+	}
+
+	//a read error is resumed at the same offset, without dropping the
+	//connection that is shared with other workers
+	otherReader, _, err := source.GetFile("/a.txt", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer otherReader.Close()
+	sharedClient := source.client
+	server.mutex.Lock()
+	server.failReadAt["/outgoing/sub/b.bin"] = 100000
+	server.mutex.Unlock()
+	body, sourceState, err := source.GetFile("/sub/b.bin", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sourceState.SizeBytes != int64(len(largeContents)) {
+		t.Errorf("expected size %d, got %d", len(largeContents), sourceState.SizeBytes)
+	}
+	contents, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(contents, []byte(largeContents)) {
+		t.Errorf("download after read error yielded %d bytes instead of the original %d bytes", len(contents), len(largeContents))
+	}
+	if source.client != sharedClient {
+		t.Error("expected shared SFTP client to be retained after read error")
+	}
+	contents, err = ioutil.ReadAll(otherReader)
+	if err != nil || string(contents) != "hello" {
+		t.Errorf("expected concurrent download to succeed, got %q and error %v", string(contents), err)
+	}
+
+	//if the file changes before the download is resumed, the download fails
+	server.mutex.Lock()
+	server.failReadAt["/outgoing/sub/b.bin"] = 100000
+	server.mutex.Unlock()
+	body, _, err = source.GetFile("/sub/b.bin", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := make([]byte, 65536)
+	_, err = io.ReadFull(body, buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server.addFile("/outgoing/sub/b.bin", largeContents, mtime.Add(2*time.Hour))
+	_, err = ioutil.ReadAll(body)
+	body.Close()
+	if err == nil || !strings.Contains(err.Error(), "file has changed mid-transfer") {
+		t.Errorf("expected download of changed file to fail, got error %v", err)
+	}
+}
+
+func TestSFTPSourceRejectsUnknownHostKey(t *testing.T) {
+	server := newFakeSFTPServer(t)
+	defer server.Close()
+	server.addFile("/outgoing/a.txt", "hello", time.Now())
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	knownHostsPath := server.writeKnownHosts(t, otherSigner.PublicKey())
+	defer os.Remove(knownHostsPath)
+
+	source := newTestSFTPSource(t, server, knownHostsPath)
+	err = source.Connect("source")
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("expected host key mismatch, got error %v", err)
+	}
+}
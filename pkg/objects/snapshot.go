@@ -0,0 +1,385 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//SnapshotConfiguration contains the "snapshots" section of a JobConfiguration.
+type SnapshotConfiguration struct {
+	Retention  uint  `yaml:"retention"`
+	SymlinksIn *bool `yaml:"symlinks"`
+	Symlinks   bool  `yaml:"-"`
+}
+
+//Snapshot describes the snapshot that a Job writes into one of its targets.
+//It is filled by JobConfiguration.Compile() if snapshots are enabled.
+type Snapshot struct {
+	//Name is the timestamp that identifies the snapshot (e.g. "20201018-120000").
+	Name string
+	//PreviousName identifies the currently published snapshot, or is empty if
+	//no snapshot has been published yet.
+	PreviousName string
+	//BasePrefix is the original ObjectNamePrefix of the target (with a trailing
+	//slash if not empty). Snapshots are stored below
+	//"$BASE_PREFIX/snapshots/$NAME/".
+	BasePrefix string
+}
+
+//The format of Snapshot.Name. Names in this format sort chronologically.
+const snapshotNameFormat = "20060102-150405"
+
+//The files that are written into the "current" symlink tree last, since they
+//refer to all other files in a repository. (Clients that see the old version
+//of these files will only request files that are still available in the old
+//snapshot.)
+var snapshotIndexFileNames = map[string]bool{
+	"repomd.xml":     true,
+	"repomd.xml.asc": true,
+	"repomd.xml.key": true,
+	"Release":        true,
+	"Release.gpg":    true,
+	"InRelease":      true,
+}
+
+//Returns the object name prefix (with trailing slash) of the snapshot with the given name.
+func (s Snapshot) objectNamePrefix(name string) string {
+	return s.BasePrefix + "snapshots/" + name + "/"
+}
+
+//Returns the name of the object that identifies the published snapshot. This
+//object is only used for bookkeeping (and by scripts that want to know the
+//snapshot name). Clients use the "current" symlink tree instead.
+func (s Snapshot) pointerObjectName() string {
+	return s.BasePrefix + "snapshots/current"
+}
+
+//Returns the name of the object below the given snapshot that corresponds to
+//the given object below the current snapshot.
+func (s Snapshot) objectNameIn(name, objectName string) string {
+	return s.objectNamePrefix(name) + strings.TrimPrefix(objectName, s.objectNamePrefix(s.Name))
+}
+
+//Switches this target to writing into a new snapshot. Must be called after
+//Connect().
+func (s *SwiftLocation) prepareSnapshot(now time.Time) error {
+	basePrefix := s.ObjectNamePrefix
+	if basePrefix != "" && !strings.HasSuffix(basePrefix, "/") {
+		basePrefix += "/"
+	}
+	snapshot := &Snapshot{
+		Name:       now.UTC().Format(snapshotNameFormat),
+		BasePrefix: basePrefix,
+	}
+
+	pointer := s.Container.Object(snapshot.pointerObjectName())
+	contents, err := pointer.Download(nil).AsString()
+	switch {
+	case err == nil:
+		snapshot.PreviousName = strings.TrimSpace(contents)
+	case schwift.Is(err, http.StatusNotFound):
+		//no snapshot published yet
+	default:
+		return fmt.Errorf("could not read %s: %s", pointer.FullName(), err.Error())
+	}
+
+	s.Snapshot = snapshot
+	s.ObjectNamePrefix = snapshot.objectNamePrefix(snapshot.Name)
+	return nil
+}
+
+//Checks whether the target supports the symlinks that are needed for the
+//"current" symlink tree.
+func (s *SwiftLocation) checkSnapshotSymlinks(cfg SnapshotConfiguration, jobName, name string) error {
+	if !cfg.Symlinks {
+		return nil
+	}
+	capabilities, err := s.Account.Capabilities()
+	if err != nil {
+		return fmt.Errorf("cannot query capabilities of %s: %s", name, err.Error())
+	}
+	if capabilities.Symlink == nil {
+		return fmt.Errorf("invalid value for %s.snapshots.symlinks: %s does not support symlinks (set this to false to only publish %s)",
+			jobName, name, s.Snapshot.pointerObjectName())
+	}
+	return nil
+}
+
+//Returns the object in the previously published snapshot that corresponds to
+//the given object in the current snapshot, or nil if there is no previous
+//snapshot.
+func (s *SwiftLocation) previousSnapshotObject(object *schwift.Object) *schwift.Object {
+	if s.Snapshot == nil || s.Snapshot.PreviousName == "" {
+		return nil
+	}
+	return s.Container.Object(s.Snapshot.objectNameIn(s.Snapshot.PreviousName, object.Name()))
+}
+
+//PublishSnapshot makes the snapshot that was written by this run the current
+//snapshot, and prunes old snapshots beyond the given retention count.
+//
+//If publishing fails, the "current" symlink tree is rolled back to the
+//previous snapshot and the new snapshot is discarded, so that the previous
+//snapshot stays published.
+func (s *SwiftLocation) PublishSnapshot(cfg SnapshotConfiguration) error {
+	snapshot := s.Snapshot
+	err := s.publishSnapshot(cfg)
+	if err != nil {
+		if cfg.Symlinks {
+			rollbackErr := s.linkSnapshot(snapshot.PreviousName)
+			if rollbackErr != nil {
+				//keep the new snapshot, since some symlinks still point into it
+				logg.Error("could not roll back %s/%scurrent/ to the previous snapshot: %s",
+					s.ContainerName, snapshot.BasePrefix, rollbackErr.Error())
+				return err
+			}
+		}
+		discardErr := s.DiscardSnapshot()
+		if discardErr != nil {
+			logg.Error(discardErr.Error())
+		}
+		return err
+	}
+	logg.Info("published snapshot %s/%s", s.ContainerName, snapshot.objectNamePrefix(snapshot.Name))
+
+	return s.pruneSnapshots(cfg.Retention)
+}
+
+func (s *SwiftLocation) publishSnapshot(cfg SnapshotConfiguration) error {
+	snapshot := s.Snapshot
+	if cfg.Symlinks {
+		err := s.linkSnapshot(snapshot.Name)
+		if err != nil {
+			return fmt.Errorf("could not publish snapshot %s: %s", snapshot.Name, err.Error())
+		}
+	}
+
+	pointer := s.Container.Object(snapshot.pointerObjectName())
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set("text/plain")
+	err := pointer.Upload(strings.NewReader(snapshot.Name+"\n"), nil, hdr.ToOpts())
+	if err != nil {
+		return fmt.Errorf("could not publish snapshot %s: PUT %s failed: %s", snapshot.Name, pointer.FullName(), err.Error())
+	}
+	return nil
+}
+
+//DiscardSnapshot deletes the snapshot that was written by this run (because
+//it is incomplete).
+func (s *SwiftLocation) DiscardSnapshot() error {
+	snapshot := s.Snapshot
+	logg.Info("discarding incomplete snapshot %s/%s", s.ContainerName, snapshot.objectNamePrefix(snapshot.Name))
+	//large objects in this snapshot are either copies of large objects from
+	//older snapshots (whose segments are still in use), or were uploaded in this
+	//snapshot (their segments are deleted by deleteSnapshotSegments)
+	err := deleteObjectsWithPrefix(s.Container, snapshot.objectNamePrefix(snapshot.Name))
+	if err != nil {
+		return err
+	}
+	return s.deleteSnapshotSegments(snapshot.Name, nil)
+}
+
+//Updates the symlinks below "$BASE_PREFIX/current/" to point to the objects
+//in the snapshot with the given name. If the name is empty, all symlinks are
+//removed. Symlinks that already point to the right object are not touched.
+func (s *SwiftLocation) linkSnapshot(name string) error {
+	snapshot := s.Snapshot
+	symlinkPrefix := snapshot.BasePrefix + "current/"
+
+	iter := s.Container.Objects()
+	iter.Prefix = symlinkPrefix
+	infos, err := iter.CollectDetailed()
+	if err != nil {
+		return fmt.Errorf("could not list symlinks in %s/%s: %s", s.ContainerName, symlinkPrefix, err.Error())
+	}
+	symlinkTargets := make(map[string]*schwift.Object, len(infos))
+	for _, info := range infos {
+		symlinkTargets[info.Object.Name()] = info.SymlinkTarget
+	}
+
+	var objs []*schwift.Object
+	snapshotPrefix := snapshot.objectNamePrefix(name)
+	if name != "" {
+		iter = s.Container.Objects()
+		iter.Prefix = snapshotPrefix
+		objs, err = iter.Collect()
+		if err != nil {
+			return fmt.Errorf("could not list objects in %s/%s: %s", s.ContainerName, snapshotPrefix, err.Error())
+		}
+	}
+
+	//link index files last (see comment on snapshotIndexFileNames)
+	sort.SliceStable(objs, func(i, j int) bool {
+		return !snapshotIndexFileNames[path.Base(objs[i].Name())] && snapshotIndexFileNames[path.Base(objs[j].Name())]
+	})
+
+	isLinked := make(map[string]bool, len(objs))
+	for _, obj := range objs {
+		symlinkName := symlinkPrefix + strings.TrimPrefix(obj.Name(), snapshotPrefix)
+		isLinked[symlinkName] = true
+		if target := symlinkTargets[symlinkName]; target != nil && target.IsEqualTo(obj) {
+			continue
+		}
+		err := s.Container.Object(symlinkName).SymlinkTo(obj, nil, nil)
+		if err != nil {
+			return fmt.Errorf("could not create symlink %s/%s: %s", s.ContainerName, symlinkName, err.Error())
+		}
+	}
+
+	//remove symlinks to files that are not in this snapshot
+	var stale []*schwift.Object
+	for _, info := range infos {
+		if !isLinked[info.Object.Name()] {
+			stale = append(stale, info.Object)
+		}
+	}
+	_, _, err = s.Container.Account().BulkDelete(stale, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not remove stale symlinks in %s/%s: %s", s.ContainerName, symlinkPrefix, err.Error())
+	}
+	return nil
+}
+
+//Deletes all snapshots except for the current one and the newest older ones,
+//up to the given retention count. Snapshots that are newer than the current
+//snapshot are not touched, since they are probably being written by a
+//concurrent run.
+func (s *SwiftLocation) pruneSnapshots(retention uint) error {
+	snapshot := s.Snapshot
+	iter := s.Container.Objects()
+	iter.Prefix = snapshot.BasePrefix + "snapshots/"
+	iter.Delimiter = "/"
+	infos, err := iter.CollectDetailed()
+	if err != nil {
+		return fmt.Errorf("could not list snapshots in %s/%s: %s", s.ContainerName, iter.Prefix, err.Error())
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.SubDirectory == "" {
+			continue //not a snapshot (e.g. the pointer object)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(info.SubDirectory, iter.Prefix), "/")
+		if name <= snapshot.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	if uint(len(names)) <= retention {
+		return nil
+	}
+
+	retained := names[:retention]
+	for _, name := range names[retention:] {
+		logg.Info("pruning snapshot %s/%s", s.ContainerName, snapshot.objectNamePrefix(name))
+		err := deleteObjectsWithPrefix(s.Container, snapshot.objectNamePrefix(name))
+		if err == nil {
+			err = s.deleteSnapshotSegments(name, retained)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Deletes the segments of large objects that were uploaded as part of the
+//given snapshot, unless they are still in use by large objects in one of the
+//retained snapshots (which may contain copies of the large objects' manifests).
+func (s *SwiftLocation) deleteSnapshotSegments(name string, retained []string) error {
+	if s.SegmentContainer == nil {
+		return nil
+	}
+	snapshot := s.Snapshot
+	snapshotPrefix := snapshot.objectNamePrefix(name)
+
+	//segment names are generated from a template that starts with the object
+	//name, so we can find the objects that the segments were uploaded for
+	segmentPrefixRx := segmentPrefixRegexp(s.SegmentPrefix, nil)
+	segmentsByObjectName := make(map[string][]*schwift.Object)
+	iter := s.SegmentContainer.Objects()
+	iter.Prefix = snapshotPrefix
+	err := iter.Foreach(func(segment *schwift.Object) error {
+		prefix, ok := segmentPrefixOf(segment.Name())
+		if !ok {
+			return nil
+		}
+		if match := segmentPrefixRx.FindStringSubmatch(prefix); match != nil {
+			objectName := match[1]
+			segmentsByObjectName[objectName] = append(segmentsByObjectName[objectName], segment)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not list segments in %s/%s: %s", s.SegmentContainer.Name(), snapshotPrefix, err.Error())
+	}
+
+	var unused []*schwift.Object
+	for objectName, segments := range segmentsByObjectName {
+		inUse := make(map[string]bool)
+		for _, retainedName := range retained {
+			relativeName := strings.TrimPrefix(objectName, snapshotPrefix)
+			lo, err := s.Container.Object(snapshot.objectNamePrefix(retainedName) + relativeName).AsLargeObject()
+			if err == schwift.ErrNotLarge || schwift.Is(err, http.StatusNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, segment := range lo.SegmentObjects() {
+				inUse[segment.FullName()] = true
+			}
+		}
+		for _, segment := range segments {
+			if !inUse[segment.FullName()] {
+				unused = append(unused, segment)
+			}
+		}
+	}
+
+	_, _, err = s.SegmentContainer.Account().BulkDelete(unused, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete segments in %s/%s: %s", s.SegmentContainer.Name(), snapshotPrefix, err.Error())
+	}
+	return nil
+}
+
+//Deletes all objects in the given container whose names start with the given prefix.
+func deleteObjectsWithPrefix(container *schwift.Container, prefix string) error {
+	iter := container.Objects()
+	iter.Prefix = prefix
+	objs, err := iter.Collect()
+	if err == nil {
+		_, _, err = container.Account().BulkDelete(objs, nil, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete objects in %s/%s: %s", container.Name(), prefix, err.Error())
+	}
+	return nil
+}
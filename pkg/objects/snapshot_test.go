@@ -0,0 +1,269 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSnapshotPublishing(t *testing.T) {
+	var sourceDownloads int64
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(&sourceDownloads, 1)
+		w.Write([]byte("hello world"))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  storage_url: %[2]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+  object_prefix: repo
+snapshots:
+  retention: 1
+`, source.URL, swift.URL)
+	job := compileTestJob(t, configYAML)
+	target := job.Targets[0]
+	file := File{Job: job, Spec: FileSpec{Path: "/file.txt"}}
+
+	//first run: file is downloaded into the first snapshot
+	firstName := target.Snapshot.Name
+	results, _ := file.PerformTransfer(job.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected first transfer to succeed, got %d", results[0])
+	}
+	err := target.PublishSnapshot(*job.Snapshots)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSnapshotPointer(t, swift, firstName)
+
+	//second run: file is unchanged and copied from the first snapshot
+	target.ObjectNamePrefix = "repo"
+	err = target.prepareSnapshot(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	secondName := target.Snapshot.Name
+	if target.Snapshot.PreviousName != firstName {
+		t.Errorf("expected previous snapshot %q, got %q", firstName, target.Snapshot.PreviousName)
+	}
+	results, _ = file.PerformTransfer(job.Targets)
+	if results[0] != TransferSkipped {
+		t.Fatalf("expected second transfer to be skipped, got %d", results[0])
+	}
+	if sourceDownloads != 1 {
+		t.Errorf("expected 1 download from source, got %d", sourceDownloads)
+	}
+	obj := swift.object("AUTH_test/mirror/repo/snapshots/" + secondName + "/file.txt")
+	if obj == nil || string(obj.Contents) != "hello world" {
+		t.Errorf("file was not copied into second snapshot: %#v", obj)
+	}
+
+	//publishing the second snapshot prunes the first one
+	err = target.PublishSnapshot(*job.Snapshots)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSnapshotPointer(t, swift, secondName)
+	if swift.object("AUTH_test/mirror/repo/snapshots/"+firstName+"/file.txt") != nil {
+		t.Error("expected first snapshot to be pruned")
+	}
+	symlink := swift.object("AUTH_test/mirror/repo/current/file.txt")
+	expectedSymlinkTarget := "mirror/repo/snapshots/" + secondName + "/file.txt"
+	if symlink == nil || symlink.Headers.Get("X-Symlink-Target") != expectedSymlinkTarget {
+		t.Errorf("expected symlink to %s, got %#v", expectedSymlinkTarget, symlink)
+	}
+
+	//a discarded snapshot leaves no objects behind
+	target.ObjectNamePrefix = "repo"
+	err = target.prepareSnapshot(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	thirdName := target.Snapshot.Name
+	file.PerformTransfer(job.Targets)
+	err = target.DiscardSnapshot()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSnapshotPointer(t, swift, secondName)
+	if swift.object("AUTH_test/mirror/repo/snapshots/"+thirdName+"/file.txt") != nil {
+		t.Error("expected third snapshot to be discarded")
+	}
+}
+
+func TestSnapshotPublishingFailure(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents of " + r.URL.Path))
+	}))
+	defer source.Close()
+
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	configYAML := fmt.Sprintf(`
+from:
+  url: %[1]s/
+to:
+  storage_url: %[2]s/v1/AUTH_test
+  auth_token: unused
+  container: mirror
+  object_prefix: repo
+snapshots:
+  retention: 2
+`, source.URL, swift.URL)
+	job := compileTestJob(t, configYAML)
+	target := job.Targets[0]
+	files := []File{
+		{Job: job, Spec: FileSpec{Path: "/package.rpm"}},
+		{Job: job, Spec: FileSpec{Path: "/repomd.xml"}},
+	}
+	transferAll := func() {
+		t.Helper()
+		for _, file := range files {
+			results, _ := file.PerformTransfer(job.Targets)
+			if results[0] == TransferFailed {
+				t.Fatalf("transfer of %s failed", file.Spec.Path)
+			}
+		}
+	}
+	countSymlinkPUTs := func() (count int) {
+		for _, request := range swift.requests {
+			if strings.HasPrefix(request, "PUT /v1/AUTH_test/mirror/repo/current/") {
+				count++
+			}
+		}
+		return
+	}
+
+	firstName := target.Snapshot.Name
+	transferAll()
+	err := target.PublishSnapshot(*job.Snapshots)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//relinking the published snapshot does not touch the existing symlinks
+	swift.requests = nil
+	err = target.linkSnapshot(firstName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count := countSymlinkPUTs(); count != 0 {
+		t.Errorf("expected no symlinks to be updated, got %d PUT requests", count)
+	}
+
+	//second run: relinking fails halfway through (the index file is linked last)
+	target.ObjectNamePrefix = "repo"
+	err = target.prepareSnapshot(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	secondName := target.Snapshot.Name
+	transferAll()
+	swift.requests = nil
+	swift.failPUT["/v1/AUTH_test/mirror/repo/current/repomd.xml"] = true
+	err = target.PublishSnapshot(*job.Snapshots)
+	if err == nil {
+		t.Fatal("expected publishing to fail")
+	}
+	swift.failPUT["/v1/AUTH_test/mirror/repo/current/repomd.xml"] = false
+
+	//current/ is rolled back to the first snapshot, and the second snapshot is discarded
+	expectSnapshotPointer(t, swift, firstName)
+	for _, file := range files {
+		symlink := swift.object("AUTH_test/mirror/repo/current" + file.Spec.Path)
+		expectedSymlinkTarget := "mirror/repo/snapshots/" + firstName + file.Spec.Path
+		if symlink == nil || symlink.Headers.Get("X-Symlink-Target") != expectedSymlinkTarget {
+			t.Errorf("expected symlink to %s, got %#v", expectedSymlinkTarget, symlink)
+		}
+	}
+	if swift.object("AUTH_test/mirror/repo/snapshots/"+secondName+"/package.rpm") != nil {
+		t.Error("expected second snapshot to be discarded")
+	}
+	//package.rpm was linked and rolled back, repomd.xml failed and was left alone
+	if count := countSymlinkPUTs(); count != 3 {
+		t.Errorf("expected 3 PUT requests for symlinks, got %d", count)
+	}
+}
+
+func expectSnapshotPointer(t *testing.T, swift *fakeSwift, expectedName string) {
+	t.Helper()
+	pointer := swift.object("AUTH_test/mirror/repo/snapshots/current")
+	if pointer == nil || string(pointer.Contents) != expectedName+"\n" {
+		t.Errorf("expected snapshot %s to be published, got %#v", expectedName, pointer)
+	}
+}
+
+func TestSnapshotSymlinksRequireCapability(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+	swift.capabilities = `{"swift":{"version":"2.25.0"}}`
+
+	compile := func(account, extraYAML string) []error {
+		configYAML := fmt.Sprintf(`
+from:
+  url: http://localhost/
+to:
+  storage_url: %[1]s/v1/%[2]s
+  auth_token: unused
+  container: mirror
+snapshots:
+  retention: 1
+%[3]s`, swift.URL, account, extraYAML)
+		var cfg JobConfiguration
+		err := yaml.Unmarshal([]byte(configYAML), &cfg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, errs := cfg.Compile("jobs[0]", SwiftLocation{})
+		return errs
+	}
+
+	//the symlink tree is enabled by default, but needs symlink support
+	errs := compile("AUTH_nosymlinks1", "")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "jobs[0].snapshots.symlinks") {
+		t.Errorf("expected error about missing symlink support, got %v", errs)
+	}
+	errs = compile("AUTH_nosymlinks2", "  symlinks: false\n")
+	if len(errs) > 0 {
+		t.Errorf("expected no errors with symlinks disabled, got %v", errs)
+	}
+}
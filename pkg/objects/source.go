@@ -30,6 +30,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,7 +50,8 @@ type Source interface {
 	Connect(name string) error
 	//ListAllFiles returns all files in the source (as paths relative to the
 	//source's root). If this returns ErrListAllFilesNotSupported, ListEntries
-	//must be used instead.
+	//must be used instead. If only some directories could not be listed, the
+	//files that were found may be returned together with an error.
 	ListAllFiles() ([]FileSpec, *ListEntriesError)
 	//ListEntries returns all files and subdirectories at this path in the
 	//source. Each result value must have a "/" prefix for subdirectories, or
@@ -102,8 +104,22 @@ type FileState struct {
 	SizeBytes    int64      //-1 if not known
 	ExpiryTime   *time.Time //nil if not set
 	//the following fields are only used in `sourceState`, not `targetState`
-	SkipTransfer bool
-	ContentType  string
+	SkipTransfer   bool
+	ContentType    string
+	SupportsRanges bool //whether the source reported support for range requests
+	//only set if the source redirected to a different file within the source
+	//root (see URLSource.RedirectsAsSymlinks); relative to the source root
+	SymlinkTargetPath string
+}
+
+//RangeSource is an optional interface for Sources that can download byte
+//ranges of files. It is used for parallel segment uploads (see
+//SegmentingConfiguration.Parallelism).
+type RangeSource interface {
+	//GetFileRange retrieves the given byte range of the file at the given path
+	//in the source. The sourceState is the one returned by GetFile(); if the
+	//file has changed since then, an error is returned.
+	GetFileRange(directoryPath string, sourceState FileState, offset, length int64) (io.ReadCloser, error)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -116,11 +132,18 @@ type URLSource struct {
 	ClientCertificatePath    string       `yaml:"cert"`
 	ClientCertificateKeyPath string       `yaml:"key"`
 	ServerCAPath             string       `yaml:"ca"`
+	HTTPAuth                 HTTPAuth     `yaml:",inline"`
 	HTTPClient               *http.Client `yaml:"-"`
 	//transfer options
 	SegmentingIn *bool  `yaml:"segmenting"`
 	Segmenting   bool   `yaml:"-"`
 	SegmentSize  uint64 `yaml:"segment_bytes"`
+	//scraping options
+	ListingFormat       string              `yaml:"listing_format"`
+	JSONListingMapping  *JSONListingMapping `yaml:"listing_json"`
+	ListingTimezone     string              `yaml:"listing_timezone"`
+	ListingLocation     *time.Location      `yaml:"-"`
+	RedirectsAsSymlinks bool                `yaml:"redirects_as_symlinks"`
 	//NOTE: All attributes that can be deserialized from YAML also need to be in
 	//the custom source types (e.g. YumSource) with the same YAML field names.
 }
@@ -151,6 +174,46 @@ func (u *URLSource) Validate(name string) (result []error) {
 		}
 	}
 
+	switch u.ListingFormat {
+	case "":
+		u.ListingFormat = "html"
+	case "html", "webdav", "nginx-json", "caddy-json":
+		//ok
+	case "json":
+		if u.JSONListingMapping == nil {
+			result = append(result, fmt.Errorf("missing value for %s.listing_json", name))
+		}
+	default:
+		result = append(result, fmt.Errorf(`invalid value for %s.listing_format: expected "html", "webdav", "nginx-json", "caddy-json" or "json", got %q`, name, u.ListingFormat))
+	}
+	if u.JSONListingMapping != nil {
+		if u.ListingFormat == "json" {
+			result = append(result, u.JSONListingMapping.Validate(name+".listing_json")...)
+		} else {
+			result = append(result, fmt.Errorf(`invalid value for %s.listing_json: only allowed for listing_format "json"`, name))
+		}
+	}
+	u.ListingLocation = time.UTC
+	if u.ListingTimezone != "" {
+		if u.ListingFormat == "html" {
+			var err error
+			u.ListingLocation, err = time.LoadLocation(u.ListingTimezone)
+			if err != nil {
+				result = append(result, fmt.Errorf("invalid value for %s.listing_timezone: %s", name, err.Error()))
+			}
+		} else {
+			result = append(result, fmt.Errorf(`invalid value for %s.listing_timezone: only allowed for listing_format "html"`, name))
+		}
+	}
+
+	result = append(result, u.HTTPAuth.Validate(name)...)
+	return append(result, u.validateConnectionOptions(name)...)
+}
+
+//Helper function for URLSource.Validate() that validates all options except
+//for the URL. This is also used by source types that do not have a single
+//root URL (e.g. ManifestSource).
+func (u *URLSource) validateConnectionOptions(name string) (result []error) {
 	// If one of the following is set, the other one needs also to be set
 	if u.ClientCertificatePath != "" || u.ClientCertificateKeyPath != "" {
 		if u.ClientCertificatePath == "" {
@@ -175,44 +238,76 @@ func (u *URLSource) Validate(name string) (result []error) {
 
 //Connect implements the Source interface.
 func (u *URLSource) Connect(name string) error {
+	tlsConfig, err := loadTLSConfig(u.ClientCertificatePath, u.ClientCertificateKeyPath, u.ServerCAPath)
+	if err != nil {
+		return err
+	}
+
+	if u.ClientCertificatePath != "" || u.ServerCAPath != "" {
+		// Overriding the transport for TLS, requires also Proxy to be set from ENV,
+		// otherwise a set proxy will get lost
+		transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+		u.HTTPClient = &http.Client{Transport: transport}
+	} else {
+		u.HTTPClient = http.DefaultClient
+	}
+
+	if !u.HTTPAuth.IsEmpty() && u.URL != nil {
+		transport := u.HTTPClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		roundTripper := &httpAuthRoundTripper{
+			Inner: transport,
+			Auth:  u.HTTPAuth,
+			Host:  u.URL.Host,
+		}
+		if u.HTTPAuth.OAuth2 != nil {
+			roundTripper.TokenSource = newOAuth2TokenSource(*u.HTTPAuth.OAuth2, &http.Client{Transport: transport})
+			//check that the credentials work
+			_, err := roundTripper.TokenSource.Token()
+			if err != nil {
+				return err
+			}
+		}
+		u.HTTPClient = &http.Client{Transport: roundTripper}
+	}
+
+	return nil
+}
+
+//Helper function for URLSource.Connect() that is also used by other source
+//types supporting TLS (e.g. FTPSource).
+func loadTLSConfig(clientCertificatePath, clientCertificateKeyPath, serverCAPath string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{}
 
-	if u.ClientCertificatePath != "" {
+	if clientCertificatePath != "" {
 		// Load client cert
-		clientCertificate, err := tls.LoadX509KeyPair(u.ClientCertificatePath, u.ClientCertificateKeyPath)
+		clientCertificate, err := tls.LoadX509KeyPair(clientCertificatePath, clientCertificateKeyPath)
 		if err != nil {
-			return fmt.Errorf("cannot load client certificate from %s: %s", u.ClientCertificatePath, err.Error())
+			return nil, fmt.Errorf("cannot load client certificate from %s: %s", clientCertificatePath, err.Error())
 		}
 
-		logg.Debug("Client certificate %s loaded", u.ClientCertificatePath)
+		logg.Debug("Client certificate %s loaded", clientCertificatePath)
 		tlsConfig.Certificates = []tls.Certificate{clientCertificate}
 	}
 
-	if u.ServerCAPath != "" {
+	if serverCAPath != "" {
 		// Load server CA cert
-		serverCA, err := ioutil.ReadFile(u.ServerCAPath)
+		serverCA, err := ioutil.ReadFile(serverCAPath)
 		if err != nil {
-			return fmt.Errorf("cannot load CA certificate from %s: %s", u.ServerCAPath, err.Error())
+			return nil, fmt.Errorf("cannot load CA certificate from %s: %s", serverCAPath, err.Error())
 		}
 
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(serverCA)
 
-		logg.Debug("Server CA %s loaded", u.ServerCAPath)
+		logg.Debug("Server CA %s loaded", serverCAPath)
 		tlsConfig.RootCAs = certPool
 	}
 
-	if u.ClientCertificatePath != "" || u.ServerCAPath != "" {
-		tlsConfig.BuildNameToCertificate()
-		// Overriding the transport for TLS, requires also Proxy to be set from ENV,
-		// otherwise a set proxy will get lost
-		transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
-		u.HTTPClient = &http.Client{Transport: transport}
-	} else {
-		u.HTTPClient = http.DefaultClient
-	}
-
-	return nil
+	tlsConfig.BuildNameToCertificate()
+	return tlsConfig, nil
 }
 
 //matches ".." path element
@@ -220,11 +315,21 @@ var dotdotRx = regexp.MustCompile(`(?:^|/)\.\.(?:$|/)`)
 
 //ListAllFiles implements the Source interface.
 func (u URLSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	if u.ListingFormat == "webdav" {
+		return u.listEntriesViaWebDAV(u.URL, "/", "infinity")
+	}
 	return nil, ErrListAllFilesNotSupported
 }
 
 //ListEntries implements the Source interface.
 func (u URLSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
+	if u.RedirectsAsSymlinks {
+		return u.listEntriesDetectingRedirects(directoryPath)
+	}
+	return u.listEntries(directoryPath)
+}
+
+func (u URLSource) listEntries(directoryPath string) ([]FileSpec, *ListEntriesError) {
 	//get full URL of this subdirectory
 	uri := u.getURLForPath(directoryPath)
 	//to get a well-formatted directory listing, the directory URL must have a
@@ -238,6 +343,17 @@ func (u URLSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesEr
 		}
 	}
 
+	switch u.ListingFormat {
+	case "webdav":
+		return u.listEntriesViaWebDAV(uri, directoryPath, "1")
+	case "nginx-json":
+		return u.listEntriesViaJSON(uri, directoryPath, nginxJSONListingMapping)
+	case "caddy-json":
+		return u.listEntriesViaJSON(uri, directoryPath, caddyJSONListingMapping)
+	case "json":
+		return u.listEntriesViaJSON(uri, directoryPath, *u.JSONListingMapping)
+	}
+
 	logg.Debug("scraping %s", uri)
 
 	//retrieve directory listing
@@ -261,21 +377,75 @@ func (u URLSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesEr
 		return nil, &ListEntriesError{uri.String(), "GET returned unexpected Content-Type: " + contentType, nil}
 	}
 
-	//find links inside the HTML document
-	tokenizer := html.NewTokenizer(response.Body)
-	var result []FileSpec
+	return parseHTMLListing(response.Body, uri, directoryPath, u.ListingLocation), nil
+}
+
+//Helper function for URLSource.ListEntries() that finds links inside an HTML
+//directory listing. When the listing was generated by Apache's mod_autoindex
+//(with FancyIndexing) or by nginx's autoindex, the modification time and size
+//columns next to each link are parsed as well, with timestamps in the given
+//location.
+func parseHTMLListing(body io.Reader, uri *url.URL, directoryPath string, location *time.Location) []FileSpec {
+	tokenizer := html.NewTokenizer(body)
+	var (
+		result []FileSpec
+		//the text between the end of the last link and the start of the next
+		//link, which contains the columns belonging to the last link
+		columnText  strings.Builder
+		inLink      bool
+		inTableRow  bool
+		hasLastLink bool
+	)
+	finishLastLink := func() {
+		if hasLastLink {
+			text := columnText.String()
+			//in <pre>-formatted listings, the columns end at the end of the line
+			if !inTableRow {
+				text = strings.SplitN(text, "\n", 2)[0]
+			}
+			result[len(result)-1].parseListingColumns(text, location)
+		}
+		hasLastLink = false
+		columnText.Reset()
+	}
+
 	for {
 		tokenType := tokenizer.Next()
 
 		switch tokenType {
 		case html.ErrorToken:
 			//end of document
-			return result, nil
+			finishLastLink()
+			return result
+		case html.TextToken:
+			if hasLastLink && !inLink {
+				columnText.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.A:
+				inLink = false
+			case atom.Td, atom.Th:
+				//separate table cells from each other
+				columnText.WriteString(" ")
+			case atom.Tr:
+				finishLastLink()
+				inTableRow = false
+			case atom.Pre, atom.Table:
+				finishLastLink()
+			}
 		case html.StartTagToken:
 			token := tokenizer.Token()
+			if token.DataAtom == atom.Tr {
+				finishLastLink()
+				inTableRow = true
+			}
 
 			if token.DataAtom == atom.A {
 				//found an <a> tag -- retrieve its href
+				finishLastLink()
+				inLink = true
 				var href string
 				for _, attr := range token.Attr {
 					if attr.Key == "href" {
@@ -321,37 +491,102 @@ func (u URLSource) ListEntries(directoryPath string) ([]FileSpec, *ListEntriesEr
 					Path:        filepath.Join(directoryPath, linkPath),
 					IsDirectory: strings.HasSuffix(linkPath, "/"),
 				})
+				hasLastLink = true
 			}
 		}
 	}
 }
 
+//Matches the modification time and size columns in directory listings, e.g.
+//
+//	nginx:                   "   12-Oct-2020 10:00    44040192"
+//	Apache (<pre> format):   "   12-Oct-2020 10:00  4.2M  "
+//	Apache (<table> format): " 2020-10-12 10:00   4.2M  "
+//
+//Sizes are only exact if they do not have a unit suffix.
+var listingColumnsRx = regexp.MustCompile(`^\s*(\d{2}-[A-Z][a-z]{2}-\d{4} \d{2}:\d{2}(?::\d{2})?|\d{4}-\d{2}-\d{2} \d{2}:\d{2}(?::\d{2})?)\s+(\S+)`)
+
+var listingTimeFormats = []struct {
+	Layout    string
+	Precision time.Duration
+}{
+	{"02-Jan-2006 15:04", time.Minute},
+	{"02-Jan-2006 15:04:05", 0},
+	{"2006-01-02 15:04", time.Minute},
+	{"2006-01-02 15:04:05", 0},
+}
+
+//Helper function for parseHTMLListing(): Fills LastModified and SizeBytes from
+//the text following the link in the directory listing. Since the listings do
+//not specify a timezone, timestamps are interpreted in the given location
+//(see URLSource.ListingTimezone).
+func (s *FileSpec) parseListingColumns(text string, location *time.Location) {
+	if s.IsDirectory {
+		return
+	}
+	match := listingColumnsRx.FindStringSubmatch(strings.Replace(text, "\u00a0", " ", -1))
+	if match == nil {
+		return
+	}
+
+	for _, format := range listingTimeFormats {
+		mtime, err := time.ParseInLocation(format.Layout, match[1], location)
+		if err == nil {
+			s.LastModified = &mtime
+			s.LastModifiedPrecision = format.Precision
+			break
+		}
+	}
+	size, err := strconv.ParseInt(match[2], 10, 64)
+	if err == nil {
+		s.SizeBytes = &size
+	}
+}
+
 //GetFile implements the Source interface.
 func (u URLSource) GetFile(directoryPath string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
-	uri := u.getURLForPath(directoryPath).String()
+	return u.getFileFromURL(u.getURLForPath(directoryPath).String(), requestHeaders)
+}
+
+//Helper function for URLSource.GetFile() and for custom source types whose
+//files are not located below a single root URL.
+func (u URLSource) getFileFromURL(uri string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
 	requestHeaders.Set("User-Agent", "swift-http-import/"+util.Version)
 
 	//retrieve file from source
 	var (
 		response *http.Response
 		err      error
+		client   = u.HTTPClient
+		location *url.URL
 	)
+	if u.RedirectsAsSymlinks {
+		client = u.clientRecordingRedirects(&location)
+	}
 	if u.Segmenting {
-		response, err = util.EnhancedGet(u.HTTPClient, uri, requestHeaders.ToHTTP(), u.SegmentSize)
+		response, err = util.EnhancedGet(client, uri, requestHeaders.ToHTTP(), u.SegmentSize)
 	} else {
 		var req *http.Request
-		req, err := http.NewRequest("GET", uri, nil)
+		req, err = http.NewRequest("GET", uri, nil)
 		if err == nil {
 			for key, val := range requestHeaders.Headers {
 				req.Header.Set(key, val)
 			}
-			response, err = u.HTTPClient.Do(req)
+			response, err = client.Do(req)
 		}
 	}
 	if err != nil {
 		return nil, FileState{}, fmt.Errorf("skipping %s: GET failed: %s", uri, err.Error())
 	}
 
+	var symlinkTargetPath string
+	if location != nil {
+		originalURL, err := url.Parse(uri)
+		if err == nil {
+			symlinkTargetPath = u.redirectTargetPath(originalURL, location)
+		}
+	}
+
 	if response.StatusCode != 200 && response.StatusCode != 304 {
 		return nil, FileState{}, fmt.Errorf(
 			"skipping %s: GET returned unexpected status code: expected 200 or 304, but got %d",
@@ -360,15 +595,29 @@ func (u URLSource) GetFile(directoryPath string, requestHeaders schwift.ObjectHe
 	}
 
 	return response.Body, FileState{
-		Etag:         response.Header.Get("Etag"),
-		LastModified: response.Header.Get("Last-Modified"),
-		SizeBytes:    response.ContentLength,
-		ExpiryTime:   nil, //no way to get this information via HTTP only
-		SkipTransfer: response.StatusCode == 304,
-		ContentType:  response.Header.Get("Content-Type"),
+		Etag:              response.Header.Get("Etag"),
+		LastModified:      response.Header.Get("Last-Modified"),
+		SizeBytes:         response.ContentLength,
+		ExpiryTime:        nil, //no way to get this information via HTTP only
+		SkipTransfer:      response.StatusCode == 304,
+		ContentType:       response.Header.Get("Content-Type"),
+		SupportsRanges:    response.Header.Get("Accept-Ranges") == "bytes" || response.Header.Get("Content-Range") != "",
+		SymlinkTargetPath: symlinkTargetPath,
 	}, nil
 }
 
+//GetFileRange implements the RangeSource interface.
+func (u URLSource) GetFileRange(directoryPath string, sourceState FileState, offset, length int64) (io.ReadCloser, error) {
+	uri := u.getURLForPath(directoryPath).String()
+	requestHeaders := make(http.Header)
+	requestHeaders.Set("User-Agent", "swift-http-import/"+util.Version)
+	body, err := util.RangedGet(u.HTTPClient, uri, requestHeaders, offset, length, sourceState.Etag)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s failed at offset %d: %s", uri, offset, err.Error())
+	}
+	return body, nil
+}
+
 //Return the URL for the given directoryPath below this URLSource.
 func (u URLSource) getURLForPath(directoryPath string) *url.URL {
 	return u.URL.ResolveReference(&url.URL{Path: strings.TrimPrefix(directoryPath, "/")})
@@ -378,30 +627,40 @@ func (u URLSource) getURLForPath(directoryPath string) *url.URL {
 func (u URLSource) getFileContents(path string, cache map[string]FileSpec) (contents []byte, uri string, e *ListEntriesError) {
 	uri = u.getURLForPath(path).String()
 
+	result, headers, lerr := u.getContentsFromURL(uri)
+	if lerr != nil {
+		return nil, uri, lerr
+	}
+
+	cache[path] = FileSpec{
+		Path:     path,
+		Contents: result,
+		Headers:  headers,
+	}
+
+	return result, uri, nil
+}
+
+//Helper function for custom source types.
+func (u URLSource) getContentsFromURL(uri string) ([]byte, http.Header, *ListEntriesError) {
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
-		return nil, uri, &ListEntriesError{uri, "GET failed", err}
+		return nil, nil, &ListEntriesError{uri, "GET failed", err}
 	}
 
 	resp, err := u.HTTPClient.Do(req)
 	if err != nil {
-		return nil, uri, &ListEntriesError{uri, "GET failed", err}
+		return nil, nil, &ListEntriesError{uri, "GET failed", err}
 	}
 	defer resp.Body.Close()
 
 	result, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, uri, &ListEntriesError{uri, "GET failed", err}
+		return nil, nil, &ListEntriesError{uri, "GET failed", err}
 	}
 	if resp.StatusCode >= 400 {
-		return nil, uri, &ListEntriesError{uri, fmt.Sprintf("GET returned status %d", resp.StatusCode), nil}
+		return nil, nil, &ListEntriesError{uri, fmt.Sprintf("GET returned status %d", resp.StatusCode), nil}
 	}
 
-	cache[path] = FileSpec{
-		Path:     path,
-		Contents: result,
-		Headers:  resp.Header,
-	}
-
-	return result, uri, nil
+	return result, resp.Header, nil
 }
@@ -0,0 +1,131 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const nginxListing = `<html>
+<head><title>Index of /files/</title></head>
+<body>
+<h1>Index of /files/</h1><hr><pre><a href="../">../</a>
+<a href="subdir/">subdir/</a>                                            12-Oct-2020 09:58                   -
+<a href="foo.tar.gz">foo.tar.gz</a>                                      12-Oct-2020 10:00            44040192
+</pre><hr></body>
+</html>
+`
+
+const apachePreListing = `<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+ <head>
+  <title>Index of /files</title>
+ </head>
+ <body>
+<h1>Index of /files</h1>
+<pre><img src="/icons/blank.gif" alt="Icon "> <a href="?C=N;O=D">Name</a>                    <a href="?C=M;O=A">Last modified</a>      <a href="?C=S;O=A">Size</a>  <a href="?C=D;O=A">Description</a><hr><img src="/icons/back.gif" alt="[PARENTDIR]"> <a href="/">Parent Directory</a>                             -   
+<img src="/icons/folder.gif" alt="[DIR]"> <a href="subdir/">subdir/</a>                 12-Oct-2020 09:58    -   
+<img src="/icons/compressed.gif" alt="[   ]"> <a href="foo.tar.gz">foo.tar.gz</a>              12-Oct-2020 10:00   42M  
+<img src="/icons/text.gif" alt="[TXT]"> <a href="README">README</a>                  12-Oct-2020 10:00  123   
+<hr></pre>
+</body></html>
+`
+
+const apacheTableListing = `<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+ <head>
+  <title>Index of /files</title>
+ </head>
+ <body>
+<h1>Index of /files</h1>
+  <table>
+   <tr><th valign="top"><img src="/icons/blank.gif" alt="[ICO]"></th><th><a href="?C=N;O=D">Name</a></th><th><a href="?C=M;O=A">Last modified</a></th><th><a href="?C=S;O=A">Size</a></th><th><a href="?C=D;O=A">Description</a></th></tr>
+   <tr><th colspan="5"><hr></th></tr>
+<tr><td valign="top"><img src="/icons/back.gif" alt="[PARENTDIR]"></td><td><a href="/">Parent Directory</a></td><td>&nbsp;</td><td align="right">  - </td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/folder.gif" alt="[DIR]"></td><td><a href="subdir/">subdir/</a></td><td align="right">2020-10-12 09:58  </td><td align="right">  - </td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/compressed.gif" alt="[   ]"></td><td><a href="foo.tar.gz">foo.tar.gz</a></td><td align="right">2020-10-12 10:00  </td><td align="right"> 42M</td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/text.gif" alt="[TXT]"></td><td><a href="README">README</a></td><td align="right">2020-10-12 10:00  </td><td align="right">123 </td><td>&nbsp;</td></tr>
+   <tr><th colspan="5"><hr></th></tr>
+</table>
+</body></html>
+`
+
+func TestParseHTMLListing(t *testing.T) {
+	uri, _ := url.Parse("http://example.com/files/")
+
+	expectedByListing := map[string]string{
+		nginxListing: `
+			/subdir/ mtime=<nil> size=<nil>
+			/foo.tar.gz mtime=2020-10-12T10:00:00Z size=44040192
+		`,
+		apachePreListing: `
+			/subdir/ mtime=<nil> size=<nil>
+			/foo.tar.gz mtime=2020-10-12T10:00:00Z size=<nil>
+			/README mtime=2020-10-12T10:00:00Z size=123
+		`,
+		apacheTableListing: `
+			/subdir/ mtime=<nil> size=<nil>
+			/foo.tar.gz mtime=2020-10-12T10:00:00Z size=<nil>
+			/README mtime=2020-10-12T10:00:00Z size=123
+		`,
+	}
+
+	for listing, expected := range expectedByListing {
+		actual := formatParsedHTMLListing(listing, uri, time.UTC)
+		expected = strings.Replace(strings.TrimSpace(expected), "\t", "", -1)
+		if actual != expected {
+			t.Errorf("expected listing to be parsed into:\n%s\n\nbut got:\n%s", expected, actual)
+		}
+	}
+
+	//Apache prints timestamps in the server's local time (here: CEST = UTC+2)
+	actual := formatParsedHTMLListing(apacheTableListing, uri, time.FixedZone("CEST", 2*60*60))
+	expected := strings.Join([]string{
+		"/subdir/ mtime=<nil> size=<nil>",
+		"/foo.tar.gz mtime=2020-10-12T08:00:00Z size=<nil>",
+		"/README mtime=2020-10-12T08:00:00Z size=123",
+	}, "\n")
+	if actual != expected {
+		t.Errorf("expected listing to be parsed into:\n%s\n\nbut got:\n%s", expected, actual)
+	}
+}
+
+func formatParsedHTMLListing(listing string, uri *url.URL, location *time.Location) string {
+	var lines []string
+	for _, spec := range parseHTMLListing(strings.NewReader(listing), uri, "/", location) {
+		line := spec.Path
+		if spec.IsDirectory {
+			line += "/"
+		}
+		mtime, size := "<nil>", "<nil>"
+		if spec.LastModified != nil {
+			mtime = spec.LastModified.UTC().Format("2006-01-02T15:04:05Z07:00")
+		}
+		if spec.SizeBytes != nil {
+			size = fmt.Sprintf("%d", *spec.SizeBytes)
+		}
+		lines = append(lines, fmt.Sprintf("%s mtime=%s size=%s", line, mtime, size))
+	}
+	return strings.Join(lines, "\n")
+}
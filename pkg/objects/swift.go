@@ -23,13 +23,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/utils/client"
+	"github.com/gophercloud/utils/openstack/clientconfig"
 	"github.com/majewsky/schwift"
 	"github.com/majewsky/schwift/gopherschwift"
 	"github.com/sapcc/go-bits/logg"
@@ -49,6 +52,13 @@ type SwiftLocation struct {
 	ApplicationCredentialName   string       `yaml:"application_credential_name"`
 	ApplicationCredentialSecret AuthPassword `yaml:"application_credential_secret"`
 	RegionName                  string       `yaml:"region_name"`
+	Cloud                       string       `yaml:"cloud"`
+	FromEnvironment             bool         `yaml:"from_environment"`
+	StorageURL                  string       `yaml:"storage_url"`
+	AuthToken                   AuthPassword `yaml:"auth_token"`
+	AuthTokenFile               string       `yaml:"auth_token_file"`
+	TempAuthUser                string       `yaml:"tempauth_user"`
+	TempAuthKey                 AuthPassword `yaml:"tempauth_key"`
 	ContainerName               string       `yaml:"container"`
 	ObjectNamePrefix            string       `yaml:"object_prefix"`
 	//configuration for Validate()
@@ -56,6 +66,18 @@ type SwiftLocation struct {
 	//Account and Container is filled by Connect(). Container will be nil if ContainerName is empty.
 	Account   *schwift.Account   `yaml:"-"`
 	Container *schwift.Container `yaml:"-"`
+	//SegmentContainer, SegmentPrefix and LargeObjectStrategy are filled by
+	//JobConfiguration.Compile() for targets of jobs with segmenting.
+	SegmentContainer    *schwift.Container          `yaml:"-"`
+	SegmentPrefix       string                      `yaml:"-"`
+	LargeObjectStrategy schwift.LargeObjectStrategy `yaml:"-"`
+	//MaxManifestSegments and MaxManifestSize are the limits for SLO manifests
+	//that the target cluster reports in its capabilities (0 if unknown).
+	MaxManifestSegments uint `yaml:"-"`
+	MaxManifestSize     uint `yaml:"-"`
+	//Snapshot is filled by JobConfiguration.Compile() for targets of jobs with
+	//snapshots. In this case, ObjectNamePrefix refers to the new snapshot.
+	Snapshot *Snapshot `yaml:"-"`
 	//FileExists is filled by DiscoverExistingFiles(). The keys are object names
 	//including the ObjectNamePrefix, if any.
 	FileExists map[string]bool `yaml:"-"`
@@ -73,6 +95,13 @@ func (s SwiftLocation) cacheKey(name string) string {
 		s.ApplicationCredentialName,
 		string(s.ApplicationCredentialSecret),
 		s.RegionName,
+		s.Cloud,
+		strconv.FormatBool(s.FromEnvironment),
+		s.StorageURL,
+		string(s.AuthToken),
+		s.AuthTokenFile,
+		s.TempAuthUser,
+		string(s.TempAuthKey),
 	}
 	if logg.ShowDebug {
 		v = append(v, name)
@@ -84,39 +113,73 @@ func (s SwiftLocation) cacheKey(name string) string {
 func (s SwiftLocation) Validate(name string) []error {
 	var result []error
 
-	if s.AuthURL == "" {
-		result = append(result, fmt.Errorf("missing value for %s.auth_url", name))
-	}
+	switch {
+	case s.Cloud != "" || s.FromEnvironment:
+		//credentials will be read from clouds.yaml or from the environment
+		if s.Cloud != "" {
+			result = append(result, s.validateCredentialFields(name, "cloud")...)
+		} else {
+			result = append(result, s.validateCredentialFields(name, "from_environment")...)
+		}
+	case s.StorageURL != "" || s.AuthToken != "" || s.AuthTokenFile != "":
+		//pre-issued token, no authentication required
+		result = append(result, s.validateCredentialFields(name, "storage_url", "auth_token", "auth_token_file")...)
+		if s.StorageURL == "" {
+			result = append(result, fmt.Errorf("missing value for %s.storage_url", name))
+		}
+		if s.AuthToken == "" && s.AuthTokenFile == "" {
+			result = append(result, fmt.Errorf("missing value for %s.auth_token or %s.auth_token_file", name, name))
+		}
+		if s.AuthToken != "" && s.AuthTokenFile != "" {
+			result = append(result, fmt.Errorf("invalid value for %s.auth_token_file: cannot be combined with %s.auth_token", name, name))
+		}
+	case s.TempAuthUser != "" || s.TempAuthKey != "":
+		//legacy TempAuth v1
+		result = append(result, s.validateCredentialFields(name, "auth_url", "tempauth_user", "tempauth_key")...)
+		if s.AuthURL == "" {
+			result = append(result, fmt.Errorf("missing value for %s.auth_url", name))
+		}
+		if s.TempAuthUser == "" {
+			result = append(result, fmt.Errorf("missing value for %s.tempauth_user", name))
+		}
+		if s.TempAuthKey == "" {
+			result = append(result, fmt.Errorf("missing value for %s.tempauth_key", name))
+		}
+	default:
+		if s.AuthURL == "" {
+			result = append(result, fmt.Errorf("missing value for %s.auth_url", name))
+		}
 
-	if s.ApplicationCredentialID != "" || s.ApplicationCredentialName != "" {
-		//checking application credential requirements
-		if s.ApplicationCredentialID == "" {
-			//if application_credential_id is not set, then we need to know user_name and user_domain_name
+		if s.ApplicationCredentialID != "" || s.ApplicationCredentialName != "" {
+			//checking application credential requirements
+			if s.ApplicationCredentialID == "" {
+				//if application_credential_id is not set, then we need to know user_name and user_domain_name
+				if s.UserName == "" {
+					result = append(result, fmt.Errorf("missing value for %s.user_name", name))
+				}
+				if s.UserDomainName == "" {
+					result = append(result, fmt.Errorf("missing value for %s.user_domain_name", name))
+				}
+			}
+			if string(s.ApplicationCredentialSecret) == "" {
+				result = append(result, fmt.Errorf("missing value for %s.application_credential_secret", name))
+			}
+		} else {
 			if s.UserName == "" {
 				result = append(result, fmt.Errorf("missing value for %s.user_name", name))
 			}
 			if s.UserDomainName == "" {
 				result = append(result, fmt.Errorf("missing value for %s.user_domain_name", name))
 			}
-		}
-		if string(s.ApplicationCredentialSecret) == "" {
-			result = append(result, fmt.Errorf("missing value for %s.application_credential_secret", name))
-		}
-	} else {
-		if s.UserName == "" {
-			result = append(result, fmt.Errorf("missing value for %s.user_name", name))
-		}
-		if s.UserDomainName == "" {
-			result = append(result, fmt.Errorf("missing value for %s.user_domain_name", name))
-		}
-		if s.ProjectName == "" {
-			result = append(result, fmt.Errorf("missing value for %s.project_name", name))
-		}
-		if s.ProjectDomainName == "" {
-			result = append(result, fmt.Errorf("missing value for %s.project_domain_name", name))
-		}
-		if s.Password == "" {
-			result = append(result, fmt.Errorf("missing value for %s.password", name))
+			if s.ProjectName == "" {
+				result = append(result, fmt.Errorf("missing value for %s.project_name", name))
+			}
+			if s.ProjectDomainName == "" {
+				result = append(result, fmt.Errorf("missing value for %s.project_domain_name", name))
+			}
+			if s.Password == "" {
+				result = append(result, fmt.Errorf("missing value for %s.password", name))
+			}
 		}
 	}
 
@@ -131,6 +194,66 @@ func (s SwiftLocation) Validate(name string) []error {
 	return result
 }
 
+//Returns the names of all credential fields that are set. Note that
+//region_name is not included since it is not a credential by itself.
+func (s SwiftLocation) credentialFields() []string {
+	var result []string
+	for _, field := range []struct {
+		Name  string
+		IsSet bool
+	}{
+		{"auth_url", s.AuthURL != ""},
+		{"user_name", s.UserName != ""},
+		{"user_domain_name", s.UserDomainName != ""},
+		{"project_name", s.ProjectName != ""},
+		{"project_domain_name", s.ProjectDomainName != ""},
+		{"password", s.Password != ""},
+		{"application_credential_id", s.ApplicationCredentialID != ""},
+		{"application_credential_name", s.ApplicationCredentialName != ""},
+		{"application_credential_secret", s.ApplicationCredentialSecret != ""},
+		{"cloud", s.Cloud != ""},
+		{"from_environment", s.FromEnvironment},
+		{"storage_url", s.StorageURL != ""},
+		{"auth_token", s.AuthToken != ""},
+		{"auth_token_file", s.AuthTokenFile != ""},
+		{"tempauth_user", s.TempAuthUser != ""},
+		{"tempauth_key", s.TempAuthKey != ""},
+	} {
+		if field.IsSet {
+			result = append(result, field.Name)
+		}
+	}
+	return result
+}
+
+//Returns whether any credential fields are set.
+func (s SwiftLocation) hasCredentials() bool {
+	return len(s.credentialFields()) > 0
+}
+
+//Complains about all credential fields that are set, but do not belong to the
+//authentication method that was selected by setting one of the allowed fields.
+func (s SwiftLocation) validateCredentialFields(name string, allowedFields ...string) (result []error) {
+	isAllowed := make(map[string]bool, len(allowedFields))
+	for _, field := range allowedFields {
+		isAllowed[field] = true
+	}
+	setFields := s.credentialFields()
+	selectedField := ""
+	for _, field := range setFields {
+		if isAllowed[field] {
+			selectedField = field
+			break
+		}
+	}
+	for _, field := range setFields {
+		if !isAllowed[field] {
+			result = append(result, fmt.Errorf("invalid value for %s.%s: cannot be combined with %s.%s", name, field, name, selectedField))
+		}
+	}
+	return
+}
+
 var accountCache = map[string]*schwift.Account{}
 
 type logger struct {
@@ -153,7 +276,133 @@ func (s *SwiftLocation) Connect(name string) error {
 	key := s.cacheKey(name)
 	s.Account = accountCache[key]
 	if s.Account == nil {
-		authOptions := gophercloud.AuthOptions{
+		var err error
+		switch {
+		case s.StorageURL != "":
+			s.Account, err = s.connectWithToken()
+		case s.TempAuthUser != "":
+			s.Account, err = s.connectWithTempAuth()
+		default:
+			s.Account, err = s.connectWithKeystone(name)
+		}
+		if err != nil {
+			return err
+		}
+		accountCache[key] = s.Account
+	}
+
+	//create target container if missing
+	if s.ContainerName == "" {
+		s.Container = nil
+		return nil
+	}
+	var err error
+	s.Container, err = s.Account.Container(s.ContainerName).EnsureExists()
+	return err
+}
+
+func (s *SwiftLocation) connectWithKeystone(name string) (*schwift.Account, error) {
+	authOptions, regionName, err := s.authOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := openstack.NewClient(authOptions.IdentityEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create OpenStack client: %s", err.Error())
+	}
+
+	//use DefaultClient, esp. to pick up correct behavior with HTTP proxies
+	provider.HTTPClient = *http.DefaultClient
+	if logg.ShowDebug {
+		transport := http.DefaultClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		provider.HTTPClient.Transport = &client.RoundTripper{
+			Rt:     transport,
+			Logger: &logger{Prefix: name},
+		}
+	}
+
+	err = openstack.Authenticate(provider, *authOptions)
+	if err != nil {
+		if s.Cloud != "" {
+			return nil, fmt.Errorf("cannot authenticate to %s using cloud %q from clouds.yaml: %s",
+				authOptions.IdentityEndpoint,
+				s.Cloud,
+				err.Error(),
+			)
+		}
+		if s.FromEnvironment {
+			return nil, fmt.Errorf("cannot authenticate to %s using credentials from OS_* environment variables: %s",
+				authOptions.IdentityEndpoint,
+				err.Error(),
+			)
+		}
+		if authOptions.ApplicationCredentialSecret != "" {
+			return nil, fmt.Errorf("cannot authenticate to %s using application credential: %s",
+				s.AuthURL,
+				err.Error(),
+			)
+		}
+		return nil, fmt.Errorf("cannot authenticate to %s in %s@%s as %s@%s: %s",
+			s.AuthURL,
+			s.ProjectName,
+			s.ProjectDomainName,
+			s.UserName,
+			s.UserDomainName,
+			err.Error(),
+		)
+	}
+
+	client, err := openstack.NewObjectStorageV1(provider, gophercloud.EndpointOpts{
+		Region: regionName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Swift client: %s", err.Error())
+	}
+	account, err := gopherschwift.Wrap(client, &gopherschwift.Options{
+		UserAgent: "swift-http-import/" + util.Version,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot wrap Swift client: %s", err.Error())
+	}
+	return account, nil
+}
+
+func (s *SwiftLocation) connectWithToken() (*schwift.Account, error) {
+	//a token from a file can be renewed by re-reading the file (an external
+	//process is expected to keep it up-to-date), but a token from the config
+	//file cannot be renewed at all
+	if s.AuthTokenFile != "" {
+		account, err := newSwiftTokenAccount(swiftTokenFromFile(s.StorageURL, s.AuthTokenFile), true)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to %s using token from %s: %s", s.StorageURL, s.AuthTokenFile, err.Error())
+		}
+		return account, nil
+	}
+	account, err := newSwiftTokenAccount(staticSwiftToken(s.StorageURL, string(s.AuthToken)), false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s using token: %s", s.StorageURL, err.Error())
+	}
+	return account, nil
+}
+
+func (s *SwiftLocation) connectWithTempAuth() (*schwift.Account, error) {
+	account, err := newSwiftTokenAccount(swiftTempAuth(s.AuthURL, s.TempAuthUser, string(s.TempAuthKey)), true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot authenticate to %s as %s using TempAuth: %s", s.AuthURL, s.TempAuthUser, err.Error())
+	}
+	return account, nil
+}
+
+//Builds the AuthOptions for Connect(), either from the credentials in the
+//config file, or from clouds.yaml or the OS_* environment variables. Also
+//returns the region name to use.
+func (s *SwiftLocation) authOptions() (*gophercloud.AuthOptions, string, error) {
+	if s.Cloud == "" && !s.FromEnvironment {
+		return &gophercloud.AuthOptions{
 			IdentityEndpoint:            s.AuthURL,
 			Username:                    s.UserName,
 			DomainName:                  s.UserDomainName,
@@ -166,68 +415,36 @@ func (s *SwiftLocation) Connect(name string) error {
 				DomainName:  s.ProjectDomainName,
 			},
 			AllowReauth: true,
-		}
-
-		provider, err := openstack.NewClient(authOptions.IdentityEndpoint)
-		if err != nil {
-			return fmt.Errorf("cannot create OpenStack client: %s", err.Error())
-		}
+		}, s.RegionName, nil
+	}
 
-		//use DefaultClient, esp. to pick up correct behavior with HTTP proxies
-		provider.HTTPClient = *http.DefaultClient
-		if logg.ShowDebug {
-			transport := http.DefaultClient.Transport
-			if transport == nil {
-				transport = http.DefaultTransport
-			}
-			provider.HTTPClient.Transport = &client.RoundTripper{
-				Rt:     transport,
-				Logger: &logger{Prefix: name},
-			}
+	//clientconfig reads clouds.yaml (and secure.yaml) if a cloud name is given,
+	//and the OS_* environment variables otherwise
+	opts := &clientconfig.ClientOpts{Cloud: s.Cloud}
+	authOptions, err := clientconfig.AuthOptions(opts)
+	if err != nil {
+		if s.Cloud != "" {
+			return nil, "", fmt.Errorf("cannot read credentials for cloud %q from clouds.yaml: %s", s.Cloud, err.Error())
 		}
-
-		err = openstack.Authenticate(provider, authOptions)
-		if err != nil {
-			if authOptions.ApplicationCredentialSecret != "" {
-				return fmt.Errorf("cannot authenticate to %s using application credential: %s",
-					s.AuthURL,
-					err.Error(),
-				)
+		return nil, "", fmt.Errorf("cannot read credentials from OS_* environment variables: %s", err.Error())
+	}
+	authOptions.AllowReauth = true
+
+	//an explicitly configured region takes precedence
+	regionName := s.RegionName
+	if regionName == "" {
+		if s.Cloud != "" {
+			cloud, err := clientconfig.GetCloudFromYAML(opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("cannot read cloud %q from clouds.yaml: %s", s.Cloud, err.Error())
 			}
-			return fmt.Errorf("cannot authenticate to %s in %s@%s as %s@%s: %s",
-				s.AuthURL,
-				s.ProjectName,
-				s.ProjectDomainName,
-				s.UserName,
-				s.UserDomainName,
-				err.Error(),
-			)
-		}
-
-		client, err := openstack.NewObjectStorageV1(provider, gophercloud.EndpointOpts{
-			Region: s.RegionName,
-		})
-		if err != nil {
-			return fmt.Errorf("cannot create Swift client: %s", err.Error())
+			regionName = cloud.RegionName
 		}
-		s.Account, err = gopherschwift.Wrap(client, &gopherschwift.Options{
-			UserAgent: "swift-http-import/" + util.Version,
-		})
-		if err != nil {
-			return fmt.Errorf("cannot wrap Swift client: %s", err.Error())
+		if regionName == "" {
+			regionName = os.Getenv("OS_REGION_NAME")
 		}
-
-		accountCache[key] = s.Account
 	}
-
-	//create target container if missing
-	if s.ContainerName == "" {
-		s.Container = nil
-		return nil
-	}
-	var err error
-	s.Container, err = s.Account.Container(s.ContainerName).EnsureExists()
-	return err
+	return authOptions, regionName, nil
 }
 
 //ObjectAtPath returns an Object instance for the object at the given path
@@ -300,8 +517,15 @@ func (s *SwiftLocation) listFiles(path string, recursively bool) ([]FileSpec, *L
 
 			if info.SymlinkTarget != nil && info.SymlinkTarget.Container().IsEqualTo(s.Container) {
 				targetPath := info.SymlinkTarget.Name()
-				if strings.HasPrefix(targetPath, s.ObjectNamePrefix) {
+				prefixDir := strings.TrimSuffix(s.ObjectNamePrefix, "/") + "/"
+				if s.ObjectNamePrefix == "" || strings.HasPrefix(targetPath, prefixDir) {
 					result[idx].SymlinkTargetPath = strings.TrimPrefix(targetPath, s.ObjectNamePrefix)
+				} else {
+					//the target may still be transferred by a different job (see SymlinkSource)
+					relPath, err := filepath.Rel("/"+prefixDir, "/"+targetPath)
+					if err == nil {
+						result[idx].SymlinkTargetPath = relPath
+					}
 				}
 			}
 		}
@@ -309,6 +533,12 @@ func (s *SwiftLocation) listFiles(path string, recursively bool) ([]FileSpec, *L
 	return result, nil
 }
 
+//SymlinkRoot implements the SymlinkSource interface.
+func (s *SwiftLocation) SymlinkRoot() (namespace, rootPath string, err error) {
+	namespace, err = s.Container.URL()
+	return namespace, s.ObjectNamePrefix, err
+}
+
 //GetFile implements the Source interface.
 func (s *SwiftLocation) GetFile(path string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
 	object := s.ObjectAtPath(path)
@@ -328,19 +558,30 @@ func (s *SwiftLocation) GetFile(path string, requestHeaders schwift.ObjectHeader
 		return nil, FileState{}, err
 	}
 
+	return body, swiftFileState(hdr), nil
+}
+
+//Returns the FileState for a Swift object with the given headers.
+func swiftFileState(hdr schwift.ObjectHeaders) FileState {
 	var expiryTime *time.Time
 	if hdr.ExpiresAt().Exists() {
 		t := hdr.ExpiresAt().Get()
 		expiryTime = &t
 	}
 
-	return body, FileState{
+	return FileState{
 		Etag:         hdr.Etag().Get(),
 		LastModified: hdr.Get("Last-Modified"),
 		SizeBytes:    int64(hdr.SizeBytes().Get()),
 		ExpiryTime:   expiryTime,
 		ContentType:  hdr.ContentType().Get(),
-	}, nil
+	}
+}
+
+//Returns whether both locations refer to the same Swift account with the same
+//credentials, so that objects can be copied between them on the server side.
+func (s SwiftLocation) isSameAccount(other SwiftLocation) bool {
+	return s.cacheKey("") == other.cacheKey("")
 }
 
 //DiscoverExistingFiles finds all objects that currently exist in this location
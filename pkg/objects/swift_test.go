@@ -0,0 +1,263 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testCloudsYAML = `
+clouds:
+  mycloud:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      application_credential_id: 80e810bf385949ae8f0e251f90269515
+    region_name: region-one
+    auth_type: v3applicationcredential
+`
+
+const testSecureYAML = `
+clouds:
+  mycloud:
+    auth:
+      application_credential_secret: eixohMoo1on5ohng
+`
+
+func TestSwiftLocationAuthOptionsFromCloudsYAML(t *testing.T) {
+	//clouds.yaml and secure.yaml are searched in the current directory first
+	tempDir, err := ioutil.TempDir("", "swift-http-import-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	for fileName, contents := range map[string]string{"clouds.yaml": testCloudsYAML, "secure.yaml": testSecureYAML} {
+		err := ioutil.WriteFile(filepath.Join(tempDir, fileName), []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	oldWorkingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.Chdir(tempDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir(oldWorkingDir)
+
+	s := SwiftLocation{Cloud: "mycloud", ContainerName: "foo"}
+	if errs := s.Validate("swift"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	authOptions, regionName, err := s.authOptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if authOptions.IdentityEndpoint != "https://keystone.example.com/v3" {
+		t.Errorf("unexpected auth URL: %q", authOptions.IdentityEndpoint)
+	}
+	if authOptions.ApplicationCredentialID != "80e810bf385949ae8f0e251f90269515" {
+		t.Errorf("unexpected application credential ID: %q", authOptions.ApplicationCredentialID)
+	}
+	if authOptions.ApplicationCredentialSecret != "eixohMoo1on5ohng" {
+		t.Errorf("expected application credential secret from secure.yaml, got %q", authOptions.ApplicationCredentialSecret)
+	}
+	if regionName != "region-one" {
+		t.Errorf("expected region name %q, got %q", "region-one", regionName)
+	}
+
+	//inline credentials cannot be combined with clouds.yaml
+	s = SwiftLocation{Cloud: "mycloud", ContainerName: "foo", Password: "secret"}
+	if errs := s.Validate("swift"); len(errs) != 1 {
+		t.Errorf("expected 1 validation error, got %d", len(errs))
+	}
+}
+
+//A minimal Swift cluster with TempAuth. Each authentication issues a new token
+//and revokes all previous tokens.
+type testTempAuthServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	authCount int
+	token     string
+}
+
+func newTestTempAuthServer() *testTempAuthServer {
+	s := &testTempAuthServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if r.URL.Path == "/auth/v1.0" {
+			if r.Header.Get("X-Auth-User") != "test:tester" || r.Header.Get("X-Auth-Key") != "testing" {
+				http.Error(w, "invalid credentials", http.StatusUnauthorized)
+				return
+			}
+			s.authCount++
+			s.token = fmt.Sprintf("AUTH_tk%d", s.authCount)
+			w.Header().Set("X-Storage-Url", s.URL+"/v1/AUTH_test")
+			w.Header().Set("X-Auth-Token", s.token)
+			return
+		}
+		if r.Header.Get("X-Auth-Token") != s.token {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/AUTH_test/foo/":
+			if r.Method == "PUT" {
+				w.WriteHeader(http.StatusAccepted)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+func (s *testTempAuthServer) revokeToken(newToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = newToken
+}
+
+func TestSwiftLocationWithTempAuth(t *testing.T) {
+	server := newTestTempAuthServer()
+	defer server.Close()
+
+	s := SwiftLocation{
+		AuthURL:       server.URL + "/auth/v1.0",
+		TempAuthUser:  "test:tester",
+		TempAuthKey:   "testing",
+		ContainerName: "foo",
+	}
+	if errs := s.Validate("swift"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := s.Connect("swift")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//when the token is revoked, we should transparently authenticate again
+	server.revokeToken("")
+	_, err = s.Container.Headers()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if server.authCount != 2 {
+		t.Errorf("expected 2 authentications, got %d", server.authCount)
+	}
+
+	//TempAuth cannot be combined with Keystone credentials
+	s = SwiftLocation{AuthURL: server.URL + "/auth/v1.0", TempAuthUser: "test:tester", TempAuthKey: "testing", UserName: "tester", ContainerName: "foo"}
+	if errs := s.Validate("swift"); len(errs) != 1 {
+		t.Errorf("expected 1 validation error, got %d", len(errs))
+	}
+}
+
+func TestSwiftLocationWithTokenFile(t *testing.T) {
+	server := newTestTempAuthServer()
+	defer server.Close()
+	server.revokeToken("AUTH_tkfirst")
+
+	tempDir, err := ioutil.TempDir("", "swift-http-import-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	tokenFilePath := filepath.Join(tempDir, "token")
+	err = ioutil.WriteFile(tokenFilePath, []byte("AUTH_tkfirst\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := SwiftLocation{
+		StorageURL:    server.URL + "/v1/AUTH_test",
+		AuthTokenFile: tokenFilePath,
+		ContainerName: "foo",
+	}
+	if errs := s.Validate("swift"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err = s.Connect("swift")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//when the token is replaced by an external process, we should pick up the
+	//new token from the file
+	server.revokeToken("AUTH_tksecond")
+	err = ioutil.WriteFile(tokenFilePath, []byte("AUTH_tksecond\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = s.Container.Headers()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//auth_token and auth_token_file are mutually exclusive
+	s = SwiftLocation{StorageURL: server.URL + "/v1/AUTH_test", AuthToken: "AUTH_tkfirst", AuthTokenFile: tokenFilePath, ContainerName: "foo"}
+	if errs := s.Validate("swift"); len(errs) != 1 {
+		t.Errorf("expected 1 validation error, got %d", len(errs))
+	}
+}
+
+func TestTargetsInheritRegionOnlyWithGlobalCredentials(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	//the first target uses the global credentials, the second one has its own
+	configYAML := fmt.Sprintf(`
+from:
+  url: http://localhost/
+to:
+  - { container: mirror }
+  - { storage_url: %[1]s/v1/AUTH_other, auth_token: unused, container: mirror }
+`, swift.URL)
+	var cfg JobConfiguration
+	err := yaml.Unmarshal([]byte(configYAML), &cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	globalSwift := SwiftLocation{StorageURL: swift.URL + "/v1/AUTH_test", AuthToken: "unused", RegionName: "region-one"}
+	job, errs := cfg.Compile("jobs[0]", globalSwift)
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if region := job.Targets[0].RegionName; region != "region-one" {
+		t.Errorf("expected target with global credentials to inherit region %q, got %q", "region-one", region)
+	}
+	if region := job.Targets[1].RegionName; region != "" {
+		t.Errorf("expected target with own credentials to not inherit the global region, got %q", region)
+	}
+}
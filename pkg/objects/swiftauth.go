@@ -0,0 +1,201 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/swift-http-import/pkg/util"
+)
+
+//swiftTokenAuthenticator obtains a Swift token (and storage URL) without
+//Keystone. It is called once during Connect(), and again whenever Swift
+//rejects the current token.
+type swiftTokenAuthenticator func() (storageURL, token string, err error)
+
+//staticSwiftToken returns a swiftTokenAuthenticator for a pre-issued token.
+//Since there is no way to obtain a new token, a rejected token is an error.
+func staticSwiftToken(storageURL, token string) swiftTokenAuthenticator {
+	return func() (string, string, error) {
+		return storageURL, token, nil
+	}
+}
+
+//swiftTokenFromFile returns a swiftTokenAuthenticator that reads the token
+//from a file, which is expected to be refreshed by some external process.
+func swiftTokenFromFile(storageURL, tokenFilePath string) swiftTokenAuthenticator {
+	return func() (string, string, error) {
+		buf, err := ioutil.ReadFile(tokenFilePath)
+		if err != nil {
+			return "", "", err
+		}
+		token := strings.TrimSpace(string(buf))
+		if token == "" {
+			return "", "", fmt.Errorf("file %s is empty", tokenFilePath)
+		}
+		return storageURL, token, nil
+	}
+}
+
+//swiftTempAuth returns a swiftTokenAuthenticator for the TempAuth v1 protocol
+//(as used by Swift's tempauth middleware or by swauth).
+func swiftTempAuth(authURL, user, key string) swiftTokenAuthenticator {
+	return func() (string, string, error) {
+		req, err := http.NewRequest("GET", authURL, nil)
+		if err != nil {
+			return "", "", err
+		}
+		req.Header.Set("X-Auth-User", user)
+		req.Header.Set("X-Auth-Key", key)
+		req.Header.Set("User-Agent", "swift-http-import/"+util.Version)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body) //nolint:errcheck
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return "", "", fmt.Errorf("GET %s returned status %s", authURL, resp.Status)
+		}
+		storageURL := resp.Header.Get("X-Storage-Url")
+		token := resp.Header.Get("X-Auth-Token")
+		if storageURL == "" || token == "" {
+			return "", "", fmt.Errorf("GET %s did not return X-Storage-Url and X-Auth-Token", authURL)
+		}
+		return storageURL, token, nil
+	}
+}
+
+//swiftTokenBackend is a schwift.Backend that authenticates with a Swift token
+//that was obtained without Keystone.
+type swiftTokenBackend struct {
+	endpointURL string
+	auth        *swiftTokenAuth
+}
+
+//swiftTokenAuth holds the current token. It is shared between all clones of
+//a swiftTokenBackend.
+type swiftTokenAuth struct {
+	authenticate swiftTokenAuthenticator
+	canRenew     bool
+	token        string
+	mutex        sync.Mutex
+}
+
+//Connects to Swift with the given swiftTokenAuthenticator. If canRenew is
+//false, rejected tokens will not be renewed.
+func newSwiftTokenAccount(authenticate swiftTokenAuthenticator, canRenew bool) (*schwift.Account, error) {
+	storageURL, token, err := authenticate()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(storageURL, "/") {
+		storageURL += "/"
+	}
+	return schwift.InitializeAccount(&swiftTokenBackend{
+		endpointURL: storageURL,
+		auth: &swiftTokenAuth{
+			authenticate: authenticate,
+			canRenew:     canRenew,
+			token:        token,
+		},
+	})
+}
+
+//Returns the current token.
+func (a *swiftTokenAuth) getToken() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.token
+}
+
+//Obtains a new token, unless another request has already done so after the
+//given token was rejected.
+func (a *swiftTokenAuth) renewToken(rejectedToken string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.token != rejectedToken {
+		return nil
+	}
+	_, token, err := a.authenticate()
+	if err != nil {
+		return err
+	}
+	if token == rejectedToken {
+		return errors.New("no new token available")
+	}
+	a.token = token
+	return nil
+}
+
+//EndpointURL implements the schwift.Backend interface.
+func (b *swiftTokenBackend) EndpointURL() string {
+	return b.endpointURL
+}
+
+//Clone implements the schwift.Backend interface.
+func (b *swiftTokenBackend) Clone(newEndpointURL string) schwift.Backend {
+	return &swiftTokenBackend{
+		endpointURL: newEndpointURL,
+		auth:        b.auth,
+	}
+}
+
+//Do implements the schwift.Backend interface.
+func (b *swiftTokenBackend) Do(req *http.Request) (*http.Response, error) {
+	token := b.auth.getToken()
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("User-Agent", "swift-http-import/"+util.Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !b.auth.canRenew {
+		return resp, err
+	}
+
+	//token was rejected -> obtain a new token and restart the request (this
+	//follows what gopherschwift does for Keystone tokens)
+	io.Copy(ioutil.Discard, resp.Body) //nolint:errcheck
+	resp.Body.Close()
+	logg.Info("Swift rejected our token, trying to obtain a new one")
+	err = b.auth.renewToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("cannot renew Swift token after receiving 401: %s", err.Error())
+	}
+	if req.Body != nil {
+		seekableReqBody, ok := req.Body.(io.Seeker)
+		if !ok {
+			return nil, errors.New("cannot restart request after receiving 401: request body is not seekable")
+		}
+		_, err := seekableReqBody.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("X-Auth-Token", b.auth.getToken())
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,207 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/swift-http-import/pkg/util"
+)
+
+//SwiftURLSource is a Swift container that is accessed via its URL without
+//Keystone credentials, either because the container is public, or because
+//objects can be downloaded with temp URLs. This type reuses the listing and
+//download logic of SwiftLocation.
+type SwiftURLSource struct {
+	//options from config file
+	URLString     string       `yaml:"url"`
+	TempURLKey    AuthPassword `yaml:"temp_url_key"`
+	TempURLDigest string       `yaml:"temp_url_digest"`
+	//compiled configuration
+	endpointURL string         `yaml:"-"`
+	location    *SwiftLocation `yaml:"-"`
+}
+
+//Matches a Swift container URL like
+//"https://swift.example.com/v1/AUTH_projectid/container/optional/prefix/".
+var swiftContainerURLRx = regexp.MustCompile(`^(https?://[^?#]+/v1/[^/?#]+/)([^/?#]+)(?:/([^?#]*))?$`)
+
+//Temp URL signatures are valid for this long, which needs to cover the whole
+//transfer of a single file (including all segments of a segmented download).
+const swiftTempURLValidity = 24 * time.Hour
+
+//Validate implements the Source interface.
+func (s *SwiftURLSource) Validate(name string) (result []error) {
+	match := swiftContainerURLRx.FindStringSubmatch(s.URLString)
+	if match == nil {
+		result = append(result, fmt.Errorf(`invalid value for %s.url: expected "https://host/v1/ACCOUNT/CONTAINER/", got %q`, name, s.URLString))
+	} else {
+		s.endpointURL = match[1]
+		s.location = &SwiftLocation{
+			ContainerName:    match[2],
+			ObjectNamePrefix: strings.TrimSuffix(match[3], "/"),
+		}
+	}
+
+	switch s.TempURLDigest {
+	case "":
+		s.TempURLDigest = "sha256"
+	case "sha1", "sha256", "sha512":
+		//ok
+	default:
+		result = append(result, fmt.Errorf(`invalid value for %s.temp_url_digest: expected "sha1", "sha256" or "sha512", got %q`, name, s.TempURLDigest))
+	}
+	if s.TempURLKey == "" && s.TempURLDigest != "sha256" {
+		result = append(result, fmt.Errorf("invalid value for %s.temp_url_digest: only allowed when %s.temp_url_key is given", name, name))
+	}
+
+	return
+}
+
+//Connect implements the Source interface.
+func (s *SwiftURLSource) Connect(name string) error {
+	backend := &swiftURLBackend{
+		endpointURL:   s.endpointURL,
+		tempURLKey:    string(s.TempURLKey),
+		tempURLDigest: s.TempURLDigest,
+	}
+	account, err := schwift.InitializeAccount(backend)
+	if err != nil {
+		return err
+	}
+	s.location.Account = account
+	//we cannot check whether the container exists since we may not be allowed
+	//to HEAD it, but the listing will complain if it does not
+	s.location.Container = account.Container(s.location.ContainerName)
+	return nil
+}
+
+//ListAllFiles implements the Source interface.
+func (s *SwiftURLSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
+	result, lerr := s.location.ListAllFiles()
+	return result, explainSwiftURLListingError(lerr)
+}
+
+//ListEntries implements the Source interface.
+func (s *SwiftURLSource) ListEntries(path string) ([]FileSpec, *ListEntriesError) {
+	result, lerr := s.location.ListEntries(path)
+	return result, explainSwiftURLListingError(lerr)
+}
+
+//Temp URLs only work for objects, so we always need anonymous access to the
+//container listing. This adds a hint to the error message when that fails.
+func explainSwiftURLListingError(lerr *ListEntriesError) *ListEntriesError {
+	if lerr != nil && (schwift.Is(lerr.Inner, http.StatusUnauthorized) || schwift.Is(lerr.Inner, http.StatusForbidden)) {
+		lerr.Message += ` (anonymous listing requires the container read ACL ".r:*,.rlistings")`
+	}
+	return lerr
+}
+
+//SymlinkRoot implements the SymlinkSource interface.
+func (s *SwiftURLSource) SymlinkRoot() (namespace, rootPath string, err error) {
+	return s.location.SymlinkRoot()
+}
+
+//GetFile implements the Source interface.
+func (s *SwiftURLSource) GetFile(path string, requestHeaders schwift.ObjectHeaders) (io.ReadCloser, FileState, error) {
+	return s.location.GetFile(path, requestHeaders)
+}
+
+//swiftURLBackend is a schwift.Backend that does not send auth tokens.
+//Requests for objects are signed with the temp URL key, if any.
+type swiftURLBackend struct {
+	endpointURL   string
+	tempURLKey    string
+	tempURLDigest string
+}
+
+//EndpointURL implements the schwift.Backend interface.
+func (b *swiftURLBackend) EndpointURL() string {
+	return b.endpointURL
+}
+
+//Clone implements the schwift.Backend interface.
+func (b *swiftURLBackend) Clone(newEndpointURL string) schwift.Backend {
+	clone := *b
+	clone.endpointURL = newEndpointURL
+	return &clone
+}
+
+//Do implements the schwift.Backend interface.
+func (b *swiftURLBackend) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", "swift-http-import/"+util.Version)
+	if b.tempURLKey != "" && (req.Method == "GET" || req.Method == "HEAD") && isSwiftObjectPath(req.URL.Path) {
+		//GET signatures are also valid for HEAD requests
+		expires := time.Now().Add(swiftTempURLValidity).Unix()
+		query := req.URL.Query()
+		query.Set("temp_url_sig", b.signTempURL("GET", expires, req.URL.Path))
+		query.Set("temp_url_expires", strconv.FormatInt(expires, 10))
+		req.URL.RawQuery = query.Encode()
+	}
+	return http.DefaultClient.Do(req)
+}
+
+//Returns whether the given URL path (e.g. "/v1/AUTH_foo/bar/baz") refers to
+//an object rather than an account or container.
+func isSwiftObjectPath(path string) bool {
+	idx := strings.Index(path, "/v1/")
+	if idx < 0 {
+		return false
+	}
+	fields := strings.SplitN(path[idx+4:], "/", 3)
+	return len(fields) == 3 && fields[2] != ""
+}
+
+//Computes the temp URL signature for the given request, as described in
+//<https://docs.openstack.org/swift/latest/middleware.html#tempurl>.
+func (b *swiftURLBackend) signTempURL(method string, expires int64, path string) string {
+	var newHash func() hash.Hash
+	switch b.tempURLDigest {
+	case "sha1":
+		newHash = sha1.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, []byte(b.tempURLKey))
+	fmt.Fprintf(mac, "%s\n%d\n%s", method, expires, path)
+	sum := mac.Sum(nil)
+
+	//SHA-512 signatures are only accepted in this prefixed form
+	if b.tempURLDigest == "sha512" {
+		return "sha512:" + base64.URLEncoding.EncodeToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
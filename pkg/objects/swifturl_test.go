@@ -0,0 +1,110 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/majewsky/schwift"
+)
+
+func TestSwiftURLSourceWithTempURLKey(t *testing.T) {
+	//this server has a publicly listable container, but objects can only be
+	//downloaded with a valid temp URL signature
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/AUTH_test/public/":
+			if r.URL.Query().Get("format") != "json" || r.URL.Query().Get("prefix") != "dir/" {
+				http.Error(w, "unexpected query: "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("marker") != "" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[
+				{"name":"dir/file.txt","bytes":5,"hash":"5d41402abc4b2a76b9719d911017c592","content_type":"text/plain","last_modified":"2020-09-01T12:00:00.000000"},
+				{"name":"dir/link.txt","bytes":0,"hash":"d41d8cd98f00b204e9800998ecf8427e","content_type":"text/plain","last_modified":"2020-09-01T12:00:00.000000","symlink_path":"/v1/AUTH_test/public/dir/file.txt"}
+			]`))
+		case "/v1/AUTH_test/public/dir/file.txt":
+			mac := hmac.New(sha256.New, []byte("secret"))
+			fmt.Fprintf(mac, "GET\n%s\n%s", r.URL.Query().Get("temp_url_expires"), r.URL.Path)
+			if r.URL.Query().Get("temp_url_sig") != hex.EncodeToString(mac.Sum(nil)) {
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Etag", "5d41402abc4b2a76b9719d911017c592")
+			w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source := SwiftURLSource{
+		URLString:  server.URL + "/v1/AUTH_test/public/dir/",
+		TempURLKey: "secret",
+	}
+	if errs := source.Validate("source"); len(errs) > 0 {
+		t.Fatal(errs[0].Error())
+	}
+	err := source.Connect("source")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	files, lerr := source.ListAllFiles()
+	if lerr != nil {
+		t.Fatal(lerr.FullMessage())
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+	if files[0].Path != "/file.txt" || files[0].SymlinkTargetPath != "" {
+		t.Errorf("unexpected file: %#v", files[0])
+	}
+	if files[1].Path != "/link.txt" || files[1].SymlinkTargetPath != "/file.txt" {
+		t.Errorf("unexpected symlink: %#v", files[1])
+	}
+
+	body, sourceState, err := source.GetFile("/file.txt", schwift.NewObjectHeaders())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "hello" {
+		t.Errorf("expected file contents %q, got %q", "hello", string(contents))
+	}
+	if sourceState.Etag != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("unexpected Etag: %q", sourceState.Etag)
+	}
+}
@@ -0,0 +1,128 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"path"
+	"strings"
+
+	"github.com/majewsky/schwift"
+)
+
+//SymlinkSource is an extension interface for Source types that can report
+//symlinks (see FileSpec.SymlinkTargetPath). When multiple jobs read from the
+//same namespace (e.g. from different prefixes of the same Swift container),
+//symlinks can be resolved across these jobs.
+type SymlinkSource interface {
+	Source
+	//SymlinkRoot returns an identifier for the namespace that this source reads
+	//from (e.g. the URL of the Swift container), and the path of this source's
+	//root directory within that namespace.
+	SymlinkRoot() (namespace, rootPath string, err error)
+}
+
+//SymlinkTarget identifies the file that a symlink refers to. The file may
+//belong to a different job than the symlink, as long as it is transferred
+//into the same target container(s).
+type SymlinkTarget struct {
+	Job  *Job
+	Path string
+	//whether the file is a symlink itself
+	IsSymlink bool
+}
+
+//SymlinkTargetLocation returns the location of this symlink's target within
+//the namespace of the job's source (see SymlinkSource). If the file is not a
+//symlink or the source does not support symlinks, false is returned.
+func (f File) SymlinkTargetLocation() (namespace, targetPath string, ok bool) {
+	source, isSymlinkSource := f.Job.Source.(SymlinkSource)
+	if !isSymlinkSource || f.Spec.SymlinkTargetPath == "" {
+		return "", "", false
+	}
+	namespace, rootPath, err := source.SymlinkRoot()
+	if err != nil {
+		return "", "", false
+	}
+	return namespace, path.Join("/", rootPath, f.Spec.SymlinkTargetPath), true
+}
+
+//PathInSource returns the path of the given location (as returned by
+//File.SymlinkTargetLocation()) relative to this job's source root. If the
+//location is outside of this job's source, false is returned.
+func (j *Job) PathInSource(namespace, targetPath string) (string, bool) {
+	source, isSymlinkSource := j.Source.(SymlinkSource)
+	if !isSymlinkSource {
+		return "", false
+	}
+	ownNamespace, rootPath, err := source.SymlinkRoot()
+	if err != nil || ownNamespace != namespace {
+		return "", false
+	}
+	rootPath = path.Join("/", rootPath)
+	if rootPath == "/" {
+		return targetPath, true
+	}
+	if !strings.HasPrefix(targetPath, rootPath+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(targetPath, rootPath), true
+}
+
+//CanSymlinkTo returns whether symlinks transferred by this job may refer to
+//files transferred by the other job. This requires the other job to write into
+//all target containers of this job.
+func (j *Job) CanSymlinkTo(other *Job) bool {
+	if j == other {
+		return true
+	}
+	//snapshots are pruned independently of each other, so symlinks into
+	//another job's snapshot could dangle
+	if j.Snapshots != nil || other.Snapshots != nil {
+		return false
+	}
+	for _, target := range j.Targets {
+		if other.targetInContainerOf(target) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the target of this job that writes into the same container as the
+//given location, or nil if there is none.
+func (j *Job) targetInContainerOf(location *SwiftLocation) *SwiftLocation {
+	for _, target := range j.Targets {
+		if target.Container.IsEqualTo(location.Container) {
+			return target
+		}
+	}
+	return nil
+}
+
+//Returns the object that the symlink target is transferred into in the
+//container of the given location, or nil if it is not transferred into that
+//container.
+func (st SymlinkTarget) objectIn(location *SwiftLocation) *schwift.Object {
+	target := st.Job.targetInContainerOf(location)
+	if target == nil {
+		return nil
+	}
+	return target.ObjectAtPath(st.Path)
+}
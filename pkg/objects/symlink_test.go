@@ -0,0 +1,121 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestSymlinksAcrossJobs(t *testing.T) {
+	swift := newFakeSwift()
+	defer swift.Close()
+
+	swift.containers["/v1/AUTH_test/source"] = true
+	swift.objects["/v1/AUTH_test/source/b/file"] = &fakeSwiftObject{
+		Contents: []byte("hello world"),
+		Headers:  http.Header{"Etag": {"5eb63bbbe01eeed093cb22bb8f5acdc3"}},
+	}
+	swift.objects["/v1/AUTH_test/source/a/link"] = &fakeSwiftObject{
+		Headers: http.Header{"X-Symlink-Target": {"source/b/file"}},
+	}
+
+	compile := func(prefix, targetContainer, extraConfig string) *Job {
+		t.Helper()
+		configYAML := fmt.Sprintf(`
+from:
+  storage_url: %[1]s/v1/AUTH_test
+  auth_token: unused
+  container: source
+  object_prefix: %[2]s/
+to:
+  storage_url: %[1]s/v1/AUTH_test
+  auth_token: unused
+  container: %[3]s
+  object_prefix: %[2]s
+%[4]s`, swift.URL, prefix, targetContainer, extraConfig)
+		return compileTestJob(t, configYAML)
+	}
+	jobA := compile("a", "mirror", "")
+	jobB := compile("b", "mirror", "")
+
+	//the symlink target is outside of the first job's source, but inside the second job's source
+	files, lerr := jobA.Source.ListAllFiles()
+	if lerr != nil {
+		t.Fatalf("%s: %s", lerr.Location, lerr.Message)
+	}
+	if len(files) != 1 || files[0].SymlinkTargetPath != "../b/file" {
+		t.Fatalf("expected symlink to ../b/file, got %#v", files)
+	}
+	link := File{Job: jobA, Spec: files[0]}
+	namespace, targetPath, ok := link.SymlinkTargetLocation()
+	if !ok || targetPath != "/b/file" {
+		t.Fatalf("expected symlink target location /b/file, got %q (ok = %t)", targetPath, ok)
+	}
+	if _, ok := jobA.PathInSource(namespace, targetPath); ok {
+		t.Error("expected symlink target to be outside of the first job's source")
+	}
+	filePath, ok := jobB.PathInSource(namespace, targetPath)
+	if !ok || filePath != "/file" {
+		t.Errorf("expected symlink target to be /file in the second job's source, got %q (ok = %t)", filePath, ok)
+	}
+
+	//symlinks can only refer to jobs that write into the same container
+	if !jobA.CanSymlinkTo(jobB) {
+		t.Error("expected jobs writing into the same container to allow symlinks between them")
+	}
+	if jobA.CanSymlinkTo(compile("b", "other", "")) {
+		t.Error("expected jobs writing into different containers to not allow symlinks between them")
+	}
+	if jobA.CanSymlinkTo(compile("b", "mirror", "snapshots:\n  retention: 1\n")) {
+		t.Error("expected jobs with snapshots to not allow symlinks between them")
+	}
+
+	//transfer the target, then the symlink
+	results, _ := File{Job: jobB, Spec: FileSpec{Path: filePath}}.PerformTransfer(jobB.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected transfer of symlink target to succeed, got %d", results[0])
+	}
+	link.SymlinkTarget = &SymlinkTarget{Job: jobB, Path: filePath}
+	results, _ = link.PerformTransfer(jobA.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected transfer of symlink to succeed, got %d", results[0])
+	}
+	obj := swift.object("AUTH_test/mirror/a/link")
+	if obj == nil {
+		t.Fatal("symlink was not uploaded")
+	}
+	if target := obj.Headers.Get("X-Symlink-Target"); target != "mirror/b/file" {
+		t.Errorf("expected symlink to mirror/b/file, got %q", target)
+	}
+
+	//without a resolved target, the symlink is transferred as a regular file
+	link.SymlinkTarget = nil
+	delete(swift.objects, "/v1/AUTH_test/mirror/a/link")
+	results, _ = link.PerformTransfer(jobA.Targets)
+	if results[0] != TransferSuccess {
+		t.Fatalf("expected transfer of unresolved symlink to succeed, got %d", results[0])
+	}
+	obj = swift.object("AUTH_test/mirror/a/link")
+	if obj == nil || obj.Headers.Get("X-Symlink-Target") != "" || string(obj.Contents) != "hello world" {
+		t.Errorf("expected unresolved symlink to be uploaded as a regular file, got %#v", obj)
+	}
+}
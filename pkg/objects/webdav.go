@@ -0,0 +1,162 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//the request body for PROPFIND requests, which restricts the response to the
+//properties that we are interested in
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+	<D:prop>
+		<D:resourcetype/>
+		<D:getcontentlength/>
+		<D:getlastmodified/>
+		<D:getetag/>
+	</D:prop>
+</D:propfind>
+`
+
+//webdavMultistatus is the response body of a PROPFIND request.
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				Etag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+//Implementation of URLSource.ListEntries() and URLSource.ListAllFiles() for
+//`listing_format: webdav`. The `depth` argument is the value of the Depth
+//header, either "1" for a single directory or "infinity" for a recursive
+//listing.
+func (u URLSource) listEntriesViaWebDAV(uri *url.URL, directoryPath, depth string) ([]FileSpec, *ListEntriesError) {
+	logg.Debug("scraping %s with PROPFIND (Depth: %s)", uri, depth)
+
+	req, err := http.NewRequest("PROPFIND", uri.String(), strings.NewReader(webdavPropfindBody))
+	if err != nil {
+		return nil, &ListEntriesError{uri.String(), "PROPFIND failed", err}
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	response, err := u.HTTPClient.Do(req)
+	if err != nil {
+		return nil, &ListEntriesError{uri.String(), "PROPFIND failed", err}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusMultiStatus {
+		if depth == "infinity" {
+			//many servers refuse to do recursive listings; fall back to
+			//listing each directory separately
+			logg.Debug("PROPFIND %s with Depth: infinity returned status %s, falling back to Depth: 1", uri, response.Status)
+			return nil, ErrListAllFilesNotSupported
+		}
+		return nil, &ListEntriesError{uri.String(), "PROPFIND returned status " + response.Status, nil}
+	}
+
+	var multistatus webdavMultistatus
+	err = xml.NewDecoder(response.Body).Decode(&multistatus)
+	if err != nil && err != io.EOF {
+		return nil, &ListEntriesError{uri.String(), "cannot parse PROPFIND response", err}
+	}
+
+	var result []FileSpec
+	for _, resp := range multistatus.Responses {
+		hrefURL, err := url.Parse(resp.Href)
+		if err != nil {
+			logg.Error("scrape %s: ignoring href '%s' which is not a valid URL", uri.String(), resp.Href)
+			continue
+		}
+		//hrefs are usually absolute paths, sometimes full URLs
+		hrefURL = uri.ResolveReference(hrefURL)
+		if hrefURL.Host != uri.Host {
+			continue
+		}
+
+		//ignore the directory itself, and everything outside of it
+		if !strings.HasPrefix(hrefURL.Path, uri.Path) {
+			continue
+		}
+		relPath := strings.TrimPrefix(hrefURL.Path, uri.Path)
+		if strings.Trim(relPath, "/") == "" || dotdotRx.MatchString(relPath) {
+			continue
+		}
+
+		spec := FileSpec{Path: filepath.Join(directoryPath, relPath)}
+		for _, propstat := range resp.Propstats {
+			//properties that the server does not know are reported with status 404
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			if prop.ResourceType.Collection != nil {
+				spec.IsDirectory = true
+			}
+			if prop.ContentLength != "" {
+				size, err := strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64)
+				if err == nil {
+					spec.SizeBytes = &size
+				}
+			}
+			if prop.LastModified != "" {
+				mtime, err := http.ParseTime(strings.TrimSpace(prop.LastModified))
+				if err == nil {
+					spec.LastModified = &mtime
+				}
+			}
+			if prop.Etag != "" {
+				spec.Etag = strings.TrimSpace(prop.Etag)
+			}
+		}
+
+		if spec.IsDirectory {
+			//in a recursive listing, subdirectories do not need to be listed again
+			if depth == "infinity" {
+				continue
+			}
+			spec.SizeBytes = nil
+			spec.LastModified = nil
+			spec.Etag = ""
+		}
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
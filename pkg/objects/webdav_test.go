@@ -0,0 +1,238 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//a Depth: 1 listing in the style of Apache's mod_dav, with namespace prefixes,
+//the collection itself, a property that the server does not know (reported
+//with status 404), and percent-encoded hrefs
+const webdavPrefixedListing = `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:">
+<D:response>
+	<D:href>/files/</D:href>
+	<D:propstat>
+		<D:prop>
+			<D:resourcetype><D:collection/></D:resourcetype>
+			<D:getlastmodified>Mon, 12 Oct 2020 09:00:00 GMT</D:getlastmodified>
+		</D:prop>
+		<D:status>HTTP/1.1 200 OK</D:status>
+	</D:propstat>
+</D:response>
+<D:response>
+	<D:href>/files/foo.tar.gz</D:href>
+	<D:propstat>
+		<D:prop>
+			<D:resourcetype/>
+			<D:getcontentlength>42</D:getcontentlength>
+			<D:getlastmodified>Mon, 12 Oct 2020 10:00:00 GMT</D:getlastmodified>
+			<D:getetag>"abc123"</D:getetag>
+		</D:prop>
+		<D:status>HTTP/1.1 200 OK</D:status>
+	</D:propstat>
+</D:response>
+<D:response>
+	<D:href>/files/release%20notes.txt</D:href>
+	<D:propstat>
+		<D:prop>
+			<D:resourcetype/>
+			<D:getcontentlength>123</D:getcontentlength>
+		</D:prop>
+		<D:status>HTTP/1.1 200 OK</D:status>
+	</D:propstat>
+	<D:propstat>
+		<D:prop>
+			<D:getlastmodified>Mon, 12 Oct 2020 10:00:00 GMT</D:getlastmodified>
+			<D:getetag>"bogus"</D:getetag>
+		</D:prop>
+		<D:status>HTTP/1.1 404 Not Found</D:status>
+	</D:propstat>
+</D:response>
+<D:response>
+	<D:href>/files/sub%20dir/</D:href>
+	<D:propstat>
+		<D:prop>
+			<D:resourcetype><D:collection/></D:resourcetype>
+			<D:getlastmodified>Mon, 12 Oct 2020 09:00:00 GMT</D:getlastmodified>
+		</D:prop>
+		<D:status>HTTP/1.1 200 OK</D:status>
+	</D:propstat>
+</D:response>
+<D:response>
+	<D:href>/other/outside.txt</D:href>
+	<D:propstat>
+		<D:prop>
+			<D:resourcetype/>
+			<D:getcontentlength>1</D:getcontentlength>
+		</D:prop>
+		<D:status>HTTP/1.1 200 OK</D:status>
+	</D:propstat>
+</D:response>
+</D:multistatus>
+`
+
+//a Depth: infinity listing in the style of nginx's dav_ext module, with DAV:
+//as the default namespace
+const webdavDefaultNamespaceListing = `<?xml version="1.0" encoding="utf-8" ?>
+<multistatus xmlns="DAV:">
+<response>
+	<href>/files/</href>
+	<propstat>
+		<prop><resourcetype><collection/></resourcetype></prop>
+		<status>HTTP/1.1 200 OK</status>
+	</propstat>
+</response>
+<response>
+	<href>/files/foo.tar.gz</href>
+	<propstat>
+		<prop>
+			<resourcetype/>
+			<getcontentlength>42</getcontentlength>
+			<getlastmodified>Mon, 12 Oct 2020 10:00:00 GMT</getlastmodified>
+		</prop>
+		<status>HTTP/1.1 200 OK</status>
+	</propstat>
+</response>
+<response>
+	<href>/files/sub%20dir/</href>
+	<propstat>
+		<prop><resourcetype><collection/></resourcetype></prop>
+		<status>HTTP/1.1 200 OK</status>
+	</propstat>
+</response>
+<response>
+	<href>/files/sub%20dir/bar.txt</href>
+	<propstat>
+		<prop>
+			<resourcetype/>
+			<getcontentlength>7</getcontentlength>
+			<getlastmodified>Mon, 12 Oct 2020 11:00:00 GMT</getlastmodified>
+		</prop>
+		<status>HTTP/1.1 200 OK</status>
+	</propstat>
+</response>
+</multistatus>
+`
+
+func TestWebDAVListing(t *testing.T) {
+	testCases := []struct {
+		//if Recursive is true, ListAllFiles() is called (with Depth:
+		//infinity), otherwise ListEntries("/")
+		Recursive bool
+		Status    int
+		Body      string
+		Expected  string
+	}{
+		{false, http.StatusMultiStatus, webdavPrefixedListing, `
+			/foo.tar.gz mtime=2020-10-12T10:00:00Z size=42 etag="abc123"
+			/release notes.txt mtime=<nil> size=123 etag=
+			/sub dir/ mtime=<nil> size=<nil> etag=
+		`},
+		//in recursive listings, directories are not reported
+		{true, http.StatusMultiStatus, webdavDefaultNamespaceListing, `
+			/foo.tar.gz mtime=2020-10-12T10:00:00Z size=42 etag=
+			/sub dir/bar.txt mtime=2020-10-12T11:00:00Z size=7 etag=
+		`},
+		{false, http.StatusNotFound, "not found", "error: PROPFIND returned status 404 Not Found"},
+		//servers that refuse Depth: infinity trigger the fallback to ListEntries()
+		{true, http.StatusForbidden, "forbidden", "error: " + ErrListAllFilesNotSupported.Message},
+	}
+
+	for idx, tc := range testCases {
+		var receivedDepth string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PROPFIND" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			receivedDepth = r.Header.Get("Depth")
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(tc.Status)
+			w.Write([]byte(tc.Body))
+		}))
+
+		source := URLSource{
+			URLString:     server.URL + "/files/",
+			ListingFormat: "webdav",
+		}
+		if errs := source.Validate("source"); len(errs) > 0 {
+			t.Fatal(errs[0].Error())
+		}
+		err := source.Connect("source")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var (
+			specs []FileSpec
+			lerr  *ListEntriesError
+		)
+		expectedDepth := "1"
+		if tc.Recursive {
+			specs, lerr = source.ListAllFiles()
+			expectedDepth = "infinity"
+		} else {
+			specs, lerr = source.ListEntries("/")
+		}
+		server.Close()
+
+		var actual string
+		if lerr == nil {
+			actual = formatWebDAVListing(specs)
+		} else {
+			actual = "error: " + lerr.Message
+		}
+		expected := strings.Replace(strings.TrimSpace(tc.Expected), "\t", "", -1)
+		if actual != expected {
+			t.Errorf("testcase %d: expected listing to be parsed into:\n%s\n\nbut got:\n%s", idx, expected, actual)
+		}
+		if receivedDepth != expectedDepth {
+			t.Errorf("testcase %d: expected Depth: %s, got %q", idx, expectedDepth, receivedDepth)
+		}
+		if tc.Status == http.StatusForbidden && lerr != ErrListAllFilesNotSupported {
+			t.Errorf("testcase %d: expected ErrListAllFilesNotSupported, got %#v", idx, lerr)
+		}
+	}
+}
+
+func formatWebDAVListing(specs []FileSpec) string {
+	var lines []string
+	for _, spec := range specs {
+		line := spec.Path
+		if spec.IsDirectory {
+			line += "/"
+		}
+		mtime, size := "<nil>", "<nil>"
+		if spec.LastModified != nil {
+			mtime = spec.LastModified.UTC().Format("2006-01-02T15:04:05Z07:00")
+		}
+		if spec.SizeBytes != nil {
+			size = fmt.Sprintf("%d", *spec.SizeBytes)
+		}
+		lines = append(lines, fmt.Sprintf("%s mtime=%s size=%s etag=%s", line, mtime, size, spec.Etag))
+	}
+	return strings.Join(lines, "\n")
+}
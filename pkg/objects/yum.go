@@ -41,6 +41,7 @@ type YumSource struct {
 	ClientCertificatePath    string   `yaml:"cert"`
 	ClientCertificateKeyPath string   `yaml:"key"`
 	ServerCAPath             string   `yaml:"ca"`
+	HTTPAuth                 HTTPAuth `yaml:",inline"`
 	Architectures            []string `yaml:"arch"`
 	VerifySignature          *bool    `yaml:"verify_signature"`
 	//compiled configuration
@@ -56,6 +57,7 @@ func (s *YumSource) Validate(name string) []error {
 		ClientCertificatePath:    s.ClientCertificatePath,
 		ClientCertificateKeyPath: s.ClientCertificateKeyPath,
 		ServerCAPath:             s.ServerCAPath,
+		HTTPAuth:                 s.HTTPAuth,
 	}
 	s.gpgVerification = true
 	if s.VerifySignature != nil {
@@ -146,15 +148,26 @@ func (s *YumSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
 			Location     struct {
 				Href string `xml:"href,attr"`
 			} `xml:"location"`
+			Checksum struct {
+				Type  string `xml:"type,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"checksum"`
 		} `xml:"package"`
 	}
 	_, _, lerr = s.downloadAndParseXML(href, &primary, cache)
 	if lerr != nil {
 		return nil, lerr
 	}
+	checksums := make(map[string]Checksum)
 	for _, pkg := range primary.Packages {
 		if s.handlesArchitecture(pkg.Architecture) {
 			allFiles = append(allFiles, pkg.Location.Href)
+			//the checksum is only informational (e.g. for deduplication), so
+			//unknown algorithms are not an error
+			checksum, err := NewChecksum(pkg.Checksum.Type, strings.TrimSpace(pkg.Checksum.Value))
+			if err == nil {
+				checksums[pkg.Location.Href] = checksum
+			}
 		}
 	}
 
@@ -215,6 +228,10 @@ func (s *YumSource) ListAllFiles() ([]FileSpec, *ListEntriesError) {
 		if !exists {
 			result[idx] = FileSpec{Path: path}
 		}
+		if checksum, exists := checksums[path]; exists {
+			checksum := checksum
+			result[idx].Checksum = &checksum
+		}
 	}
 	return result, nil
 }
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,33 +30,46 @@ type GPGKeyRing struct {
 //A non-nil error is returned, if signature verification was unsuccessful.
 func VerifyClearSignedGPGSignature(keyring *GPGKeyRing, messageWithSignature []byte) error {
 	block, _ := clearsign.Decode(messageWithSignature)
-	return verifyGPGSignature(keyring, block.Bytes, block.ArmoredSignature)
+	if block == nil {
+		return errors.New("no clear signed message found")
+	}
+	signatureBytes, err := readArmoredSignature(block.ArmoredSignature)
+	if err != nil {
+		return err
+	}
+	return verifyGPGSignature(keyring, block.Bytes, signatureBytes)
 }
 
 //VerifyDetachedGPGSignature takes a message, a detached signature, and a GPGKeyRing to check
-//if the signature is valid. The detached signature is expected to be armored.
+//if the signature is valid. The detached signature may be armored or binary.
 //If the key ring does not contain the concerning public key then the key is downloaded
 //from a pool server and added to the existing key ring.
 //A non-nil error is returned, if signature verification was unsuccessful.
-func VerifyDetachedGPGSignature(keyring *GPGKeyRing, message, armoredSignature []byte) error {
-	block, err := armor.Decode(bytes.NewReader(armoredSignature))
-	if err != nil {
-		return err
+func VerifyDetachedGPGSignature(keyring *GPGKeyRing, message, signature []byte) error {
+	signatureBytes := signature
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN ")) {
+		block, err := armor.Decode(bytes.NewReader(signature))
+		if err != nil {
+			return err
+		}
+		signatureBytes, err = readArmoredSignature(block)
+		if err != nil {
+			return err
+		}
 	}
-	return verifyGPGSignature(keyring, message, block)
+	return verifyGPGSignature(keyring, message, signatureBytes)
 }
 
-func verifyGPGSignature(keyring *GPGKeyRing, message []byte, signature *armor.Block) error {
+func readArmoredSignature(signature *armor.Block) ([]byte, error) {
 	if signature.Type != openpgp.SignatureType {
-		return fmt.Errorf("invalid OpenPGP armored structure: expected %q, got %q", openpgp.SignatureType, signature.Type)
+		return nil, fmt.Errorf("invalid OpenPGP armored structure: expected %q, got %q", openpgp.SignatureType, signature.Type)
 	}
+	return ioutil.ReadAll(signature.Body)
+}
 
+func verifyGPGSignature(keyring *GPGKeyRing, message, signatureBytes []byte) error {
 	var publicKeyBytes []byte
 
-	signatureBytes, err := ioutil.ReadAll(signature.Body)
-	if err != nil {
-		return err
-	}
 	r := packet.NewReader(bytes.NewReader(signatureBytes))
 	for {
 		pkt, err := r.Next()
@@ -101,7 +115,7 @@ func verifyGPGSignature(keyring *GPGKeyRing, message []byte, signature *armor.Bl
 	}
 
 	keyring.Mux.RLock()
-	_, err = openpgp.CheckDetachedSignature(keyring.EntityList, bytes.NewReader(message), bytes.NewReader(signatureBytes))
+	_, err := openpgp.CheckDetachedSignature(keyring.EntityList, bytes.NewReader(message), bytes.NewReader(signatureBytes))
 	keyring.Mux.RUnlock()
 
 	return err
@@ -30,11 +30,6 @@ import (
 	"github.com/sapcc/go-bits/logg"
 )
 
-const (
-	maxTotalRetryCount = 10
-	maxRetryCount      = 3
-)
-
 //EnhancedGet is like http.Client.Get(), but recognizes if the HTTP server
 //understands range requests, and downloads the file in segments in that case.
 func EnhancedGet(client *http.Client, uri string, requestHeaders http.Header, segmentBytes uint64) (*http.Response, error) {
@@ -70,6 +65,8 @@ func EnhancedGet(client *http.Client, uri string, requestHeaders http.Header, se
 		return resp, err
 	}
 
+	d.Ranged = true
+
 	//actual response is 206, but we simulate the behavior of a 200 response
 	resp.Status = "200 OK"
 	resp.StatusCode = 200
@@ -94,6 +91,34 @@ func EnhancedGet(client *http.Client, uri string, requestHeaders http.Header, se
 	return resp, err
 }
 
+//RangedGet downloads the given byte range of a file with a single range
+//request. If etag is not empty, the download fails if the file's Etag does
+//not match (i.e. if the file has changed since it was first requested).
+func RangedGet(client *http.Client, uri string, requestHeaders http.Header, offset, length int64, etag string) (io.ReadCloser, error) {
+	d := downloader{
+		Client:         client,
+		URI:            uri,
+		RequestHeaders: requestHeaders,
+		SegmentBytes:   length,
+		Etag:           etag,
+		BytesRead:      offset,
+		BytesTotal:     -1,
+		Ranged:         true,
+	}
+	resp, headers, err := d.getNextChunk()
+	if err != nil {
+		return nil, err
+	}
+	if headers.ContentRangeStart != offset || headers.ContentRangeLength != length {
+		resp.Body.Close()
+		return nil, fmt.Errorf(
+			"expected range response for %d bytes at offset %d, but got %d bytes at offset %d",
+			length, offset, headers.ContentRangeLength, headers.ContentRangeStart,
+		)
+	}
+	return resp.Body, nil
+}
+
 //downloader is an io.ReadCloser that downloads a file from a Source in
 //segments by using the HTTP request parameter "Range" [RFC 7233].
 //
@@ -112,10 +137,9 @@ type downloader struct {
 	BytesTotal int64         //the total Content-Length the file, or -1 if not known
 	Reader     io.ReadCloser //current, not-yet-exhausted, response.Body, or nil after EOF or error
 	Err        error         //non-nil after error
+	Ranged     bool          //true once the server has answered a range request with 206
 	//retry handling
-	LastErrorAtBytesRead int64 //at which offset the last read error occurred
-	LastErrorRetryCount  int   //retry counter for said offset, or 0 if no error occurred before
-	TotalRetryCount      int   //retry counter for all read errors encountered at any offset
+	Retries ReadRetryCounter
 }
 
 type parsedResponseHeaders struct {
@@ -154,6 +178,14 @@ func (d *downloader) getNextChunk() (*http.Response, *parsedResponseHeaders, err
 		return resp, nil, err
 	}
 
+	//once we know that the server supports range requests, any other response
+	//is an error (e.g. 401 when the server does not accept our credentials
+	//anymore)
+	if d.Ranged && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("GET returned unexpected status code at offset %d: expected 206, but got %d", start, resp.StatusCode)
+	}
+
 	//check Etag
 	etag := resp.Header.Get("Etag")
 	if d.Etag == "" {
@@ -237,7 +269,7 @@ func (d *downloader) Read(buf []byte) (int, error) {
 		d.Reader = nil
 	default:
 		//unexpected read error
-		if !d.shouldRetry() {
+		if !d.Retries.ShouldRetry("GET "+d.URI, d.BytesRead) {
 			return bytesRead, err
 		}
 		logg.Error("restarting GET %s after read error at offset %d: %s",
@@ -280,33 +312,3 @@ func (d *downloader) Close() error {
 	}
 	return nil
 }
-
-//This function is called when a read error is encountered, and decides whether
-//to retry or not.
-func (d *downloader) shouldRetry() bool {
-	//never restart transfer of the same file more than 10 times
-	d.TotalRetryCount++
-	if d.TotalRetryCount > maxTotalRetryCount {
-		logg.Info("giving up on GET %s after %d read errors", d.URI, maxTotalRetryCount)
-		return false
-	}
-
-	//if there was no error at this offset before, always retry
-	if d.LastErrorAtBytesRead != d.BytesRead {
-		d.LastErrorAtBytesRead = d.BytesRead
-		d.LastErrorRetryCount = 0
-		return true
-	}
-
-	//only retry an error at the same offset for 3 times
-	d.LastErrorRetryCount++
-	if d.LastErrorRetryCount > maxRetryCount {
-		logg.Info("giving up on GET %s after %d read errors at the same offset (%d)",
-			d.URI,
-			maxRetryCount,
-			d.LastErrorAtBytesRead,
-		)
-		return false
-	}
-	return true
-}
@@ -19,7 +19,11 @@
 
 package util
 
-import "io"
+import (
+	"errors"
+	"io"
+	"sync"
+)
 
 //FullReader is an io.ReadCloser whose Read() implementation always fills the read
 //buffer as much as possible by calling Base.Read() repeatedly.
@@ -44,3 +48,57 @@ func (r *FullReader) Read(buf []byte) (int, error) {
 func (r *FullReader) Close() error {
 	return r.Base.Close()
 }
+
+//FanOut reads everything from the given source and streams it to all the
+//given consumers concurrently. Each consumer runs in its own goroutine and
+//receives its own reader. A consumer that returns before reading everything
+//does not affect the other consumers. FanOut returns when all consumers have
+//returned.
+//
+//If reading from the source fails, the consumers will see the read error
+//instead of io.EOF.
+func FanOut(source io.Reader, consumers ...func(io.Reader)) {
+	var wg sync.WaitGroup
+	writers := make([]*io.PipeWriter, len(consumers))
+	for idx, consumer := range consumers {
+		reader, writer := io.Pipe()
+		writers[idx] = writer
+		wg.Add(1)
+		go func(consume func(io.Reader), reader *io.PipeReader) {
+			defer wg.Done()
+			consume(reader)
+			//unblock the writing side if the consumer did not read everything
+			reader.CloseWithError(errFanOutConsumerDone)
+		}(consumer, reader)
+	}
+
+	_, err := io.Copy(&fanOutWriter{writers}, source)
+	for _, writer := range writers {
+		writer.CloseWithError(err) //err == nil will cause io.EOF on the reading side
+	}
+	wg.Wait()
+}
+
+var errFanOutConsumerDone = errors.New("consumer stopped reading")
+
+//fanOutWriter is the io.Writer that is used by FanOut(). It writes into all
+//pipes whose reading side is still active.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+}
+
+//Write implements the io.Writer interface.
+func (w *fanOutWriter) Write(buf []byte) (int, error) {
+	var active []*io.PipeWriter
+	for _, writer := range w.writers {
+		_, err := writer.Write(buf)
+		if err == nil {
+			active = append(active, writer)
+		}
+	}
+	w.writers = active
+	if len(active) == 0 {
+		return 0, errFanOutConsumerDone
+	}
+	return len(buf), nil
+}
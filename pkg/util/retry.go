@@ -0,0 +1,67 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import "github.com/sapcc/go-bits/logg"
+
+const (
+	maxTotalRetryCount = 10
+	maxRetryCount      = 3
+)
+
+//ReadRetryCounter decides whether a download shall be resumed after a read
+//error. It is used by EnhancedGet() and by the readers of source types that
+//download files in ranges (e.g. via SFTP).
+type ReadRetryCounter struct {
+	LastErrorAtOffset   int64 //at which offset the last read error occurred
+	LastErrorRetryCount int   //retry counter for said offset, or 0 if no error occurred before
+	TotalRetryCount     int   //retry counter for all read errors encountered at any offset
+}
+
+//ShouldRetry is called when a read error is encountered at the given offset,
+//and decides whether to retry or not. The description (e.g. "GET $URL") is
+//used for log messages.
+func (c *ReadRetryCounter) ShouldRetry(description string, offset int64) bool {
+	//never restart transfer of the same file more than 10 times
+	c.TotalRetryCount++
+	if c.TotalRetryCount > maxTotalRetryCount {
+		logg.Info("giving up on %s after %d read errors", description, maxTotalRetryCount)
+		return false
+	}
+
+	//if there was no error at this offset before, always retry
+	if c.LastErrorAtOffset != offset {
+		c.LastErrorAtOffset = offset
+		c.LastErrorRetryCount = 0
+		return true
+	}
+
+	//only retry an error at the same offset for 3 times
+	c.LastErrorRetryCount++
+	if c.LastErrorRetryCount > maxRetryCount {
+		logg.Info("giving up on %s after %d read errors at the same offset (%d)",
+			description,
+			maxRetryCount,
+			c.LastErrorAtOffset,
+		)
+		return false
+	}
+	return true
+}